@@ -3,13 +3,16 @@ package backends
 import (
 	"cas/localstorage"
 	"context"
+	"errors"
 	"io"
+	"os"
 	"time"
 )
 
 type Backend interface {
 	WriteMetadata(ctx context.Context, hash string, key string, value io.ReadSeeker) error
 	ReadMetadata(ctx context.Context, hash string, keys []string) (map[string]string, error)
+	FindHashes(ctx context.Context, query map[string]string) ([]string, error)
 
 	StoreArtifacts(ctx context.Context, hash string, files []*localstorage.LocalFile) ([]string, error)
 
@@ -18,10 +21,40 @@ type Backend interface {
 	FetchArtifacts(ctx context.Context, hash string) ([]*RemoteFile, error)
 }
 
+var ErrManifestUnsupported = errors.New("backend does not support manifests")
+
+// EncryptedValuePrefix marks metadata values which were encrypted before reaching the backend,
+// so that backends can tell their content isn't meaningful
+const EncryptedValuePrefix = "enc:v1:"
+
+// ManifestReader is implemented by backends which can read all of a hash's metadata at once.
+type ManifestReader interface {
+	// ReadManifest returns the hash's manifest.  If cached is given and is still current, it is
+	// returned rather than the manifest being read again.
+	ReadManifest(ctx context.Context, hash string, cached *Manifest) (*Manifest, error)
+}
+
+// ArtifactReader is implemented by backends which can read an artifact given its entry in the
+// hash's artifact manifest and the hash's timestamp, so that fetching many artifacts only reads
+// them once.
+type ArtifactReader interface {
+	ReadArtifact(ctx context.Context, hash string, name string, artifact Artifact, timestamp time.Time) (*RemoteFile, error)
+}
+
+type Manifest struct {
+	Metadata map[string]string `json:"metadata"`
+
+	// Version identifies the manifest's content, and is empty if the manifest can't be cached
+	Version string `json:"version"`
+}
+
 type RemoteFile struct {
 	Name      string
 	Timestamp time.Time
 	Content   io.ReadCloser
+
+	// Mode is the file's type and permissions, see localstorage.LocalFile
+	Mode os.FileMode
 }
 
 func (rf *RemoteFile) Close() error {
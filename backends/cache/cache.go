@@ -3,14 +3,18 @@ package cache
 import (
 	"cas/backends"
 	"cas/localstorage"
+	"cas/progress"
 	"cas/tracing"
 	"context"
+	"encoding/json"
 	"errors"
 	"io"
 	"os"
 	"path"
+	"time"
 
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
 )
 
@@ -18,10 +22,11 @@ func startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
 	return otel.Tracer("cache").Start(ctx, name)
 }
 
-func NewCachedBackend(wrapped backends.Backend) *CacheBackend {
+func NewCachedBackend(wrapped backends.Backend, concurrency int) *CacheBackend {
 	return &CacheBackend{
-		wrapped: wrapped,
-		root:    ".cas/cache",
+		wrapped:     wrapped,
+		root:        ".cas/cache",
+		concurrency: concurrency,
 	}
 }
 
@@ -29,6 +34,9 @@ type CacheBackend struct {
 	wrapped backends.Backend
 
 	root string
+
+	// how many artifacts FetchArtifacts downloads at once
+	concurrency int
 }
 
 // TODO: fix passthroughs
@@ -38,7 +46,104 @@ func (cache *CacheBackend) WriteMetadata(ctx context.Context, hash string, key s
 }
 
 func (cache *CacheBackend) ReadMetadata(ctx context.Context, hash string, keys []string) (map[string]string, error) {
-	return cache.wrapped.ReadMetadata(ctx, hash, keys)
+	ctx, span := startSpan(ctx, "read_metadata")
+	defer span.End()
+
+	manifest, err := cache.readManifest(ctx, hash)
+	if errors.Is(err, backends.ErrManifestUnsupported) {
+		return cache.wrapped.ReadMetadata(ctx, hash, keys)
+	}
+	if err != nil {
+		return nil, tracing.Error(span, err)
+	}
+
+	return backends.SelectMetadata(manifest.Metadata, keys), nil
+}
+
+// readManifest reads the hash's manifest, revalidating and updating the copy in the local
+// cache, so that unchanged manifests aren't downloaded again.
+func (cache *CacheBackend) readManifest(ctx context.Context, hash string) (*backends.Manifest, error) {
+	ctx, span := startSpan(ctx, "read_manifest")
+	defer span.End()
+
+	reader, ok := cache.wrapped.(backends.ManifestReader)
+	if !ok {
+		return nil, backends.ErrManifestUnsupported
+	}
+
+	cachePath := cache.manifestPathFor(hash)
+	cached := readCachedManifest(cachePath)
+
+	span.SetAttributes(attribute.Bool("cached", cached != nil))
+
+	manifest, err := reader.ReadManifest(ctx, hash, cached)
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest.Version == "" || (cached != nil && cached.Version == manifest.Version) {
+		return manifest, nil
+	}
+
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, tracing.Error(span, err)
+	}
+
+	if err := os.MkdirAll(path.Dir(cachePath), os.ModePerm); err != nil {
+		return nil, tracing.Error(span, err)
+	}
+
+	if err := os.WriteFile(cachePath, content, 0666); err != nil {
+		return nil, tracing.Error(span, err)
+	}
+
+	return manifest, nil
+}
+
+// readCachedManifest returns nil if there is no usable cached copy
+func readCachedManifest(cachePath string) *backends.Manifest {
+	content, err := os.ReadFile(cachePath)
+	if err != nil {
+		return nil
+	}
+
+	manifest := &backends.Manifest{}
+	if err := json.Unmarshal(content, manifest); err != nil {
+		return nil
+	}
+
+	return manifest
+}
+
+func (cache *CacheBackend) FindHashes(ctx context.Context, query map[string]string) ([]string, error) {
+	return cache.wrapped.FindHashes(ctx, query)
+}
+
+func (cache *CacheBackend) AcquireLease(ctx context.Context, hash string, ttl time.Duration) (bool, error) {
+	leaser, ok := cache.wrapped.(backends.Leaser)
+	if !ok {
+		return false, backends.ErrLeaseUnsupported
+	}
+
+	return leaser.AcquireLease(ctx, hash, ttl)
+}
+
+func (cache *CacheBackend) PresignArtifact(ctx context.Context, hash string, name string, expires time.Duration) (string, error) {
+	return backends.PresignArtifact(ctx, cache.wrapped, hash, name, expires)
+}
+
+func (cache *CacheBackend) PresignArchive(ctx context.Context, hash string, write func(io.Writer) error, expires time.Duration) (string, error) {
+	return backends.PresignArchive(ctx, cache.wrapped, hash, write, expires)
+}
+
+func (cache *CacheBackend) ReleaseLease(ctx context.Context, hash string) error {
+	leaser, ok := cache.wrapped.(backends.Leaser)
+	if !ok {
+		return backends.ErrLeaseUnsupported
+	}
+
+	return leaser.ReleaseLease(ctx, hash)
 }
 
 func (cache *CacheBackend) StoreArtifacts(ctx context.Context, hash string, files []*localstorage.LocalFile) ([]string, error) {
@@ -55,118 +160,328 @@ func (cache *CacheBackend) FetchArtifact(ctx context.Context, hash string, name
 	ctx, span := startSpan(ctx, "fetch_artifact")
 	defer span.End()
 
-	file, err := cache.readCacheFile(ctx, hash, name)
+	manifest, _, err := backends.ReadArtifactManifest(ctx, cache, hash)
 	if err != nil {
 		return nil, tracing.Error(span, err)
 	}
 
-	if file != nil {
-		return file, nil
-	}
+	progress.FromContext(ctx).Expect(1, manifest[name].Size)
 
-	remoteFile, err := cache.wrapped.FetchArtifact(ctx, hash, name)
+	file, err := cache.fetchArtifact(ctx, hash, name, manifest)
 	if err != nil {
 		return nil, tracing.Error(span, err)
 	}
 
-	if err := cache.writeCacheFile(ctx, hash, remoteFile); err != nil {
-		return nil, tracing.Error(span, err)
+	return file, nil
+}
+
+// fetchArtifact reads the artifact from the cache, or fetches it if it isn't cached.  Cached
+// artifacts are plain files, so their mode comes from the hash's manifest.
+func (cache *CacheBackend) fetchArtifact(ctx context.Context, hash string, name string, manifest backends.ArtifactManifest) (*backends.RemoteFile, error) {
+	cached, err := cache.checkCached(ctx, hash, name, manifest)
+	if err != nil {
+		return nil, err
 	}
-	remoteFile.Close()
 
-	// now pull back from the local cache
-	file, err = cache.readCacheFile(ctx, hash, name)
+	if cached {
+		file, err := cache.readCacheFile(ctx, hash, name)
+		if err != nil {
+			return nil, err
+		}
+
+		if file != nil {
+			file.Mode = manifest[name].Mode
+			progress.FromContext(ctx).CacheHit(name, manifest[name].Size)
+			return file, nil
+		}
+	}
+
+	remoteFile, err := cache.wrapped.FetchArtifact(ctx, hash, name)
 	if err != nil {
-		return nil, tracing.Error(span, err)
+		return nil, err
 	}
 
-	return file, nil
+	remoteFile.Content = progress.FromContext(ctx).Reader(name, manifest[name].Size, remoteFile.Content)
+
+	// the artifact is streamed to the caller while being written to the cache, rather than
+	// being downloaded completely first
+	content, err := cache.newCachingReader(hash, remoteFile)
+	if err != nil {
+		remoteFile.Close()
+		return nil, err
+	}
+
+	return &backends.RemoteFile{
+		Name:      remoteFile.Name,
+		Timestamp: remoteFile.Timestamp,
+		Content:   content,
+		Mode:      remoteFile.Mode,
+	}, nil
+}
+
+// checkCached returns true if the artifact is cached and matches the digest in the manifest.
+// Corrupt copies, and copies of artifacts no longer in the manifest, are removed so that they
+// are never served.
+func (cache *CacheBackend) checkCached(ctx context.Context, hash string, name string, manifest backends.ArtifactManifest) (bool, error) {
+	artifact, found := manifest[name]
+	if !found {
+		return false, cache.removeCached(hash, name)
+	}
+
+	digest, cached, err := cache.verifiedDigest(hash, name)
+	if err != nil || !cached {
+		return false, err
+	}
+
+	if digest == artifact.Digest {
+		return true, nil
+	}
+
+	// the cached copy is corrupt, so replace it with the remote copy
+	trace.SpanFromContext(ctx).AddEvent("corrupt_cache_file", trace.WithAttributes(
+		attribute.String("name", name),
+		attribute.String("digest", digest),
+	))
+
+	return false, cache.removeCached(hash, name)
+}
+
+func (cache *CacheBackend) removeCached(hash string, name string) error {
+	if err := os.Remove(cache.cachePathFor(hash, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if err := os.Remove(cache.digestPathFor(hash, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
 }
 
+// FetchArtifacts downloads the artifacts which aren't cached into the cache in parallel, and
+// then reads them all from the cache.
 func (cache *CacheBackend) FetchArtifacts(ctx context.Context, hash string) ([]*backends.RemoteFile, error) {
 	ctx, span := startSpan(ctx, "fetch_artifacts")
 	defer span.End()
 
-	paths, err := cache.wrapped.ListArtifacts(ctx, hash)
+	manifest, _, err := backends.ReadArtifactManifest(ctx, cache, hash)
+	if err != nil {
+		return nil, tracing.Error(span, err)
+	}
+
+	paths := manifest.Paths()
+	if len(paths) == 0 {
+		return []*backends.RemoteFile{}, nil
+	}
+
+	total := int64(0)
+	for _, artifact := range manifest {
+		total += artifact.Size
+	}
+
+	progress.FromContext(ctx).Expect(len(paths), total)
+
+	// the timestamp is the same for every artifact, so it is only read once
+	ts, _, err := backends.ReadTimestamp(ctx, cache, hash)
 	if err != nil {
 		return nil, tracing.Error(span, err)
 	}
 
+	downloaded, err := backends.ForEach(ctx, cache.concurrency, paths, func(ctx context.Context, name string) (bool, error) {
+		return cache.download(ctx, hash, name, manifest, ts)
+	})
+	if err != nil {
+		return nil, tracing.Error(span, err)
+	}
+
+	count := 0
+	for _, d := range downloaded {
+		if d {
+			count++
+		}
+	}
+
+	span.SetAttributes(
+		attribute.Int("artifacts", len(paths)),
+		attribute.Int("downloaded", count),
+	)
+
 	remoteFiles := make([]*backends.RemoteFile, 0, len(paths))
 	for _, path := range paths {
-		remoteFile, err := cache.FetchArtifact(ctx, hash, path)
+		remoteFile, err := cache.readCacheFile(ctx, hash, path)
+		if err == nil && remoteFile == nil {
+			// removed from the cache since it was downloaded, so fetch it again
+			remoteFile, err = cache.fetchArtifact(ctx, hash, path, manifest)
+		}
 		if err != nil {
 			closeAll(remoteFiles)
 			return nil, tracing.Error(span, err)
 		}
 
+		remoteFile.Mode = manifest[path].Mode
 		remoteFiles = append(remoteFiles, remoteFile)
 	}
 
 	return remoteFiles, nil
 }
 
-func (cache *CacheBackend) readCacheFile(ctx context.Context, hash string, name string) (*backends.RemoteFile, error) {
-	ctx, span := startSpan(ctx, "read_cache_file")
-	defer span.End()
+// recordedDigest is the digest of a cached file, which is still valid while the file's size and
+// modification time are unchanged
+type recordedDigest struct {
+	Digest   string    `json:"digest"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
 
-	cachePath := cache.cachePathFor(hash, name)
-	file, err := os.Open(cachePath)
+// verifiedDigest returns the digest of the cached copy of an artifact, from the digest recorded
+// when it was cached if the file hasn't changed since, so that it isn't hashed on every fetch.
+func (cache *CacheBackend) verifiedDigest(hash string, name string) (string, bool, error) {
+	info, err := os.Stat(cache.cachePathFor(hash, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false, nil
+	}
 	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return nil, nil
+		return "", false, err
+	}
+
+	if content, err := os.ReadFile(cache.digestPathFor(hash, name)); err == nil {
+		recorded := recordedDigest{}
+		if json.Unmarshal(content, &recorded) == nil && recorded.Size == info.Size() && recorded.Modified.Equal(info.ModTime()) {
+			return recorded.Digest, true, nil
 		}
+	}
 
-		return nil, tracing.Error(span, err)
+	digest, cached, err := cache.CachedDigest(hash, name)
+	if err != nil || !cached {
+		return "", false, err
 	}
 
-	stats, err := file.Stat()
+	return digest, true, cache.recordDigest(hash, name, digest)
+}
+
+// recordDigest stores the digest of a cached file, with the file's current size and
+// modification time
+func (cache *CacheBackend) recordDigest(hash string, name string, digest string) error {
+	info, err := os.Stat(cache.cachePathFor(hash, name))
 	if err != nil {
-		return nil, tracing.Error(span, err)
+		return err
 	}
 
-	return &backends.RemoteFile{
-		Name:      name,
-		Timestamp: stats.ModTime(),
-		Content:   file,
-	}, nil
+	content, err := json.Marshal(recordedDigest{Digest: digest, Size: info.Size(), Modified: info.ModTime()})
+	if err != nil {
+		return err
+	}
+
+	digestPath := cache.digestPathFor(hash, name)
+	if err := os.MkdirAll(path.Dir(digestPath), os.ModePerm); err != nil {
+		return err
+	}
+
+	return os.WriteFile(digestPath, content, 0666)
 }
 
-func (cache *CacheBackend) writeCacheFile(ctx context.Context, hash string, remoteFile *backends.RemoteFile) error {
-	ctx, span := startSpan(ctx, "write_cache_file")
+// download writes the artifact into the cache unless a valid copy is already there, and
+// returns true if it was downloaded
+func (cache *CacheBackend) download(ctx context.Context, hash string, name string, manifest backends.ArtifactManifest, ts time.Time) (bool, error) {
+	ctx, span := startSpan(ctx, "download")
 	defer span.End()
 
-	localPath := cache.cachePathFor(hash, remoteFile.Name)
+	span.SetAttributes(attribute.String("name", name))
+
+	cached, err := cache.checkCached(ctx, hash, name, manifest)
+	if err != nil {
+		return false, tracing.Error(span, err)
+	}
+
+	span.SetAttributes(attribute.Bool("cached", cached))
+
+	tracker := progress.FromContext(ctx)
 
-	if err := os.MkdirAll(path.Dir(localPath), os.ModePerm); err != nil {
-		return tracing.Error(span, err)
+	if cached {
+		tracker.CacheHit(name, manifest[name].Size)
+		return false, nil
 	}
 
-	f, err := os.Create(localPath)
+	var remoteFile *backends.RemoteFile
+	if reader, ok := cache.wrapped.(backends.ArtifactReader); ok {
+		remoteFile, err = reader.ReadArtifact(ctx, hash, name, manifest[name], ts)
+	} else {
+		remoteFile, err = cache.wrapped.FetchArtifact(ctx, hash, name)
+	}
 	if err != nil {
-		return tracing.Error(span, err)
+		return false, tracing.Error(span, err)
 	}
-	defer f.Close()
 
-	if _, err := io.Copy(f, remoteFile.Content); err != nil {
-		return tracing.Error(span, err)
+	remoteFile.Content = tracker.Reader(name, manifest[name].Size, remoteFile.Content)
+
+	content, err := cache.newCachingReader(hash, remoteFile)
+	if err != nil {
+		remoteFile.Close()
+		return false, tracing.Error(span, err)
 	}
 
-	if err := f.Close(); err != nil {
-		return tracing.Error(span, err)
+	// the caching reader only adds the file to the cache once it has been read completely,
+	// which also checks its digest
+	_, err = io.Copy(io.Discard, content)
+	if err := errors.Join(err, content.Close()); err != nil {
+		return false, tracing.Error(span, err)
 	}
 
-	if err := os.Chtimes(localPath, remoteFile.Timestamp, remoteFile.Timestamp); err != nil {
-		return tracing.Error(span, err)
+	return true, nil
+}
+
+// CachedDigest hashes the cached copy of an artifact, and returns false if the artifact isn't
+// cached.
+func (cache *CacheBackend) CachedDigest(hash string, name string) (string, bool, error) {
+	digest, err := backends.FileDigest(cache.cachePathFor(hash, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
 	}
 
-	return nil
+	return digest, true, nil
+}
+
+func (cache *CacheBackend) readCacheFile(ctx context.Context, hash string, name string) (*backends.RemoteFile, error) {
+	ctx, span := startSpan(ctx, "read_cache_file")
+	defer span.End()
+
+	cachePath := cache.cachePathFor(hash, name)
+	file, err := os.Open(cachePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, tracing.Error(span, err)
+	}
+
+	stats, err := file.Stat()
+	if err != nil {
+		return nil, tracing.Error(span, err)
+	}
+
+	return &backends.RemoteFile{
+		Name:      name,
+		Timestamp: stats.ModTime(),
+		Content:   file,
+	}, nil
 }
 
 func (cache *CacheBackend) cachePathFor(hash string, name string) string {
 	return path.Join(cache.root, hash, name)
 }
 
+func (cache *CacheBackend) digestPathFor(hash string, name string) string {
+	return path.Join(cache.root, "@digests", hash, name+".json")
+}
+
+func (cache *CacheBackend) manifestPathFor(hash string) string {
+	return path.Join(cache.root, "@manifests", hash+".json")
+}
+
 func closeAll(files []*backends.RemoteFile) {
 	for _, f := range files {
 		f.Close()
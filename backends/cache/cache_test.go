@@ -0,0 +1,297 @@
+package cache
+
+import (
+	"cas/backends"
+	"cas/localstorage"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryBackend serves the artifacts of a single hash from memory, with their manifest and
+// timestamp as its metadata
+type memoryBackend struct {
+	artifacts map[string]string
+	timestamp time.Time
+
+	// delay is the longest a fetch waits before returning, so that fetches finish out of order
+	delay time.Duration
+
+	fetches atomic.Int32
+}
+
+func newMemoryBackend(artifacts map[string]string) *memoryBackend {
+	return &memoryBackend{
+		artifacts: artifacts,
+		timestamp: time.Unix(1700000000, 0),
+	}
+}
+
+func (m *memoryBackend) WriteMetadata(ctx context.Context, hash string, key string, value io.ReadSeeker) error {
+	return fmt.Errorf("metadata can't be written")
+}
+
+func (m *memoryBackend) ReadMetadata(ctx context.Context, hash string, keys []string) (map[string]string, error) {
+	manifest := backends.ArtifactManifest{}
+	for name, content := range m.artifacts {
+		manifest[name] = backends.Artifact{Digest: digestOf(content), Size: int64(len(content))}
+	}
+
+	encoded, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return backends.SelectMetadata(map[string]string{
+		backends.MetadataArtifacts: string(encoded),
+		backends.MetadataTimeStamp: strconv.FormatInt(m.timestamp.Unix(), 10),
+	}, keys), nil
+}
+
+func (m *memoryBackend) FindHashes(ctx context.Context, query map[string]string) ([]string, error) {
+	return []string{}, nil
+}
+
+func (m *memoryBackend) StoreArtifacts(ctx context.Context, hash string, files []*localstorage.LocalFile) ([]string, error) {
+	return nil, fmt.Errorf("artifacts can't be stored")
+}
+
+func (m *memoryBackend) ListArtifacts(ctx context.Context, hash string) ([]string, error) {
+	names := make([]string, 0, len(m.artifacts))
+	for name := range m.artifacts {
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+func (m *memoryBackend) FetchArtifact(ctx context.Context, hash string, name string) (*backends.RemoteFile, error) {
+	content, found := m.artifacts[name]
+	if !found {
+		return nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+
+	m.fetches.Add(1)
+
+	if m.delay > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(m.delay))))
+	}
+
+	return &backends.RemoteFile{
+		Name:      name,
+		Timestamp: m.timestamp,
+		Content:   io.NopCloser(strings.NewReader(content)),
+	}, nil
+}
+
+func (m *memoryBackend) FetchArtifacts(ctx context.Context, hash string) ([]*backends.RemoteFile, error) {
+	return nil, fmt.Errorf("artifacts can only be fetched one at a time")
+}
+
+func digestOf(content string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(content)))
+}
+
+func createCache(t *testing.T, remote backends.Backend) *CacheBackend {
+	cache := NewCachedBackend(remote, 4)
+	cache.root = t.TempDir()
+
+	return cache
+}
+
+func fetch(t *testing.T, cache *CacheBackend, hash string, name string) string {
+	file, err := cache.FetchArtifact(context.Background(), hash, name)
+	require.NoError(t, err)
+
+	content, err := io.ReadAll(file.Content)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	return string(content)
+}
+
+func TestCachedDigestsAreRecorded(t *testing.T) {
+	remote := newMemoryBackend(map[string]string{"dist/app": "some content"})
+	cache := createCache(t, remote)
+
+	assert.Equal(t, "some content", fetch(t, cache, "abc", "dist/app"))
+
+	content, err := os.ReadFile(cache.digestPathFor("abc", "dist/app"))
+	require.NoError(t, err)
+
+	recorded := recordedDigest{}
+	require.NoError(t, json.Unmarshal(content, &recorded))
+	assert.Equal(t, digestOf("some content"), recorded.Digest)
+	assert.Equal(t, int64(len("some content")), recorded.Size)
+
+	assert.Equal(t, "some content", fetch(t, cache, "abc", "dist/app"))
+	assert.Equal(t, int32(1), remote.fetches.Load(), "the cached copy should be served")
+}
+
+func TestRecordedDigestsAreOnlyTrustedForUnchangedFiles(t *testing.T) {
+	remote := newMemoryBackend(map[string]string{"dist/app": "some content"})
+	cache := createCache(t, remote)
+
+	fetch(t, cache, "abc", "dist/app")
+
+	// while the file is unchanged, the recorded digest is used rather than hashing it again
+	digestPath := cache.digestPathFor("abc", "dist/app")
+	content, err := os.ReadFile(digestPath)
+	require.NoError(t, err)
+
+	recorded := recordedDigest{}
+	require.NoError(t, json.Unmarshal(content, &recorded))
+	recorded.Digest = "recorded"
+
+	content, err = json.Marshal(recorded)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(digestPath, content, 0666))
+
+	digest, cached, err := cache.verifiedDigest("abc", "dist/app")
+	require.NoError(t, err)
+	assert.True(t, cached)
+	assert.Equal(t, "recorded", digest)
+
+	// once the file changes, it is hashed again and the new digest recorded
+	cachePath := cache.cachePathFor("abc", "dist/app")
+	require.NoError(t, os.WriteFile(cachePath, []byte("changed content"), 0666))
+
+	digest, cached, err = cache.verifiedDigest("abc", "dist/app")
+	require.NoError(t, err)
+	assert.True(t, cached)
+	assert.Equal(t, digestOf("changed content"), digest)
+
+	content, err = os.ReadFile(digestPath)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(content, &recorded))
+	assert.Equal(t, digestOf("changed content"), recorded.Digest)
+
+	// and as it no longer matches the manifest, it is fetched again
+	assert.Equal(t, "some content", fetch(t, cache, "abc", "dist/app"))
+	assert.Equal(t, int32(2), remote.fetches.Load())
+}
+
+func TestCachedDigest(t *testing.T) {
+	remote := newMemoryBackend(map[string]string{"dist/app": "some content"})
+	cache := createCache(t, remote)
+
+	_, cached, err := cache.CachedDigest("abc", "dist/app")
+	require.NoError(t, err)
+	assert.False(t, cached)
+
+	fetch(t, cache, "abc", "dist/app")
+
+	digest, cached, err := cache.CachedDigest("abc", "dist/app")
+	require.NoError(t, err)
+	assert.True(t, cached)
+	assert.Equal(t, digestOf("some content"), digest)
+}
+
+func TestPartialReadsAreNotCached(t *testing.T) {
+	remote := newMemoryBackend(map[string]string{"dist/app": "some content"})
+	cache := createCache(t, remote)
+
+	file, err := cache.FetchArtifact(context.Background(), "abc", "dist/app")
+	require.NoError(t, err)
+
+	partial := make([]byte, 4)
+	_, err = io.ReadFull(file.Content, partial)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	assert.NoFileExists(t, cache.cachePathFor("abc", "dist/app"))
+	assert.NoFileExists(t, cache.digestPathFor("abc", "dist/app"))
+
+	leftovers, err := filepath.Glob(path.Join(cache.root, "abc", "dist", ".partial-*"))
+	require.NoError(t, err)
+	assert.Empty(t, leftovers)
+
+	// so the next fetch reads it from the remote again
+	assert.Equal(t, "some content", fetch(t, cache, "abc", "dist/app"))
+	assert.Equal(t, int32(2), remote.fetches.Load())
+	assert.FileExists(t, cache.cachePathFor("abc", "dist/app"))
+}
+
+func TestCorruptCacheEntriesAreRemoved(t *testing.T) {
+	remote := newMemoryBackend(map[string]string{"one": "first", "two": "second"})
+	cache := createCache(t, remote)
+
+	files, err := cache.FetchArtifacts(context.Background(), "abc")
+	require.NoError(t, err)
+	closeAll(files)
+	require.Equal(t, int32(2), remote.fetches.Load())
+
+	require.NoError(t, os.WriteFile(cache.cachePathFor("abc", "two"), []byte("corrupt"), 0666))
+
+	files, err = cache.FetchArtifacts(context.Background(), "abc")
+	require.NoError(t, err)
+	defer closeAll(files)
+
+	require.Len(t, files, 2)
+	content, err := io.ReadAll(files[1].Content)
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(content))
+	assert.Equal(t, int32(3), remote.fetches.Load(), "only the corrupt artifact should be fetched again")
+
+	digest, cached, err := cache.CachedDigest("abc", "two")
+	require.NoError(t, err)
+	assert.True(t, cached)
+	assert.Equal(t, digestOf("second"), digest)
+}
+
+func TestUnlistedCacheEntriesAreRemoved(t *testing.T) {
+	remote := newMemoryBackend(map[string]string{"one": "first"})
+	cache := createCache(t, remote)
+
+	// a copy of an artifact which isn't in the hash's manifest
+	cachePath := cache.cachePathFor("abc", "stale")
+	require.NoError(t, os.MkdirAll(path.Dir(cachePath), os.ModePerm))
+	require.NoError(t, os.WriteFile(cachePath, []byte("stale"), 0666))
+	require.NoError(t, cache.recordDigest("abc", "stale", digestOf("stale")))
+
+	_, err := cache.FetchArtifact(context.Background(), "abc", "stale")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	assert.NoFileExists(t, cachePath)
+	assert.NoFileExists(t, cache.digestPathFor("abc", "stale"))
+}
+
+func TestFetchArtifactsKeepsManifestOrder(t *testing.T) {
+	artifacts := map[string]string{}
+	for i := 0; i < 50; i++ {
+		artifacts[fmt.Sprintf("dist/file-%02d", i)] = fmt.Sprintf("content of %d", i)
+	}
+
+	remote := newMemoryBackend(artifacts)
+	remote.delay = 5 * time.Millisecond
+	cache := createCache(t, remote)
+
+	files, err := cache.FetchArtifacts(context.Background(), "abc")
+	require.NoError(t, err)
+	defer closeAll(files)
+
+	require.Len(t, files, len(artifacts))
+	for i, file := range files {
+		assert.Equal(t, fmt.Sprintf("dist/file-%02d", i), file.Name)
+
+		content, err := io.ReadAll(file.Content)
+		require.NoError(t, err)
+		assert.Equal(t, artifacts[file.Name], string(content))
+	}
+
+	assert.Equal(t, int32(len(artifacts)), remote.fetches.Load())
+}
@@ -0,0 +1,97 @@
+package cache
+
+import (
+	"cas/backends"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+// cachingReader copies everything read from a remote file into the cache.  The file is only
+// added to the cache once it has been read completely, so an interrupted read never leaves a
+// partial artifact behind.  Its digest is recorded alongside it, so later fetches don't need to
+// hash it again.
+type cachingReader struct {
+	cache     *CacheBackend
+	hash      string
+	name      string
+	remote    io.ReadCloser
+	temp      *os.File
+	dest      string
+	timestamp time.Time
+	digest    hash.Hash
+	complete  bool
+}
+
+func (cache *CacheBackend) newCachingReader(hash string, remoteFile *backends.RemoteFile) (*cachingReader, error) {
+	dest := cache.cachePathFor(hash, remoteFile.Name)
+
+	if err := os.MkdirAll(path.Dir(dest), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	temp, err := os.CreateTemp(path.Dir(dest), ".partial-*")
+	if err != nil {
+		return nil, err
+	}
+
+	return &cachingReader{
+		cache:     cache,
+		hash:      hash,
+		name:      remoteFile.Name,
+		remote:    remoteFile.Content,
+		temp:      temp,
+		dest:      dest,
+		timestamp: remoteFile.Timestamp,
+		digest:    sha1.New(),
+	}, nil
+}
+
+func (r *cachingReader) Read(p []byte) (int, error) {
+	n, err := r.remote.Read(p)
+
+	if n > 0 {
+		if _, werr := r.temp.Write(p[:n]); werr != nil {
+			return n, werr
+		}
+		r.digest.Write(p[:n])
+	}
+
+	if err == io.EOF {
+		r.complete = true
+	}
+
+	return n, err
+}
+
+func (r *cachingReader) Close() error {
+	remoteErr := r.remote.Close()
+	tempErr := r.temp.Close()
+
+	if !r.complete || tempErr != nil {
+		os.Remove(r.temp.Name())
+		return errors.Join(remoteErr, tempErr)
+	}
+
+	if err := os.Chtimes(r.temp.Name(), r.timestamp, r.timestamp); err != nil {
+		os.Remove(r.temp.Name())
+		return errors.Join(remoteErr, err)
+	}
+
+	if err := os.Rename(r.temp.Name(), r.dest); err != nil {
+		os.Remove(r.temp.Name())
+		return errors.Join(remoteErr, err)
+	}
+
+	digest := fmt.Sprintf("%x", r.digest.Sum(nil))
+	if err := r.cache.recordDigest(r.hash, r.name, digest); err != nil {
+		return errors.Join(remoteErr, err)
+	}
+
+	return remoteErr
+}
@@ -0,0 +1,103 @@
+package backends
+
+import (
+	"bytes"
+	"cas/tracing"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// MetadataConflicts holds a json list of every conflicting push to the hash
+const MetadataConflicts = "@conflicts"
+
+// MetadataConflicted is set to `true` on any hash which has had a conflicting push, so that
+// nondeterministic builds can be found with `cas meta find`
+const MetadataConflicted = "cas.conflicted"
+
+type ConflictPolicy string
+
+const (
+	// ConflictFail refuses to store an artifact whose content differs from the existing one
+	ConflictFail ConflictPolicy = "fail"
+	// ConflictWarn replaces the existing artifact, but reports the conflict
+	ConflictWarn ConflictPolicy = "warn"
+	// ConflictOverwrite replaces the existing artifact silently
+	ConflictOverwrite ConflictPolicy = "overwrite"
+)
+
+func ParseConflictPolicy(value string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(strings.ToLower(value)); policy {
+	case ConflictFail, ConflictWarn, ConflictOverwrite:
+		return policy, nil
+	}
+
+	return "", fmt.Errorf("unsupported conflict policy '%s', expected one of: %s, %s, %s", value, ConflictFail, ConflictWarn, ConflictOverwrite)
+}
+
+type Conflict struct {
+	Path     string    `json:"path"`
+	Existing string    `json:"existing"`
+	Incoming string    `json:"incoming"`
+	When     time.Time `json:"when"`
+}
+
+func (c Conflict) Err() error {
+	return fmt.Errorf("%s already exists with different content (%s), not replacing with %s", c.Path, c.Existing, c.Incoming)
+}
+
+// ConflictError is returned by StoreArtifacts when an artifact already exists with different
+// content.  With the warn policy, the artifacts have still been stored.
+type ConflictError struct {
+	Policy    ConflictPolicy
+	Conflicts []Conflict
+}
+
+func (e *ConflictError) Error() string {
+	paths := make([]string, len(e.Conflicts))
+	for i, c := range e.Conflicts {
+		paths[i] = c.Path
+	}
+
+	return fmt.Sprintf("artifacts already exist with different content: %s", strings.Join(paths, ", "))
+}
+
+// RecordConflicts appends the conflicts to the hash's metadata
+func RecordConflicts(ctx context.Context, backend Backend, hash string, conflicts []Conflict) error {
+	ctx, span := otel.Tracer("backends").Start(ctx, "record_conflicts")
+	defer span.End()
+
+	span.SetAttributes(attribute.Int("conflicts", len(conflicts)))
+
+	meta, err := backend.ReadMetadata(ctx, hash, []string{MetadataConflicts})
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	existing := []Conflict{}
+	if content, found := meta[MetadataConflicts]; found {
+		if err := json.Unmarshal([]byte(content), &existing); err != nil {
+			return tracing.Error(span, err)
+		}
+	}
+
+	content, err := json.Marshal(append(existing, conflicts...))
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	if err := backend.WriteMetadata(ctx, hash, MetadataConflicts, bytes.NewReader(content)); err != nil {
+		return tracing.Error(span, err)
+	}
+
+	if err := backend.WriteMetadata(ctx, hash, MetadataConflicted, strings.NewReader("true")); err != nil {
+		return tracing.Error(span, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,17 @@
+package backends
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrCopyUnsupported = errors.New("backend can't copy hashes from the source backend")
+
+// HashCopier is implemented by backends which can copy a hash from another backend, keeping its
+// metadata, timestamp and artifact digests.
+type HashCopier interface {
+	// CopyHash copies the hash's artifacts and then its metadata, so the hash isn't visible until
+	// every artifact is copied.  Artifacts which were already copied are skipped, so an
+	// interrupted copy can be run again.  It returns how many artifacts were transferred.
+	CopyHash(ctx context.Context, source Backend, hash string) (int, error)
+}
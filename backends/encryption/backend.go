@@ -0,0 +1,439 @@
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"cas/backends"
+	"cas/backends/signing"
+	"cas/localstorage"
+	"cas/tracing"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// KeyMetadata is the artifact metadata holding the id of the key an artifact was encrypted with
+const KeyMetadata = "encryption-key"
+
+// ErrNotEncrypted is returned when encryption is required, and an artifact was stored without it,
+// such as by someone with write access to the bucket but not the keys.  Metadata values stored
+// without it are left out of the metadata read instead.
+var ErrNotEncrypted = errors.New("content is not encrypted")
+
+// encrypted metadata values are marked, so that values written before encryption was enabled
+// are still readable
+const valuePrefix = backends.EncryptedValuePrefix
+
+// these keys are read by cas itself, and hold no user data, so are stored as plain text
+var plaintextKeys = map[string]bool{
+	backends.MetadataTimeStamp:  true,
+	backends.MetadataArtifacts:  true,
+	backends.MetadataConflicts:  true,
+	backends.MetadataConflicted: true,
+	signing.MetadataSignature:   true,
+}
+
+func startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return otel.Tracer("encryption").Start(ctx, name)
+}
+
+// NewEncryptedBackend encrypts artifact content and metadata values before they reach the
+// wrapped backend, and decrypts them when they are read.  Artifact paths and metadata keys are
+// not encrypted.  When required is true, content read without encryption is rejected, otherwise
+// it is returned as it is, so that content stored before encryption was enabled stays readable.
+func NewEncryptedBackend(wrapped backends.Backend, keyring *Keyring, required bool) *EncryptedBackend {
+	return &EncryptedBackend{
+		wrapped:  wrapped,
+		keyring:  keyring,
+		required: required,
+	}
+}
+
+type EncryptedBackend struct {
+	wrapped  backends.Backend
+	keyring  *Keyring
+	required bool
+}
+
+func (e *EncryptedBackend) WriteMetadata(ctx context.Context, hash string, key string, value io.ReadSeeker) error {
+	ctx, span := startSpan(ctx, "write_metadata")
+	defer span.End()
+
+	if plaintextKeys[key] {
+		return e.wrapped.WriteMetadata(ctx, hash, key, value)
+	}
+
+	content, err := io.ReadAll(value)
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	encrypted, err := e.encryptValue(key, string(content))
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	if err := e.wrapped.WriteMetadata(ctx, hash, key, strings.NewReader(encrypted)); err != nil {
+		return tracing.Error(span, err)
+	}
+
+	return nil
+}
+
+func (e *EncryptedBackend) ReadMetadata(ctx context.Context, hash string, keys []string) (map[string]string, error) {
+	ctx, span := startSpan(ctx, "read_metadata")
+	defer span.End()
+
+	meta, err := e.wrapped.ReadMetadata(ctx, hash, keys)
+	if err != nil {
+		return nil, tracing.Error(span, err)
+	}
+
+	for key, value := range meta {
+		if plaintextKeys[key] {
+			continue
+		}
+
+		decrypted, err := e.decryptValue(value)
+		if errors.Is(err, ErrNotEncrypted) {
+			// only the value is rejected, so the hash's other metadata can still be read
+			span.AddEvent("unencrypted_value_rejected", trace.WithAttributes(attribute.String("key", key)))
+			delete(meta, key)
+			continue
+		}
+		if err != nil {
+			return nil, tracing.Error(span, fmt.Errorf("metadata %s: %w", key, err))
+		}
+
+		meta[key] = decrypted
+	}
+
+	return meta, nil
+}
+
+// FindHashes searches for the encrypted values, which only finds values encrypted with the
+// current key, as each key encrypts a value differently.
+func (e *EncryptedBackend) FindHashes(ctx context.Context, query map[string]string) ([]string, error) {
+	ctx, span := startSpan(ctx, "find_hashes")
+	defer span.End()
+
+	encrypted := make(map[string]string, len(query))
+	for key, value := range query {
+		if plaintextKeys[key] {
+			encrypted[key] = value
+			continue
+		}
+
+		encryptedValue, err := e.encryptValue(key, value)
+		if err != nil {
+			return nil, tracing.Error(span, err)
+		}
+
+		encrypted[key] = encryptedValue
+	}
+
+	hashes, err := e.wrapped.FindHashes(ctx, encrypted)
+	if err != nil {
+		return nil, tracing.Error(span, err)
+	}
+
+	return hashes, nil
+}
+
+// encryptValue encrypts a metadata value deterministically, so that the backend can still
+// index and find it.  The key is part of the salt, so the same value under different keys
+// can't be matched up.
+func (e *EncryptedBackend) encryptValue(key string, value string) (string, error) {
+	current := e.keyring.Current
+
+	salt, err := convergentSalt(current, "metadata\x00"+key, strings.NewReader(value))
+	if err != nil {
+		return "", err
+	}
+
+	buffer := &bytes.Buffer{}
+
+	writer, err := newEncryptWriter(buffer, current, salt)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := writer.Write([]byte(value)); err != nil {
+		return "", err
+	}
+
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	return valuePrefix + base64.RawURLEncoding.EncodeToString(buffer.Bytes()), nil
+}
+
+func (e *EncryptedBackend) decryptValue(value string) (string, error) {
+	encoded, found := strings.CutPrefix(value, valuePrefix)
+	if !found {
+		if e.required {
+			return "", ErrNotEncrypted
+		}
+
+		return value, nil
+	}
+
+	encrypted, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+
+	reader, err := newDecryptReader(bytes.NewReader(encrypted), e.keyring)
+	if err != nil {
+		return "", err
+	}
+
+	decrypted, err := io.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+
+	return string(decrypted), nil
+}
+
+func (e *EncryptedBackend) AcquireLease(ctx context.Context, hash string, ttl time.Duration) (bool, error) {
+	leaser, ok := e.wrapped.(backends.Leaser)
+	if !ok {
+		return false, backends.ErrLeaseUnsupported
+	}
+
+	return leaser.AcquireLease(ctx, hash, ttl)
+}
+
+func (e *EncryptedBackend) ReleaseLease(ctx context.Context, hash string) error {
+	leaser, ok := e.wrapped.(backends.Leaser)
+	if !ok {
+		return backends.ErrLeaseUnsupported
+	}
+
+	return leaser.ReleaseLease(ctx, hash)
+}
+
+// PresignArtifact refuses, as the url would download the encrypted content
+func (e *EncryptedBackend) PresignArtifact(ctx context.Context, hash string, name string, expires time.Duration) (string, error) {
+	return "", fmt.Errorf("%w: artifacts are encrypted", backends.ErrPresignUnsupported)
+}
+
+// PresignArchive refuses, as the archive would be stored without encryption
+func (e *EncryptedBackend) PresignArchive(ctx context.Context, hash string, write func(io.Writer) error, expires time.Duration) (string, error) {
+	return "", fmt.Errorf("%w: artifacts are encrypted", backends.ErrPresignUnsupported)
+}
+
+func (e *EncryptedBackend) StoreArtifacts(ctx context.Context, hash string, files []*localstorage.LocalFile) ([]string, error) {
+	ctx, span := startSpan(ctx, "store_artifacts")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("key_id", e.keyring.Current.ID))
+
+	encrypted := make([]*localstorage.LocalFile, 0, len(files))
+	defer func() {
+		for _, file := range encrypted {
+			file.Close()
+		}
+	}()
+
+	for _, file := range files {
+		content, err := e.encryptArtifact(file.Content)
+		if err != nil {
+			return nil, tracing.Error(span, err)
+		}
+
+		metadata := map[string]string{}
+		for key, value := range file.Metadata {
+			metadata[key] = value
+		}
+		metadata[KeyMetadata] = e.keyring.Current.ID
+
+		encrypted = append(encrypted, &localstorage.LocalFile{
+			Path:     file.Path,
+			Content:  content,
+			Mode:     file.Mode,
+			Metadata: metadata,
+		})
+	}
+
+	stored, err := e.wrapped.StoreArtifacts(ctx, hash, encrypted)
+	if err != nil {
+		return stored, tracing.Error(span, err)
+	}
+
+	return stored, nil
+}
+
+// encryptSpooled writes a stream to a temporary file while deriving its salt, then encrypts it
+func (e *EncryptedBackend) encryptSpooled(content io.ReadCloser) (io.ReadCloser, error) {
+	defer content.Close()
+
+	file, err := os.CreateTemp("", "cas-stream-*")
+	if err != nil {
+		return nil, err
+	}
+
+	spooled := &tempFile{File: file}
+
+	salt, err := convergentSalt(e.keyring.Current, "artifact", io.TeeReader(content, file))
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+
+	if err != nil {
+		spooled.Close()
+		return nil, err
+	}
+
+	return encryptToFile(spooled, e.keyring.Current, salt)
+}
+
+// encryptArtifact encrypts the content to a temporary file, with a salt derived from the
+// content, so that pushing the same artifact again gives the same ciphertext, and isn't seen as
+// a conflict.  The salt is needed before anything is encrypted, so streams are first spooled to
+// a temporary file while it is derived.
+func (e *EncryptedBackend) encryptArtifact(content io.ReadCloser) (io.ReadCloser, error) {
+	current := e.keyring.Current
+
+	seeker, seekable := content.(io.ReadSeeker)
+	if !seekable {
+		return e.encryptSpooled(content)
+	}
+
+	salt, err := convergentSalt(current, "artifact", seeker)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return encryptToFile(content, current, salt)
+}
+
+func encryptToFile(content io.ReadCloser, key *Key, salt []byte) (io.ReadCloser, error) {
+	defer content.Close()
+
+	file, err := os.CreateTemp("", "cas-encrypted-*")
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted := &tempFile{File: file}
+
+	encrypter, err := newEncryptWriter(file, key, salt)
+	if err == nil {
+		_, err = io.Copy(encrypter, content)
+	}
+	if err == nil {
+		err = encrypter.Close()
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+
+	if err != nil {
+		encrypted.Close()
+		return nil, err
+	}
+
+	return encrypted, nil
+}
+
+// tempFile is removed once it is closed
+type tempFile struct {
+	*os.File
+}
+
+func (f *tempFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+
+	return err
+}
+
+func (e *EncryptedBackend) ListArtifacts(ctx context.Context, hash string) ([]string, error) {
+	return e.wrapped.ListArtifacts(ctx, hash)
+}
+
+func (e *EncryptedBackend) FetchArtifact(ctx context.Context, hash string, name string) (*backends.RemoteFile, error) {
+	ctx, span := startSpan(ctx, "fetch_artifact")
+	defer span.End()
+
+	remoteFile, err := e.wrapped.FetchArtifact(ctx, hash, name)
+	if err != nil {
+		return nil, tracing.Error(span, err)
+	}
+
+	if err := e.decryptArtifact(remoteFile); err != nil {
+		remoteFile.Close()
+		return nil, tracing.Error(span, err)
+	}
+
+	return remoteFile, nil
+}
+
+func (e *EncryptedBackend) FetchArtifacts(ctx context.Context, hash string) ([]*backends.RemoteFile, error) {
+	ctx, span := startSpan(ctx, "fetch_artifacts")
+	defer span.End()
+
+	remoteFiles, err := e.wrapped.FetchArtifacts(ctx, hash)
+	if err != nil {
+		return nil, tracing.Error(span, err)
+	}
+
+	for _, remoteFile := range remoteFiles {
+		if err := e.decryptArtifact(remoteFile); err != nil {
+			for _, f := range remoteFiles {
+				f.Close()
+			}
+			return nil, tracing.Error(span, err)
+		}
+	}
+
+	return remoteFiles, nil
+}
+
+// decryptArtifact replaces the file's content with its decrypted content.  Unless encryption is
+// required, artifacts stored before encryption was enabled are returned as they are.
+func (e *EncryptedBackend) decryptArtifact(remoteFile *backends.RemoteFile) error {
+	buffered := bufio.NewReader(remoteFile.Content)
+
+	if !isEncrypted(buffered) {
+		if e.required {
+			return fmt.Errorf("artifact %s: %w", remoteFile.Name, ErrNotEncrypted)
+		}
+
+		remoteFile.Content = &decryptingReader{Reader: buffered, content: remoteFile.Content}
+		return nil
+	}
+
+	decrypted, err := newDecryptReader(buffered, e.keyring)
+	if err != nil {
+		return err
+	}
+
+	remoteFile.Content = &decryptingReader{Reader: decrypted, content: remoteFile.Content}
+	return nil
+}
+
+type decryptingReader struct {
+	io.Reader
+	content io.Closer
+}
+
+func (r *decryptingReader) Close() error {
+	return r.content.Close()
+}
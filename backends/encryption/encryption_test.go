@@ -0,0 +1,218 @@
+package encryption
+
+import (
+	"bytes"
+	"cas/backends"
+	"cas/backends/s3"
+	"cas/localstorage"
+	"context"
+	"encoding/base64"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func createKey(id string) string {
+	return id + "=" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte(id[:1]), 32))
+}
+
+func createBackend(t *testing.T, keys string) (*EncryptedBackend, *s3.S3Backend) {
+	cfg := s3.S3Config{
+		BucketName: "cas",
+		PathPrefix: "tests",
+	}
+	s3.EnsureBucket(context.Background(), cfg)
+
+	remote, err := s3.NewS3Backend(t.Context(), cfg)
+	require.NoError(t, err)
+
+	keyring, err := ParseKeys(keys)
+	require.NoError(t, err)
+
+	return NewEncryptedBackend(remote, keyring, true), remote
+}
+
+type seekableContent struct {
+	*bytes.Reader
+}
+
+func (c *seekableContent) Close() error {
+	return nil
+}
+
+func fetch(t *testing.T, be backends.Backend, hash string, name string) string {
+	file, err := be.FetchArtifact(t.Context(), hash, name)
+	require.NoError(t, err)
+
+	defer file.Close()
+
+	content, err := io.ReadAll(file.Content)
+	require.NoError(t, err)
+
+	return string(content)
+}
+
+func TestParseKeys(t *testing.T) {
+	keyring, err := ParseKeys("# comment\n" + createKey("new") + "\n" + createKey("old") + "\n")
+	require.NoError(t, err)
+	assert.Equal(t, "new", keyring.Current.ID)
+
+	old, err := keyring.Find("old")
+	require.NoError(t, err)
+	assert.Equal(t, "old", old.ID)
+
+	_, err = keyring.Find("other")
+	assert.ErrorContains(t, err, "isn't configured")
+
+	_, err = ParseKeys("short=" + base64.StdEncoding.EncodeToString([]byte("abc")))
+	assert.ErrorContains(t, err, "should be 16, 24 or 32 bytes")
+
+	_, err = ParseKeys("")
+	assert.ErrorContains(t, err, "no encryption keys")
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	keyring, err := ParseKeys(createKey("one"))
+	require.NoError(t, err)
+
+	salt := make([]byte, saltSize)
+
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3 * chunkSize} {
+		plain := bytes.Repeat([]byte("x"), size)
+
+		encrypted := &bytes.Buffer{}
+		writer, err := newEncryptWriter(encrypted, keyring.Current, salt)
+		require.NoError(t, err)
+
+		_, err = writer.Write(plain)
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+
+		sealed := encrypted.Bytes()
+
+		reader, err := newDecryptReader(bytes.NewReader(sealed), keyring)
+		require.NoError(t, err)
+
+		decrypted, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		assert.Equal(t, plain, decrypted, "size %d", size)
+
+		// dropping the final chunk, or any byte of it, must be detected
+		for _, truncated := range [][]byte{sealed[:len(sealed)-1], sealed[:len(sealed)-(size%chunkSize)-16]} {
+			reader, err := newDecryptReader(bytes.NewReader(truncated), keyring)
+			if err != nil {
+				continue
+			}
+
+			_, err = io.ReadAll(reader)
+			assert.Error(t, err, "size %d", size)
+		}
+	}
+}
+
+func TestEncryptedArtifacts(t *testing.T) {
+	be, remote := createBackend(t, createKey("one"))
+	hash := uuid.Must(uuid.NewUUID()).String()
+
+	seekable := "seekable " + strings.Repeat(uuid.NewString(), chunkSize/20)
+	streamed := "streamed " + uuid.NewString()
+
+	written, err := be.StoreArtifacts(t.Context(), hash, []*localstorage.LocalFile{
+		{Path: "dist/seekable.js", Content: &seekableContent{Reader: bytes.NewReader([]byte(seekable))}},
+		{Path: "dist/streamed.tar", Content: io.NopCloser(strings.NewReader(streamed))},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"dist/seekable.js", "dist/streamed.tar"}, written)
+
+	// the remote only has the ciphertext
+	raw := fetch(t, remote, hash, "dist/seekable.js")
+	assert.True(t, strings.HasPrefix(raw, magic+"\x03one"))
+	assert.NotContains(t, raw, "seekable")
+
+	assert.Equal(t, seekable, fetch(t, be, hash, "dist/seekable.js"))
+	assert.Equal(t, streamed, fetch(t, be, hash, "dist/streamed.tar"))
+
+	// the same content is encrypted identically, even when streamed, so it isn't a conflict
+	_, err = be.StoreArtifacts(t.Context(), hash, []*localstorage.LocalFile{
+		{Path: "dist/seekable.js", Content: &seekableContent{Reader: bytes.NewReader([]byte(seekable))}},
+		{Path: "dist/streamed.tar", Content: io.NopCloser(strings.NewReader(streamed))},
+	})
+	require.NoError(t, err)
+
+	meta, err := remote.ReadMetadata(t.Context(), hash, []string{backends.MetadataConflicts})
+	require.NoError(t, err)
+	assert.NotContains(t, meta, backends.MetadataConflicts)
+
+	// after rotating, the old key still decrypts
+	rotated, _ := createBackend(t, createKey("two")+","+createKey("one"))
+
+	assert.Equal(t, seekable, fetch(t, rotated, hash, "dist/seekable.js"))
+	assert.Equal(t, streamed, fetch(t, rotated, hash, "dist/streamed.tar"))
+
+	// but without it, the artifacts can't be read
+	other, _ := createBackend(t, createKey("two"))
+
+	_, err = other.FetchArtifact(t.Context(), hash, "dist/seekable.js")
+	assert.ErrorContains(t, err, "'one', which isn't configured")
+}
+
+func TestEncryptedMetadata(t *testing.T) {
+	be, remote := createBackend(t, createKey("one"))
+	hash := uuid.Must(uuid.NewUUID()).String()
+	branch := "branch-" + uuid.NewString()
+
+	require.NoError(t, be.WriteMetadata(t.Context(), hash, "branch", strings.NewReader(branch)))
+	require.NoError(t, be.WriteMetadata(t.Context(), hash, backends.MetadataConflicted, strings.NewReader("true")))
+
+	raw, err := remote.ReadMetadata(t.Context(), hash, []string{"branch", backends.MetadataConflicted})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(raw["branch"], valuePrefix))
+	assert.Equal(t, "true", raw[backends.MetadataConflicted])
+
+	meta, err := be.ReadMetadata(t.Context(), hash, []string{"branch", backends.MetadataConflicted})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"branch":                    branch,
+		backends.MetadataConflicted: "true",
+	}, meta)
+
+	hashes, err := be.FindHashes(t.Context(), map[string]string{"branch": branch})
+	require.NoError(t, err)
+	assert.Equal(t, []string{hash}, hashes)
+}
+
+func TestEncryptionRequired(t *testing.T) {
+	be, remote := createBackend(t, createKey("one"))
+	hash := uuid.Must(uuid.NewUUID()).String()
+
+	// content written without the keys, such as before encryption was enabled, or by anyone else
+	// who can write to the bucket
+	_, err := remote.StoreArtifacts(t.Context(), hash, []*localstorage.LocalFile{
+		{Path: "dist/plain.js", Content: io.NopCloser(strings.NewReader("unencrypted"))},
+	})
+	require.NoError(t, err)
+	require.NoError(t, remote.WriteMetadata(t.Context(), hash, "plain", strings.NewReader("unencrypted")))
+
+	_, err = be.FetchArtifact(t.Context(), hash, "dist/plain.js")
+	assert.ErrorIs(t, err, ErrNotEncrypted)
+
+	// the unencrypted value is left out, while the others are still read
+	require.NoError(t, be.WriteMetadata(t.Context(), hash, "branch", strings.NewReader("main")))
+
+	meta, err := be.ReadMetadata(t.Context(), hash, []string{"plain", "branch"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"branch": "main"}, meta)
+
+	// while migrating, it is read as it is
+	migrating := NewEncryptedBackend(remote, be.keyring, false)
+
+	assert.Equal(t, "unencrypted", fetch(t, migrating, hash, "dist/plain.js"))
+
+	meta, err = migrating.ReadMetadata(t.Context(), hash, []string{"plain", "branch"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"plain": "unencrypted", "branch": "main"}, meta)
+}
@@ -0,0 +1,126 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// Keyring holds the key new content is encrypted with, and older keys which existing content
+// may still be encrypted with.
+type Keyring struct {
+	Current *Key
+
+	keys map[string]*Key
+}
+
+func (kr *Keyring) Find(id string) (*Key, error) {
+	key, found := kr.keys[id]
+	if !found {
+		return nil, fmt.Errorf("content is encrypted with key '%s', which isn't configured", id)
+	}
+
+	return key, nil
+}
+
+// KeySource says where to read keys from.  Only one of the fields should be set.
+type KeySource struct {
+	// File is the path to a file containing the keys
+	File string
+	// Value is the keys themselves, usually from an environment variable
+	Value string
+	// Command is a shell command which prints the keys, e.g. to read them from a secret store
+	Command string
+}
+
+func (src KeySource) IsEmpty() bool {
+	return src.File == "" && src.Value == "" && src.Command == ""
+}
+
+func LoadKeyring(ctx context.Context, src KeySource) (*Keyring, error) {
+	switch {
+	case src.File != "":
+		content, err := os.ReadFile(src.File)
+		if err != nil {
+			return nil, err
+		}
+
+		return ParseKeys(string(content))
+
+	case src.Command != "":
+		stderr := &bytes.Buffer{}
+
+		cmd := exec.CommandContext(ctx, "sh", "-c", src.Command)
+		cmd.Stderr = stderr
+
+		output, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("running the encryption key command failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+
+		return ParseKeys(string(output))
+	}
+
+	return ParseKeys(src.Value)
+}
+
+// ParseKeys reads `id=base64-secret` pairs, separated by newlines or commas.  The first key is
+// used to encrypt new content, and the rest are only used for decrypting.
+func ParseKeys(text string) (*Keyring, error) {
+	keyring := &Keyring{keys: map[string]*Key{}}
+
+	entries := strings.FieldsFunc(text, func(r rune) bool {
+		return r == '\n' || r == ','
+	})
+
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		id, encoded, found := strings.Cut(entry, "=")
+		if !found || id == "" {
+			return nil, fmt.Errorf("encryption keys should be in the format id=base64-secret")
+		}
+
+		if len(id) > 255 {
+			return nil, fmt.Errorf("encryption key id '%s...' is longer than 255 characters", id[:16])
+		}
+
+		secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("encryption key '%s' is not valid base64: %w", id, err)
+		}
+
+		if len(secret) != 16 && len(secret) != 24 && len(secret) != 32 {
+			return nil, fmt.Errorf("encryption key '%s' should be 16, 24 or 32 bytes, but is %d", id, len(secret))
+		}
+
+		if _, exists := keyring.keys[id]; exists {
+			return nil, fmt.Errorf("encryption key '%s' is given more than once", id)
+		}
+
+		key := &Key{ID: id, Secret: secret}
+		keyring.keys[id] = key
+
+		if keyring.Current == nil {
+			keyring.Current = key
+		}
+	}
+
+	if keyring.Current == nil {
+		return nil, fmt.Errorf("no encryption keys were given")
+	}
+
+	return keyring, nil
+}
@@ -0,0 +1,218 @@
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Encrypted content starts with a header of the magic bytes, the key id and a salt, followed by
+// chunks sealed with AES-GCM.  Each chunk's nonce is its index, with the final chunk flagged, so
+// chunks can't be reordered and truncation is detected.
+//
+//	magic | id length (1 byte) | id | salt (32 bytes) | chunk... | final chunk
+const (
+	magic     = "CASENC1"
+	saltSize  = 32
+	chunkSize = 64 * 1024
+)
+
+// chunks are sealed with a key derived from the salt, so the nonces never repeat for a key
+func contentCipher(key *Key, salt []byte) (cipher.AEAD, error) {
+	derived, err := hkdf.Key(sha256.New, key.Secret, salt, "cas content", 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(derived)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// convergentSalt derives the salt from the content, so that identical content is encrypted
+// identically, and repeated pushes don't look like conflicts.
+func convergentSalt(key *Key, purpose string, content io.Reader) ([]byte, error) {
+	mac := hmac.New(sha256.New, key.Secret)
+	mac.Write([]byte(purpose))
+	mac.Write([]byte{0})
+
+	if _, err := io.Copy(mac, content); err != nil {
+		return nil, err
+	}
+
+	return mac.Sum(nil), nil
+}
+
+func chunkNonce(index uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], index)
+
+	if final {
+		nonce[11] = 1
+	}
+
+	return nonce
+}
+
+type encryptWriter struct {
+	dst    io.Writer
+	aead   cipher.AEAD
+	buffer []byte
+	index  uint64
+}
+
+func newEncryptWriter(dst io.Writer, key *Key, salt []byte) (io.WriteCloser, error) {
+	aead, err := contentCipher(key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	header := append([]byte(magic), byte(len(key.ID)))
+	header = append(header, key.ID...)
+	header = append(header, salt...)
+
+	if _, err := dst.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{
+		dst:    dst,
+		aead:   aead,
+		buffer: make([]byte, 0, chunkSize),
+	}, nil
+}
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		n := min(len(p), chunkSize-len(w.buffer))
+		w.buffer = append(w.buffer, p[:n]...)
+		p = p[n:]
+		written += n
+
+		if len(w.buffer) == chunkSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// Close writes the final chunk, which is always shorter than a full chunk
+func (w *encryptWriter) Close() error {
+	return w.seal(true)
+}
+
+func (w *encryptWriter) seal(final bool) error {
+	sealed := w.aead.Seal(nil, chunkNonce(w.index, final), w.buffer, nil)
+
+	w.index++
+	w.buffer = w.buffer[:0]
+
+	_, err := w.dst.Write(sealed)
+	return err
+}
+
+type decryptReader struct {
+	src      io.Reader
+	aead     cipher.AEAD
+	sealed   []byte
+	plain    []byte
+	index    uint64
+	finished bool
+}
+
+// isEncrypted checks for the header without consuming it
+func isEncrypted(src *bufio.Reader) bool {
+	prefix, _ := src.Peek(len(magic))
+	return bytes.Equal(prefix, []byte(magic))
+}
+
+func newDecryptReader(src io.Reader, keyring *Keyring) (io.Reader, error) {
+	header := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return nil, fmt.Errorf("reading encryption header: %w", err)
+	}
+
+	id := make([]byte, header[len(magic)])
+	if _, err := io.ReadFull(src, id); err != nil {
+		return nil, fmt.Errorf("reading encryption header: %w", err)
+	}
+
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(src, salt); err != nil {
+		return nil, fmt.Errorf("reading encryption header: %w", err)
+	}
+
+	key, err := keyring.Find(string(id))
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := contentCipher(key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReader{
+		src:    src,
+		aead:   aead,
+		sealed: make([]byte, chunkSize+aead.Overhead()),
+	}, nil
+}
+
+var errTruncated = errors.New("encrypted content is truncated")
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.finished {
+			return 0, io.EOF
+		}
+
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+
+	return n, nil
+}
+
+func (r *decryptReader) open() error {
+	n, err := io.ReadFull(r.src, r.sealed)
+
+	switch {
+	case err == io.EOF:
+		return errTruncated
+	case err == io.ErrUnexpectedEOF:
+		r.finished = true
+	case err != nil:
+		return err
+	}
+
+	plain, err := r.aead.Open(r.sealed[:0], chunkNonce(r.index, r.finished), r.sealed[:n], nil)
+	if err != nil {
+		return fmt.Errorf("encrypted content has been modified, or is truncated: %w", err)
+	}
+
+	r.index++
+	r.plain = plain
+
+	return nil
+}
@@ -0,0 +1,263 @@
+package failopen
+
+import (
+	"cas/backends"
+	"cas/localstorage"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var ErrUnavailable = errors.New("the backend is unavailable")
+
+// NewFailOpenBackend treats the wrapped backend as unavailable after its first outage, so that
+// a cache outage doesn't fail the build.  Reads become misses, and writes are skipped.  The
+// outage is written to warnings once.
+func NewFailOpenBackend(wrapped backends.Backend, warnings io.Writer) *FailOpenBackend {
+	return &FailOpenBackend{
+		wrapped:  wrapped,
+		warnings: warnings,
+	}
+}
+
+type FailOpenBackend struct {
+	wrapped  backends.Backend
+	warnings io.Writer
+
+	outage     error
+	outageLock sync.Mutex
+}
+
+// Outage returns the error which made the backend unavailable, or nil if it hasn't been
+// unavailable, or doesn't fail open
+func Outage(backend backends.Backend) error {
+	f, ok := backend.(*FailOpenBackend)
+	if !ok {
+		return nil
+	}
+
+	f.outageLock.Lock()
+	defer f.outageLock.Unlock()
+
+	return f.outage
+}
+
+// isOutage decides which errors mean the backend can't be used.  Missing data and permanent
+// errors (such as conflicts) are still returned, as they say something about the request.
+// Rejected credentials are returned too, as they won't fix themselves, and would otherwise make
+// every build run uncached with only a warning.
+func isOutage(err error) bool {
+	switch backends.Classify(err) {
+	case backends.ErrorTransient, backends.ErrorThrottled:
+		return true
+	}
+
+	return false
+}
+
+// open returns the outage if the circuit is already open
+func (f *FailOpenBackend) open(ctx context.Context, operation string) error {
+	f.outageLock.Lock()
+	defer f.outageLock.Unlock()
+
+	if f.outage != nil {
+		trace.SpanFromContext(ctx).AddEvent("circuit_open", trace.WithAttributes(
+			attribute.String("operation", operation),
+		))
+	}
+
+	return f.outage
+}
+
+// failed opens the circuit if the error is an outage, and returns the error if it isn't
+func (f *FailOpenBackend) failed(ctx context.Context, operation string, err error) error {
+	if err == nil || !isOutage(err) {
+		return err
+	}
+
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.Bool("backend.unavailable", true))
+	span.AddEvent("backend_unavailable", trace.WithAttributes(
+		attribute.String("operation", operation),
+		attribute.String("error.class", string(backends.Classify(err))),
+		attribute.String("error", err.Error()),
+	))
+
+	f.outageLock.Lock()
+	defer f.outageLock.Unlock()
+
+	if f.outage == nil {
+		f.outage = err
+		fmt.Fprintf(f.warnings, "Warning: the backend is unavailable, continuing without it: %s\n", err)
+	}
+
+	return nil
+}
+
+func (f *FailOpenBackend) WriteMetadata(ctx context.Context, hash string, key string, value io.ReadSeeker) error {
+	if f.open(ctx, "write_metadata") != nil {
+		return nil
+	}
+
+	return f.failed(ctx, "write_metadata", f.wrapped.WriteMetadata(ctx, hash, key, value))
+}
+
+func (f *FailOpenBackend) ReadMetadata(ctx context.Context, hash string, keys []string) (map[string]string, error) {
+	if f.open(ctx, "read_metadata") != nil {
+		return map[string]string{}, nil
+	}
+
+	meta, err := f.wrapped.ReadMetadata(ctx, hash, keys)
+	if err := f.failed(ctx, "read_metadata", err); err != nil {
+		return nil, err
+	}
+	if err != nil {
+		return map[string]string{}, nil
+	}
+
+	return meta, nil
+}
+
+func (f *FailOpenBackend) FindHashes(ctx context.Context, query map[string]string) ([]string, error) {
+	if f.open(ctx, "find_hashes") != nil {
+		return []string{}, nil
+	}
+
+	hashes, err := f.wrapped.FindHashes(ctx, query)
+	if err := f.failed(ctx, "find_hashes", err); err != nil {
+		return nil, err
+	}
+	if err != nil {
+		return []string{}, nil
+	}
+
+	return hashes, nil
+}
+
+// AcquireLease always succeeds when the backend is unavailable, so the caller builds rather
+// than waiting for a process it can't see
+func (f *FailOpenBackend) AcquireLease(ctx context.Context, hash string, ttl time.Duration) (bool, error) {
+	leaser, ok := f.wrapped.(backends.Leaser)
+	if !ok {
+		return false, backends.ErrLeaseUnsupported
+	}
+
+	if f.open(ctx, "acquire_lease") != nil {
+		return true, nil
+	}
+
+	acquired, err := leaser.AcquireLease(ctx, hash, ttl)
+	if err := f.failed(ctx, "acquire_lease", err); err != nil {
+		return false, err
+	}
+	if err != nil {
+		return true, nil
+	}
+
+	return acquired, nil
+}
+
+func (f *FailOpenBackend) ReleaseLease(ctx context.Context, hash string) error {
+	leaser, ok := f.wrapped.(backends.Leaser)
+	if !ok {
+		return backends.ErrLeaseUnsupported
+	}
+
+	if f.open(ctx, "release_lease") != nil {
+		return nil
+	}
+
+	return f.failed(ctx, "release_lease", leaser.ReleaseLease(ctx, hash))
+}
+
+// PresignArtifact fails when the backend is unavailable, as there is no url to print instead
+func (f *FailOpenBackend) PresignArtifact(ctx context.Context, hash string, name string, expires time.Duration) (string, error) {
+	if outage := f.open(ctx, "presign_artifact"); outage != nil {
+		return "", fmt.Errorf("%w: %w", ErrUnavailable, outage)
+	}
+
+	return backends.PresignArtifact(ctx, f.wrapped, hash, name, expires)
+}
+
+func (f *FailOpenBackend) PresignArchive(ctx context.Context, hash string, write func(io.Writer) error, expires time.Duration) (string, error) {
+	if outage := f.open(ctx, "presign_archive"); outage != nil {
+		return "", fmt.Errorf("%w: %w", ErrUnavailable, outage)
+	}
+
+	return backends.PresignArchive(ctx, f.wrapped, hash, write, expires)
+}
+
+// StoreArtifacts skips storing when the backend is unavailable, so nothing is reported as written
+func (f *FailOpenBackend) StoreArtifacts(ctx context.Context, hash string, files []*localstorage.LocalFile) ([]string, error) {
+	if f.open(ctx, "store_artifacts") != nil {
+		for _, file := range files {
+			file.Close()
+		}
+
+		return []string{}, nil
+	}
+
+	written, err := f.wrapped.StoreArtifacts(ctx, hash, files)
+	if err := f.failed(ctx, "store_artifacts", err); err != nil {
+		return written, err
+	}
+	if err != nil {
+		return []string{}, nil
+	}
+
+	return written, nil
+}
+
+func (f *FailOpenBackend) ListArtifacts(ctx context.Context, hash string) ([]string, error) {
+	if f.open(ctx, "list_artifacts") != nil {
+		return []string{}, nil
+	}
+
+	artifacts, err := f.wrapped.ListArtifacts(ctx, hash)
+	if err := f.failed(ctx, "list_artifacts", err); err != nil {
+		return nil, err
+	}
+	if err != nil {
+		return []string{}, nil
+	}
+
+	return artifacts, nil
+}
+
+// FetchArtifact still fails when the backend is unavailable, as there is no way to miss a
+// single artifact
+func (f *FailOpenBackend) FetchArtifact(ctx context.Context, hash string, name string) (*backends.RemoteFile, error) {
+	if outage := f.open(ctx, "fetch_artifact"); outage != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUnavailable, outage)
+	}
+
+	file, err := f.wrapped.FetchArtifact(ctx, hash, name)
+	if err != nil && isOutage(err) {
+		f.failed(ctx, "fetch_artifact", err)
+		return nil, fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+
+	return file, err
+}
+
+func (f *FailOpenBackend) FetchArtifacts(ctx context.Context, hash string) ([]*backends.RemoteFile, error) {
+	if f.open(ctx, "fetch_artifacts") != nil {
+		return []*backends.RemoteFile{}, nil
+	}
+
+	files, err := f.wrapped.FetchArtifacts(ctx, hash)
+	if err := f.failed(ctx, "fetch_artifacts", err); err != nil {
+		return nil, err
+	}
+	if err != nil {
+		return []*backends.RemoteFile{}, nil
+	}
+
+	return files, nil
+}
@@ -0,0 +1,116 @@
+package backends
+
+import (
+	"cas/tracing"
+	"context"
+	"errors"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var ErrLeaseUnsupported = errors.New("backend does not support leases")
+
+// how often a waiting process checks if the lease holder has pushed the artifacts
+const leasePollInterval = 2 * time.Second
+
+// Leaser is implemented by backends which can lease a hash to a single process, so that only
+// one process builds the hash while the others wait for its artifacts.
+type Leaser interface {
+	// AcquireLease takes the hash's lease for the given time, returning false if another
+	// process holds an unexpired lease.
+	AcquireLease(ctx context.Context, hash string, ttl time.Duration) (bool, error)
+
+	// ReleaseLease removes the hash's lease, if it is still the lease this process took.
+	ReleaseLease(ctx context.Context, hash string) error
+}
+
+type LeaseState string
+
+const (
+	// LeaseHeld means this process holds the lease, and should build the hash
+	LeaseHeld LeaseState = "held"
+	// LeaseArtifacts means the hash's artifacts have been pushed
+	LeaseArtifacts LeaseState = "artifacts"
+	// LeaseTimeout means another process held the lease for longer than we were willing to wait
+	LeaseTimeout LeaseState = "timeout"
+)
+
+// AwaitLease takes the hash's lease if it has no artifacts yet.  If another process holds the
+// lease, this waits until that process pushes the artifacts, its lease expires or is released,
+// or the wait times out.
+func AwaitLease(ctx context.Context, backend Backend, hash string, ttl time.Duration, wait time.Duration) (LeaseState, error) {
+	ctx, span := otel.Tracer("backends").Start(ctx, "await_lease")
+	defer span.End()
+
+	leaser, ok := backend.(Leaser)
+	if !ok {
+		return "", tracing.Error(span, ErrLeaseUnsupported)
+	}
+
+	deadline := time.Now().Add(wait)
+
+	for polls := 1; ; polls++ {
+		span.SetAttributes(attribute.Int("polls", polls))
+
+		_, found, err := ReadArtifactManifest(ctx, backend, hash)
+		if err != nil {
+			return "", tracing.Error(span, err)
+		}
+		if found {
+			return leaseState(span, LeaseArtifacts), nil
+		}
+
+		acquired, err := leaser.AcquireLease(ctx, hash, ttl)
+		if err != nil {
+			return "", tracing.Error(span, err)
+		}
+
+		if acquired {
+			// the previous holder could have pushed and released in between us reading the
+			// manifest and taking the lease
+			_, found, err := ReadArtifactManifest(ctx, backend, hash)
+			if err != nil {
+				return "", tracing.Error(span, err)
+			}
+
+			if !found {
+				return leaseState(span, LeaseHeld), nil
+			}
+
+			if err := leaser.ReleaseLease(ctx, hash); err != nil {
+				return "", tracing.Error(span, err)
+			}
+
+			return leaseState(span, LeaseArtifacts), nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return leaseState(span, LeaseTimeout), nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", tracing.Error(span, ctx.Err())
+		case <-time.After(min(remaining, leasePollInterval)):
+		}
+	}
+}
+
+func leaseState(span trace.Span, state LeaseState) LeaseState {
+	span.SetAttributes(attribute.String("state", string(state)))
+	return state
+}
+
+// ReleaseLease removes the hash's lease, so that processes waiting on it stop waiting.
+func ReleaseLease(ctx context.Context, backend Backend, hash string) error {
+	leaser, ok := backend.(Leaser)
+	if !ok {
+		return ErrLeaseUnsupported
+	}
+
+	return leaser.ReleaseLease(ctx, hash)
+}
@@ -0,0 +1,130 @@
+package backends
+
+import (
+	"cas/tracing"
+	"context"
+	"encoding/json"
+	"maps"
+	"os"
+	"sort"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const MetadataArtifacts = "@artifacts"
+
+type Artifact struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+
+	// Mode is the artifact's type and permissions, and is zero for artifacts pushed before
+	// modes were recorded
+	Mode os.FileMode `json:"mode,omitempty"`
+}
+
+// ArtifactManifest maps the relative path of each artifact in a hash to its content.
+type ArtifactManifest map[string]Artifact
+
+func (m ArtifactManifest) Paths() []string {
+	paths := make([]string, 0, len(m))
+	for p := range m {
+		paths = append(paths, p)
+	}
+
+	sort.Strings(paths)
+
+	return paths
+}
+
+type pinnedManifestKey struct{}
+
+type pinnedManifest struct {
+	hash     string
+	manifest ArtifactManifest
+}
+
+// WithArtifactManifest pins the hash's manifest for reads with the returned context, so that the
+// artifacts fetched are the ones which were checked (e.g. against a signature), even if the
+// manifest is written in between.
+func WithArtifactManifest(ctx context.Context, hash string, manifest ArtifactManifest) context.Context {
+	return context.WithValue(ctx, pinnedManifestKey{}, &pinnedManifest{hash: hash, manifest: manifest})
+}
+
+// ReadArtifactManifest reads the hash's manifest, unless the context has it pinned.
+func ReadArtifactManifest(ctx context.Context, backend Backend, hash string) (ArtifactManifest, bool, error) {
+	ctx, span := otel.Tracer("backends").Start(ctx, "read_artifact_manifest")
+	defer span.End()
+
+	if pinned, ok := ctx.Value(pinnedManifestKey{}).(*pinnedManifest); ok && pinned.hash == hash {
+		span.SetAttributes(attribute.Bool("pinned", true))
+		return maps.Clone(pinned.manifest), len(pinned.manifest) > 0, nil
+	}
+
+	meta, err := backend.ReadMetadata(ctx, hash, []string{MetadataArtifacts})
+	if err != nil {
+		return nil, false, tracing.Error(span, err)
+	}
+
+	content, found := meta[MetadataArtifacts]
+	if !found {
+		return ArtifactManifest{}, false, nil
+	}
+
+	manifest := ArtifactManifest{}
+	if err := json.Unmarshal([]byte(content), &manifest); err != nil {
+		return nil, false, tracing.Error(span, err)
+	}
+
+	span.SetAttributes(attribute.Int("artifacts", len(manifest)))
+
+	return manifest, true, nil
+}
+
+// UpdateArtifactManifest adds the given artifacts to the hash's manifest, replacing any
+// existing entries with the same path.  The manifest is read and written back unconditionally,
+// so backends which can be pushed to concurrently should merge with MergeArtifactManifest and
+// write conditionally instead.
+func UpdateArtifactManifest(ctx context.Context, backend Backend, hash string, artifacts ArtifactManifest) error {
+	ctx, span := otel.Tracer("backends").Start(ctx, "update_artifact_manifest")
+	defer span.End()
+
+	meta, err := backend.ReadMetadata(ctx, hash, []string{MetadataArtifacts})
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	content, err := MergeArtifactManifest(meta[MetadataArtifacts], artifacts)
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	if err := backend.WriteMetadata(ctx, hash, MetadataArtifacts, strings.NewReader(content)); err != nil {
+		return tracing.Error(span, err)
+	}
+
+	return nil
+}
+
+// MergeArtifactManifest adds the given artifacts to the serialised manifest, which is empty if
+// the hash has no manifest yet, and returns the merged manifest.
+func MergeArtifactManifest(content string, artifacts ArtifactManifest) (string, error) {
+	manifest := ArtifactManifest{}
+	if content != "" {
+		if err := json.Unmarshal([]byte(content), &manifest); err != nil {
+			return "", err
+		}
+	}
+
+	for p, artifact := range artifacts {
+		manifest[p] = artifact
+	}
+
+	merged, err := json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+
+	return string(merged), nil
+}
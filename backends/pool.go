@@ -0,0 +1,55 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// DefaultConcurrency is how many requests a backend operation makes at once, when the
+// concurrency isn't configured
+const DefaultConcurrency = 16
+
+// ForEach calls fn for every item, with at most limit calls running at once.  The results are
+// in the same order as the items, and each call's result is kept even if it fails.  The errors
+// are joined in the order of the items too, so the same failures always give the same error.
+//
+// Once ctx is cancelled, no more calls are started and its error is returned along with the
+// errors of the calls which did run.
+func ForEach[T any, R any](ctx context.Context, limit int, items []T, fn func(ctx context.Context, item T) (R, error)) ([]R, error) {
+	if limit <= 0 {
+		limit = DefaultConcurrency
+	}
+
+	results := make([]R, len(items))
+	errs := make([]error, len(items), len(items)+1)
+
+	slots := make(chan struct{}, limit)
+	wg := sync.WaitGroup{}
+
+	var cancelled error
+
+	for i, item := range items {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+
+		// a slot and the cancellation can be ready together, so check again after waiting
+		if cancelled = ctx.Err(); cancelled != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			results[i], errs[i] = fn(ctx, item)
+		}()
+	}
+
+	wg.Wait()
+
+	return results, errors.Join(append(errs, cancelled)...)
+}
@@ -0,0 +1,80 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForEachLimitsConcurrency(t *testing.T) {
+	items := make([]int, 100)
+	for i := range items {
+		items[i] = i
+	}
+
+	running := atomic.Int32{}
+	highest := atomic.Int32{}
+
+	results, err := ForEach(context.Background(), 4, items, func(ctx context.Context, item int) (int, error) {
+		now := running.Add(1)
+		defer running.Add(-1)
+
+		for {
+			seen := highest.Load()
+			if now <= seen || highest.CompareAndSwap(seen, now) {
+				break
+			}
+		}
+
+		time.Sleep(time.Millisecond)
+		return item * 2, nil
+	})
+
+	require.NoError(t, err)
+	assert.LessOrEqual(t, highest.Load(), int32(4))
+
+	for i, result := range results {
+		assert.Equal(t, i*2, result)
+	}
+}
+
+func TestForEachErrorsAreOrdered(t *testing.T) {
+	items := []int{0, 1, 2, 3, 4, 5}
+
+	results, err := ForEach(context.Background(), 3, items, func(ctx context.Context, item int) (string, error) {
+		// later items fail first, so the errors would be out of order if collected as they happen
+		time.Sleep(time.Duration(len(items)-item) * time.Millisecond)
+
+		if item%2 == 1 {
+			return "failed", fmt.Errorf("item %d", item)
+		}
+		return "ok", nil
+	})
+
+	assert.EqualError(t, err, "item 1\nitem 3\nitem 5")
+	assert.Equal(t, []string{"ok", "failed", "ok", "failed", "ok", "failed"}, results)
+}
+
+func TestForEachCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	items := make([]int, 10)
+	started := atomic.Int32{}
+
+	_, err := ForEach(ctx, 1, items, func(ctx context.Context, item int) (int, error) {
+		if started.Add(1) == 1 {
+			cancel()
+		}
+
+		return 0, ctx.Err()
+	})
+
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Equal(t, int32(1), started.Load())
+}
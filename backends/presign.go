@@ -0,0 +1,43 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var ErrPresignUnsupported = errors.New("backend can't create urls for downloading artifacts")
+
+// Presigner is implemented by backends which can create urls that download an artifact without
+// credentials or cas, until they expire.
+type Presigner interface {
+	// PresignArtifact returns a url which downloads one of the hash's artifacts.
+	PresignArtifact(ctx context.Context, hash string, name string, expires time.Duration) (string, error)
+
+	// PresignArchive stores an archive of the hash's artifacts, and returns a url which downloads
+	// it.  write is called to write the archive, a tar.gz, unless the backend can't create urls.
+	PresignArchive(ctx context.Context, hash string, write func(io.Writer) error, expires time.Duration) (string, error)
+}
+
+// PresignArtifact returns a url which downloads one of the hash's artifacts, or
+// ErrPresignUnsupported if the backend can't create one.
+func PresignArtifact(ctx context.Context, backend Backend, hash string, name string, expires time.Duration) (string, error) {
+	presigner, ok := backend.(Presigner)
+	if !ok {
+		return "", ErrPresignUnsupported
+	}
+
+	return presigner.PresignArtifact(ctx, hash, name, expires)
+}
+
+// PresignArchive stores an archive of the hash's artifacts and returns a url which downloads it,
+// or ErrPresignUnsupported if the backend can't create one.
+func PresignArchive(ctx context.Context, backend Backend, hash string, write func(io.Writer) error, expires time.Duration) (string, error) {
+	presigner, ok := backend.(Presigner)
+	if !ok {
+		return "", ErrPresignUnsupported
+	}
+
+	return presigner.PresignArchive(ctx, hash, write, expires)
+}
@@ -0,0 +1,84 @@
+package readonly
+
+import (
+	"cas/backends"
+	"cas/localstorage"
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var ErrReadOnly = errors.New("the backend is read only")
+
+// NewReadOnlyBackend refuses every write to the wrapped backend, so that a command which would
+// write fails, rather than an untrusted build modifying the cache.
+func NewReadOnlyBackend(wrapped backends.Backend) *ReadOnlyBackend {
+	return &ReadOnlyBackend{
+		wrapped: wrapped,
+	}
+}
+
+type ReadOnlyBackend struct {
+	wrapped backends.Backend
+}
+
+func refuse(ctx context.Context, operation string) error {
+	trace.SpanFromContext(ctx).AddEvent("read_only_refused", trace.WithAttributes(
+		attribute.String("operation", operation),
+	))
+
+	return ErrReadOnly
+}
+
+func (r *ReadOnlyBackend) WriteMetadata(ctx context.Context, hash string, key string, value io.ReadSeeker) error {
+	return refuse(ctx, "write_metadata")
+}
+
+func (r *ReadOnlyBackend) ReadMetadata(ctx context.Context, hash string, keys []string) (map[string]string, error) {
+	return r.wrapped.ReadMetadata(ctx, hash, keys)
+}
+
+func (r *ReadOnlyBackend) FindHashes(ctx context.Context, query map[string]string) ([]string, error) {
+	return r.wrapped.FindHashes(ctx, query)
+}
+
+func (r *ReadOnlyBackend) AcquireLease(ctx context.Context, hash string, ttl time.Duration) (bool, error) {
+	return false, refuse(ctx, "acquire_lease")
+}
+
+func (r *ReadOnlyBackend) ReleaseLease(ctx context.Context, hash string) error {
+	return refuse(ctx, "release_lease")
+}
+
+func (r *ReadOnlyBackend) PresignArtifact(ctx context.Context, hash string, name string, expires time.Duration) (string, error) {
+	return backends.PresignArtifact(ctx, r.wrapped, hash, name, expires)
+}
+
+// PresignArchive is refused, as the archive has to be stored before it can be downloaded
+func (r *ReadOnlyBackend) PresignArchive(ctx context.Context, hash string, write func(io.Writer) error, expires time.Duration) (string, error) {
+	return "", refuse(ctx, "presign_archive")
+}
+
+func (r *ReadOnlyBackend) StoreArtifacts(ctx context.Context, hash string, files []*localstorage.LocalFile) ([]string, error) {
+	for _, file := range files {
+		file.Close()
+	}
+
+	return nil, refuse(ctx, "store_artifacts")
+}
+
+func (r *ReadOnlyBackend) ListArtifacts(ctx context.Context, hash string) ([]string, error) {
+	return r.wrapped.ListArtifacts(ctx, hash)
+}
+
+func (r *ReadOnlyBackend) FetchArtifact(ctx context.Context, hash string, name string) (*backends.RemoteFile, error) {
+	return r.wrapped.FetchArtifact(ctx, hash, name)
+}
+
+func (r *ReadOnlyBackend) FetchArtifacts(ctx context.Context, hash string) ([]*backends.RemoteFile, error) {
+	return r.wrapped.FetchArtifacts(ctx, hash)
+}
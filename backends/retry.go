@@ -0,0 +1,95 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"os"
+	"time"
+)
+
+// ErrorClass groups backend errors by what the caller can do about them
+type ErrorClass string
+
+const (
+	ErrorNotFound  ErrorClass = "not_found"
+	ErrorAuth      ErrorClass = "auth"
+	ErrorThrottled ErrorClass = "throttled"
+	ErrorTransient ErrorClass = "transient"
+	ErrorPermanent ErrorClass = "permanent"
+)
+
+// Retryable is true for errors which may not happen if the operation is tried again
+func (c ErrorClass) Retryable() bool {
+	return c == ErrorThrottled || c == ErrorTransient
+}
+
+// ClassifiedError is returned by backends, so that callers and spans can tell why an operation
+// failed without knowing the backend's own errors.
+type ClassifiedError struct {
+	Class ErrorClass
+	Err   error
+}
+
+func (e *ClassifiedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ClassifiedError) Unwrap() error {
+	return e.Err
+}
+
+// Classify returns the class of an error from any backend.  Errors which weren't classified by
+// a backend are permanent, unless they are a missing file or a deadline.
+func Classify(err error) ErrorClass {
+	var classified *ClassifiedError
+
+	switch {
+	case errors.As(err, &classified):
+		return classified.Class
+	case errors.Is(err, os.ErrNotExist):
+		return ErrorNotFound
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorTransient
+	}
+
+	return ErrorPermanent
+}
+
+// RetryPolicy decides how often, and how long apart, a failed operation is tried again
+type RetryPolicy struct {
+	// Attempts is the most times an operation is tried, including the first
+	Attempts int
+
+	// the delay before each retry is random, up to BaseDelay doubled for each attempt, and
+	// never more than MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// Timeout is the deadline for an operation, including its retries, or zero for none
+	Timeout time.Duration
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Attempts:  4,
+		BaseDelay: 200 * time.Millisecond,
+		MaxDelay:  20 * time.Second,
+		Timeout:   15 * time.Minute,
+	}
+}
+
+// Delay is how long to wait before the given retry, starting from 1.  The delay is chosen
+// at random ("full jitter"), so that processes throttled together don't retry together.
+func (p RetryPolicy) Delay(retry int) time.Duration {
+	ceiling := p.MaxDelay
+	if shift := retry - 1; shift < 32 {
+		ceiling = min(p.BaseDelay<<shift, p.MaxDelay)
+	}
+
+	if ceiling <= 0 {
+		return 0
+	}
+
+	return rand.N(ceiling)
+}
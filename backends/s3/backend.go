@@ -1,6 +1,7 @@
 package s3
 
 import (
+	"bytes"
 	"cas/backends"
 	"cas/localstorage"
 	"cas/tracing"
@@ -10,19 +11,27 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"os"
 	"path"
-	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
 	awscfg "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/aws/smithy-go"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var tr = otel.Tracer("s3_backend")
@@ -30,18 +39,86 @@ var tr = otel.Tracer("s3_backend")
 type S3Backend struct {
 	cfg    S3Config
 	client *s3.Client
+
+	// metadata keys whose values are tags, from cfg.TagKeys
+	tagKeys []string
+
+	// the values of the tag keys read or written by this process, by hash, so that each object
+	// written doesn't need them read again.  Keys the hash doesn't have are empty.
+	tagValues     map[string]map[string]string
+	tagValuesLock sync.Mutex
+
+	// manifests read or written by this process, so that reading several keys or artifacts
+	// from the same hash only needs one request
+	manifests     map[string]*backends.Manifest
+	manifestsLock sync.Mutex
 }
 
 func NewS3Backend(ctx context.Context, cfg S3Config) (*S3Backend, error) {
 
+	if cfg.ArtifactLayout == "" {
+		cfg.ArtifactLayout = LayoutPath
+	}
+
+	if cfg.ArtifactLayout != LayoutPath && cfg.ArtifactLayout != LayoutBlobs {
+		return nil, fmt.Errorf("unsupported artifact layout '%s', expected one of: %s, %s", cfg.ArtifactLayout, LayoutPath, LayoutBlobs)
+	}
+
+	if cfg.MetadataLayout == "" {
+		cfg.MetadataLayout = LayoutKeys
+	}
+
+	if cfg.OnConflict == "" {
+		cfg.OnConflict = backends.ConflictWarn
+	}
+
+	if cfg.MetadataLayout != LayoutKeys && cfg.MetadataLayout != LayoutManifest {
+		return nil, fmt.Errorf("unsupported metadata layout '%s', expected one of: %s, %s", cfg.MetadataLayout, LayoutKeys, LayoutManifest)
+	}
+
+	if cfg.Compression == "" {
+		cfg.Compression = CompressionNone
+	}
+
+	if cfg.Compression != CompressionNone && cfg.Compression != CompressionGzip {
+		return nil, fmt.Errorf("unsupported compression '%s', expected one of: %s, %s", cfg.Compression, CompressionNone, CompressionGzip)
+	}
+
+	if cfg.MultipartThreshold == 0 {
+		cfg.MultipartThreshold = DefaultMultipartThreshold
+	}
+
+	if cfg.PartSize == 0 {
+		cfg.PartSize = DefaultPartSize
+	}
+
+	if cfg.PartSize < minPartSize {
+		return nil, fmt.Errorf("part size %d is too small, parts must be at least %d bytes", cfg.PartSize, minPartSize)
+	}
+
+	if cfg.PartConcurrency <= 0 {
+		cfg.PartConcurrency = DefaultPartConcurrency
+	}
+
+	if cfg.KMSKeyID != "" && cfg.ServerSideEncryption == "" {
+		cfg.ServerSideEncryption = string(types.ServerSideEncryptionAwsKms)
+	}
+
+	if err := cfg.validateObjectSettings(); err != nil {
+		return nil, err
+	}
+
 	client, err := createClient(ctx, cfg)
 	if err != nil {
 		return nil, err
 	}
 
 	return &S3Backend{
-		cfg:    cfg,
-		client: client,
+		cfg:       cfg,
+		client:    client,
+		tagKeys:   parseTagKeys(cfg.TagKeys),
+		tagValues: map[string]map[string]string{},
+		manifests: map[string]*backends.Manifest{},
 	}, nil
 }
 
@@ -52,8 +129,19 @@ func createClient(ctx context.Context, cas S3Config) (*s3.Client, error) {
 		opts = append(opts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(cas.AccessKey, cas.SecretKey, "")))
 	}
 
-	if cas.Endpoint != "" {
-		opts = append(opts, config.WithBaseEndpoint(cas.Endpoint))
+	if cas.Region != "" {
+		opts = append(opts, config.WithRegion(cas.Region))
+	}
+
+	if cas.Profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(cas.Profile))
+	}
+
+	if cas.ConnectTimeout > 0 {
+		client := awshttp.NewBuildableClient().WithDialerOptions(func(d *net.Dialer) {
+			d.Timeout = cas.ConnectTimeout
+		})
+		opts = append(opts, config.WithHTTPClient(client))
 	}
 
 	cfg, err := awscfg.LoadDefaultConfig(ctx, opts...)
@@ -61,8 +149,31 @@ func createClient(ctx context.Context, cas S3Config) (*s3.Client, error) {
 		return nil, err
 	}
 
+	// the role is assumed with the credentials configured above, and refreshed before it expires
+	if cas.RoleARN != "" {
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), cas.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = "cas"
+			if cas.ExternalID != "" {
+				o.ExternalID = &cas.ExternalID
+			}
+		})
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+
+	policy := cas.Retry
+	if policy.Attempts == 0 {
+		policy = backends.DefaultRetryPolicy()
+	}
+
 	return s3.NewFromConfig(cfg, func(o *s3.Options) {
-		o.UsePathStyle = true
+		// only S3 uses the endpoint, so an assumed role still comes from STS
+		if cas.Endpoint != "" {
+			o.BaseEndpoint = &cas.Endpoint
+		}
+
+		o.UsePathStyle = !cas.VirtualHosted
+		o.Retryer = &retryer{policy: policy}
+		o.APIOptions = append(o.APIOptions, classifyErrors(policy), objectSettings(cas))
 	}), nil
 }
 
@@ -87,16 +198,45 @@ func (s *S3Backend) WriteMetadata(ctx context.Context, hash string, key string,
 		attribute.String("key", key),
 	)
 
-	req := &s3.PutObjectInput{
-		Bucket: &s.cfg.BucketName,
-		Key:    s.metadataPath(hash, key),
-		Body:   value,
+	content, err := io.ReadAll(value)
+	if err != nil {
+		return tracing.Error(span, err)
 	}
 
-	if _, err := s.client.PutObject(ctx, req); err != nil {
+	tags, err := s.hashTags(ctx, hash, map[string]string{key: string(content)})
+	if err != nil {
 		return tracing.Error(span, err)
 	}
 
+	// a manifest holds every key, so only debug keys in their own object can be tagged as debug
+	if strings.HasPrefix(key, "@debug/") && s.cfg.MetadataLayout == LayoutKeys {
+		tags[TagDebug] = "true"
+	}
+
+	ctx = withTags(ctx, tags)
+
+	if s.cfg.MetadataLayout == LayoutManifest {
+		if err := s.writeManifestKey(ctx, hash, key, string(content)); err != nil {
+			return tracing.Error(span, err)
+		}
+	} else {
+		req := &s3.PutObjectInput{
+			Bucket: &s.cfg.BucketName,
+			Key:    s.metadataPath(hash, key),
+			Body:   bytes.NewReader(content),
+		}
+
+		if _, err := s.client.PutObject(ctx, req); err != nil {
+			return tracing.Error(span, err)
+		}
+	}
+
+	if isIndexed(key, string(content)) {
+		if err := s.writeIndex(ctx, hash, key, string(content)); err != nil {
+			return tracing.Error(span, err)
+		}
+	}
+
 	return nil
 }
 
@@ -104,6 +244,29 @@ func (s *S3Backend) ReadMetadata(ctx context.Context, hash string, keys []string
 	ctx, span := tr.Start(ctx, "read_metadata")
 	defer span.End()
 
+	span.SetAttributes(attribute.String("metadata_layout", s.cfg.MetadataLayout))
+
+	if s.cfg.MetadataLayout == LayoutManifest {
+		manifest, err := s.readManifest(ctx, hash, nil)
+		if err != nil {
+			return nil, tracing.Error(span, err)
+		}
+
+		return backends.SelectMetadata(manifest.Metadata, keys), nil
+	}
+
+	pairs, err := s.readMetadataKeys(ctx, hash, keys)
+	if err != nil {
+		return nil, tracing.Error(span, err)
+	}
+
+	return pairs, nil
+}
+
+func (s *S3Backend) readMetadataKeys(ctx context.Context, hash string, keys []string) (map[string]string, error) {
+	ctx, span := tr.Start(ctx, "read_metadata_keys")
+	defer span.End()
+
 	// if no keys are passed in, we return all keys and values
 	if len(keys) == 0 {
 		var err error
@@ -113,51 +276,48 @@ func (s *S3Backend) ReadMetadata(ctx context.Context, hash string, keys []string
 		}
 	}
 
-	wg := sync.WaitGroup{}
-	wg.Add(len(keys))
+	type result struct {
+		value string
+		found bool
+	}
 
-	errChan := make(chan error, len(keys))
-	pairs := make(map[string]string, len(keys))
+	results, err := backends.ForEach(ctx, s.cfg.Concurrency, keys, func(ctx context.Context, key string) (result, error) {
+		ctx, span := tr.Start(ctx, "read_"+key)
+		defer span.End()
 
-	for _, k := range keys {
-		go func(c context.Context, key string) {
-			ctx, span := tr.Start(c, "read_"+key)
-			defer span.End()
-			defer wg.Done()
-
-			span.SetAttributes(attribute.String("key", key))
-
-			res, err := s.client.GetObject(ctx, &s3.GetObjectInput{
-				Bucket: &s.cfg.BucketName,
-				Key:    s.metadataPath(hash, key),
-			})
-			if err != nil {
-				// if the key doesn't exist, that isn't an error for us, just no results.
-				var nokey *types.NoSuchKey
-				if errors.As(err, &nokey) {
-					return
-				}
+		span.SetAttributes(attribute.String("key", key))
 
-				errChan <- tracing.Error(span, err)
-				return
+		res, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: &s.cfg.BucketName,
+			Key:    s.metadataPath(hash, key),
+		})
+		if err != nil {
+			// if the key doesn't exist, that isn't an error for us, just no results.
+			var nokey *types.NoSuchKey
+			if errors.As(err, &nokey) {
+				return result{}, nil
 			}
-			defer res.Body.Close()
 
-			b, err := ioutil.ReadAll(res.Body)
-			if err != nil {
-				errChan <- tracing.Error(span, err)
-				return
-			}
+			return result{}, tracing.Error(span, err)
+		}
+		defer res.Body.Close()
 
-			pairs[key] = string(b)
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return result{}, tracing.Error(span, err)
+		}
 
-		}(ctx, k)
+		return result{value: string(b), found: true}, nil
+	})
+	if err != nil {
+		return nil, tracing.Error(span, err)
 	}
 
-	wg.Wait()
-
-	if err := collectErrors(errChan); err != nil {
-		return nil, tracing.Error(span, err)
+	pairs := make(map[string]string, len(keys))
+	for i, key := range keys {
+		if results[i].found {
+			pairs[key] = results[i].value
+		}
 	}
 
 	return pairs, nil
@@ -176,15 +336,72 @@ func (s *S3Backend) listMetadataKeys(ctx context.Context, hash string) ([]string
 		return nil, tracing.Error(span, err)
 	}
 
+	prefix := *s.metadataPath(hash, "") + "/"
 	keys := make([]string, len(res.Contents))
 
+	// keys can contain slashes (e.g. `@debug/hashes`), so take the whole path relative to the hash
 	for i, o := range res.Contents {
-		keys[i] = path.Base(*o.Key)
+		keys[i] = strings.TrimPrefix(*o.Key, prefix)
 	}
 
 	return keys, nil
 }
 
+// ListHashes returns every hash which has metadata, in either metadata layout.
+func (s *S3Backend) ListHashes(ctx context.Context) ([]string, error) {
+	ctx, span := tr.Start(ctx, "list_hashes")
+	defer span.End()
+
+	found := map[string]bool{}
+
+	metaPrefix := path.Join(s.cfg.PathPrefix, "meta") + "/"
+	manifestPrefix := path.Join(s.cfg.PathPrefix, "manifest") + "/"
+	delimiter := "/"
+
+	pages := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket:    &s.cfg.BucketName,
+		Prefix:    &metaPrefix,
+		Delimiter: &delimiter,
+	})
+
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, tracing.Error(span, err)
+		}
+
+		for _, p := range page.CommonPrefixes {
+			found[strings.TrimSuffix(strings.TrimPrefix(*p.Prefix, metaPrefix), "/")] = true
+		}
+	}
+
+	pages = s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: &s.cfg.BucketName,
+		Prefix: &manifestPrefix,
+	})
+
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, tracing.Error(span, err)
+		}
+
+		for _, o := range page.Contents {
+			found[strings.TrimPrefix(*o.Key, manifestPrefix)] = true
+		}
+	}
+
+	hashes := make([]string, 0, len(found))
+	for hash := range found {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+
+	span.SetAttributes(attribute.Int("hashes", len(hashes)))
+
+	return hashes, nil
+}
+
 func (s *S3Backend) hasMetadata(ctx context.Context, hash string, key string) (bool, error) {
 	ctx, span := tr.Start(ctx, "has_metadata")
 	defer span.End()
@@ -229,76 +446,333 @@ func (s *S3Backend) StoreArtifacts(ctx context.Context, hash string, files []*lo
 		span.SetAttributes(attribute.Bool("hash_created", true))
 	}
 
-	wg := sync.WaitGroup{}
-	wg.Add(len(files))
+	// blobs can be shared by many hashes, so they only have the configured tags
+	if s.cfg.ArtifactLayout == LayoutPath {
+		tags, err := s.hashTags(ctx, hash, nil)
+		if err != nil {
+			return nil, tracing.Error(span, err)
+		}
 
-	errChan := make(chan error, len(files))
-	writtenChan := make(chan string, len(files))
+		ctx = withTags(ctx, tags)
+	}
 
-	for _, lf := range files {
+	// artifacts in the blobs layout can't conflict by path, only by what the manifest points to
+	committed, _, err := backends.ReadArtifactManifest(ctx, s, hash)
+	if err != nil {
+		return nil, tracing.Error(span, err)
+	}
 
-		go func(c context.Context, localFile *localstorage.LocalFile) {
-			ctx, span := tr.Start(c, "store_"+path.Base(localFile.Path))
-			defer span.End()
-			defer localFile.Close()
-			defer wg.Done()
+	type result struct {
+		artifact backends.Artifact
+		conflict *backends.Conflict
+		stored   bool
+	}
 
-			s3path := s.artifactPath(hash, localFile.Path)
-			span.SetAttributes(
-				attribute.String("local_path", localFile.Path),
-				attribute.String("remote_path", s3path),
-			)
+	results, storeErr := backends.ForEach(ctx, s.cfg.Concurrency, files, func(ctx context.Context, localFile *localstorage.LocalFile) (result, error) {
+		ctx, span := tr.Start(ctx, "store_"+path.Base(localFile.Path))
+		defer span.End()
+		defer localFile.Close()
 
-			sha, err := hashFile(ctx, localFile.Content)
-			if err != nil {
-				errChan <- tracing.Error(span, err)
-				return
-			}
+		artifact, conflict, err := s.storeArtifact(ctx, hash, localFile, committed)
+		if err != nil {
+			return result{conflict: conflict}, tracing.Error(span, err)
+		}
 
-			span.SetAttributes(attribute.String("local_hash", sha))
+		return result{artifact: artifact, conflict: conflict, stored: true}, nil
+	})
 
-			if _, err := localFile.Content.Seek(0, 0); err != nil {
-				errChan <- tracing.Error(span, err)
-				return
-			}
+	// files which weren't started because the push was cancelled still need closing, and
+	// closing the others again is harmless
+	if ctx.Err() != nil {
+		for _, file := range files {
+			file.Close()
+		}
+	}
 
-			req := &s3.PutObjectInput{
-				Bucket: &s.cfg.BucketName,
-				Key:    &s3path,
-				Body:   localFile.Content,
-				Metadata: map[string]string{
-					"sha1": sha,
-				},
-			}
+	stored := backends.ArtifactManifest{}
+	conflicts := []backends.Conflict{}
 
-			if _, err := s.client.PutObject(ctx, req); err != nil {
-				errChan <- tracing.Error(span, err)
-				return
-			}
+	for i, res := range results {
+		if res.conflict != nil {
+			conflicts = append(conflicts, *res.conflict)
+		}
+		if res.stored {
+			stored[files[i].Path] = res.artifact
+		}
+	}
 
-			writtenChan <- localFile.Path
-		}(ctx, lf)
+	written := stored.Paths()
+
+	span.SetAttributes(attribute.Int("conflicts", len(conflicts)))
+
+	if len(conflicts) > 0 {
+		if err := backends.RecordConflicts(ctx, s, hash, conflicts); err != nil {
+			return written, tracing.Error(span, err)
+		}
 	}
 
-	wg.Wait()
+	if err := storeErr; err != nil {
+		// the manifest is only written once every artifact is stored, so that readers never
+		// see a partially pushed hash
+		span.SetAttributes(attribute.Bool("committed", false))
+
+		if len(conflicts) > 0 {
+			err = errors.Join(err, &backends.ConflictError{Policy: s.cfg.OnConflict, Conflicts: conflicts})
+		}
 
-	written := collectArray(writtenChan)
+		return written, tracing.Error(span, err)
+	}
 
-	if err := collectErrors(errChan); err != nil {
+	if err := s.commitArtifacts(ctx, hash, stored); err != nil {
+		span.SetAttributes(attribute.Bool("committed", false))
 		return written, tracing.Error(span, err)
 	}
 
+	span.SetAttributes(attribute.Bool("committed", true))
+
+	if len(conflicts) > 0 && s.cfg.OnConflict == backends.ConflictWarn {
+		return written, &backends.ConflictError{Policy: s.cfg.OnConflict, Conflicts: conflicts}
+	}
+
 	return written, nil
 }
 
-func hashFile(ctx context.Context, file io.Reader) (string, error) {
+// storeArtifact uploads a single artifact, unless identical content is already stored.  When the
+// hash's committed manifest has different content for the path, the conflict is returned, and
+// the conflict policy decides if the artifact is stored anyway.
+func (s *S3Backend) storeArtifact(ctx context.Context, hash string, localFile *localstorage.LocalFile, committed backends.ArtifactManifest) (backends.Artifact, *backends.Conflict, error) {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.String("local_path", localFile.Path))
+
+	content, seekable := localFile.Content.(io.ReadSeeker)
+	span.SetAttributes(attribute.Bool("seekable", seekable))
+
+	var sha, staged string
+	var size, stored int64
+	var err error
+
+	if seekable {
+		sha, size, err = hashFile(ctx, content)
+		if err != nil {
+			return backends.Artifact{}, nil, err
+		}
+
+		if _, err := content.Seek(0, 0); err != nil {
+			return backends.Artifact{}, nil, err
+		}
+	} else {
+		// streams can only be read once, so they are hashed while being uploaded
+		staged, sha, size, stored, err = s.stageStream(ctx, localFile.Content)
+		if err != nil {
+			return backends.Artifact{}, nil, err
+		}
+		defer s.deleteObject(ctx, staged)
+	}
+
+	artifact := backends.Artifact{Digest: sha, Size: size, Mode: localFile.Mode}
+
+	span.SetAttributes(
+		attribute.String("local_hash", sha),
+		attribute.Int64("size", size),
+	)
+
+	s3path := s.artifactPath(hash, localFile.Path)
+	if s.cfg.ArtifactLayout == LayoutBlobs {
+		s3path = s.blobPath(sha)
+	}
+
+	span.SetAttributes(attribute.String("remote_path", s3path))
+
+	var conflict *backends.Conflict
+	if existing, found := committed[localFile.Path]; found && existing.Digest != sha {
+		conflict = s.conflict(ctx, localFile.Path, existing.Digest, sha)
+
+		if s.cfg.OnConflict == backends.ConflictFail {
+			return artifact, conflict, conflict.Err()
+		}
+	}
+
+	for {
+		existing, version, err := s.objectDigest(ctx, s3path)
+		if err != nil {
+			return artifact, conflict, err
+		}
+
+		span.SetAttributes(attribute.String("remote_hash", existing))
+
+		if existing == sha {
+			return artifact, conflict, nil
+		}
+
+		// an object which no committed manifest references is left by a failed push, or was
+		// pushed before manifests, so is replaced without being a conflict.  It is only
+		// replaced if it hasn't changed since we checked, in case another process is writing it.
+		if version == "" {
+			version = absentVersion
+		}
+
+		if seekable {
+			err = s.putArtifact(ctx, s3path, content, sha, localFile.Metadata, version)
+		} else {
+			err = s.copyStaged(ctx, staged, s3path, stored, sha, localFile.Metadata, version)
+		}
+
+		if isPreconditionFailed(err) || (version != absentVersion && isNoSuchKey(err)) {
+			if seekable {
+				if _, err := content.Seek(0, 0); err != nil {
+					return artifact, conflict, err
+				}
+			}
+
+			continue
+		}
+
+		return artifact, conflict, err
+	}
+}
+
+func (s *S3Backend) putArtifact(ctx context.Context, key string, content io.Reader, sha string, metadata map[string]string, version string) error {
+	ctx, span := tr.Start(ctx, "put_artifact")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("compression", s.cfg.Compression))
+
+	if s.cfg.Compression == CompressionGzip {
+		compressed, err := compressToFile(content)
+		if compressed != nil {
+			defer os.Remove(compressed.Name())
+			defer compressed.Close()
+		}
+		if err != nil {
+			return tracing.Error(span, err)
+		}
+
+		content = compressed
+	}
+
+	headers := objectHeaders{
+		Metadata:        s.objectMetadata(sha, metadata),
+		ContentEncoding: s.contentEncoding(),
+	}
+
+	return s.putObject(ctx, key, content, sha, headers, version)
+}
+
+// objectHeaders are stored with a new object
+type objectHeaders struct {
+	Metadata        map[string]string
+	ContentEncoding *string
+	ContentType     *string
+}
+
+// putObject stores content, uploading it in parts if it is seekable and large.  It is only
+// written over the given version of the object, see writeConditions.
+func (s *S3Backend) putObject(ctx context.Context, key string, content io.Reader, sha string, headers objectHeaders, version string) error {
+	span := trace.SpanFromContext(ctx)
+
+	if seeker, ok := content.(io.ReadSeeker); ok {
+		size, err := seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return tracing.Error(span, err)
+		}
+
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return tracing.Error(span, err)
+		}
+
+		span.SetAttributes(attribute.Int64("size", size))
+
+		// large objects are uploaded in parts, as a single request is limited to 5GB and would
+		// have to be sent again completely if it failed
+		if size >= s.cfg.MultipartThreshold {
+			return s.putMultipart(ctx, key, seeker, size, sha, headers, version)
+		}
+	}
+
+	req := &s3.PutObjectInput{
+		Bucket:          &s.cfg.BucketName,
+		Key:             &key,
+		Body:            content,
+		Metadata:        headers.Metadata,
+		ContentEncoding: headers.ContentEncoding,
+		ContentType:     headers.ContentType,
+	}
+
+	req.IfMatch, req.IfNoneMatch = writeConditions(version)
+
+	_, err := s.client.PutObject(ctx, req)
+	return err
+}
+
+func (s *S3Backend) conflict(ctx context.Context, artifactPath string, existing string, incoming string) *backends.Conflict {
+	trace.SpanFromContext(ctx).AddEvent("conflict", trace.WithAttributes(
+		attribute.String("existing_hash", existing),
+		attribute.String("policy", string(s.cfg.OnConflict)),
+	))
+
+	return &backends.Conflict{
+		Path:     artifactPath,
+		Existing: existing,
+		Incoming: incoming,
+		When:     time.Now(),
+	}
+}
+
+// objectDigest returns the sha1 and ETag of the object, or empty strings if the object doesn't
+// exist
+func (s *S3Backend) objectDigest(ctx context.Context, key string) (string, string, error) {
+	ctx, span := tr.Start(ctx, "object_digest")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("key", key))
+
+	res, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &s.cfg.BucketName,
+		Key:    &key,
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return "", "", nil
+		}
+
+		return "", "", tracing.Error(span, err)
+	}
+
+	return res.Metadata["sha1"], aws.ToString(res.ETag), nil
+}
+
+func hashFile(ctx context.Context, file io.Reader) (string, int64, error) {
 
 	hash := sha1.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		return "", err
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil)), size, nil
+}
+
+func (s *S3Backend) hasObject(ctx context.Context, key string) (bool, error) {
+	ctx, span := tr.Start(ctx, "has_object")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("key", key))
+
+	_, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &s.cfg.BucketName,
+		Key:    &key,
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return false, nil
+		}
+
+		return false, tracing.Error(span, err)
 	}
 
-	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+	return true, nil
 }
 
 func (s *S3Backend) FetchArtifacts(ctx context.Context, hash string) ([]*backends.RemoteFile, error) {
@@ -311,57 +785,88 @@ func (s *S3Backend) FetchArtifact(ctx context.Context, hash string, name string)
 
 	span.SetAttributes(attribute.String("artifact_name", name))
 
-	remotePath := s.artifactPath(hash, name)
-
-	res, err := s.client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: &s.cfg.BucketName,
-		Key:    &remotePath,
-	})
+	manifest, _, err := backends.ReadArtifactManifest(ctx, s, hash)
 	if err != nil {
 		return nil, tracing.Error(span, err)
 	}
 
+	// artifacts which aren't in the manifest are either from a push which didn't complete,
+	// or don't exist at all.
+	artifact, found := manifest[name]
+	if !found {
+		return nil, tracing.Errorf(span, "artifact %s does not exist in hash %s", name, hash)
+	}
+
 	ts, _, err := backends.ReadTimestamp(ctx, s, hash)
 	if err != nil {
 		return nil, tracing.Error(span, err)
 	}
 
-	return &backends.RemoteFile{
-		Name:      name,
-		Content:   res.Body,
-		Timestamp: ts,
-	}, nil
+	file, err := s.ReadArtifact(ctx, hash, name, artifact, ts)
+	if err != nil {
+		return nil, tracing.Error(span, err)
+	}
 
+	return file, nil
 }
 
-func (s *S3Backend) ListArtifacts(ctx context.Context, hash string) ([]string, error) {
-	ctx, span := tr.Start(ctx, "list_artifact_keys")
+// ReadArtifact reads an artifact's content, without reading the hash's manifest or timestamp
+func (s *S3Backend) ReadArtifact(ctx context.Context, hash string, name string, artifact backends.Artifact, timestamp time.Time) (*backends.RemoteFile, error) {
+	ctx, span := tr.Start(ctx, "read_artifact")
 	defer span.End()
 
-	artifactPath := s.artifactPath(hash, "")
+	span.SetAttributes(attribute.String("artifact_name", name))
 
-	res, err := s.client.ListObjects(ctx, &s3.ListObjectsInput{
-		Bucket: &s.cfg.BucketName,
-		Prefix: &artifactPath,
-	})
+	remotePath := s.artifactKey(hash, name, artifact)
 
-	if err != nil {
-		return nil, tracing.Error(span, err)
-	}
+	var content io.ReadCloser
+	var metadata map[string]string
 
-	keys := make([]string, len(res.Contents))
+	// large artifacts are downloaded in parts, several at once
+	if artifact.Size >= s.cfg.MultipartThreshold {
+		span.SetAttributes(attribute.Bool("ranged", true))
 
-	for i, o := range res.Contents {
+		ranged, meta, err := s.getRanged(ctx, remotePath)
+		if err != nil {
+			return nil, tracing.Error(span, err)
+		}
 
-		name, err := filepath.Rel(artifactPath, *o.Key)
+		content, metadata = ranged, meta
+	} else {
+		res, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: &s.cfg.BucketName,
+			Key:    &remotePath,
+		})
 		if err != nil {
 			return nil, tracing.Error(span, err)
 		}
 
-		keys[i] = name
+		content, metadata = res.Body, res.Metadata
 	}
 
-	return keys, nil
+	body, err := decompressReader(content, metadata)
+	if err != nil {
+		return nil, tracing.Error(span, err)
+	}
+
+	return &backends.RemoteFile{
+		Name:      name,
+		Content:   backends.NewVerifyingReader(name, body, artifact.Digest),
+		Timestamp: timestamp,
+		Mode:      artifact.Mode,
+	}, nil
+}
+
+func (s *S3Backend) ListArtifacts(ctx context.Context, hash string) ([]string, error) {
+	ctx, span := tr.Start(ctx, "list_artifact_keys")
+	defer span.End()
+
+	manifest, _, err := backends.ReadArtifactManifest(ctx, s, hash)
+	if err != nil {
+		return nil, tracing.Error(span, err)
+	}
+
+	return manifest.Paths(), nil
 }
 
 func (s *S3Backend) metadataPath(hash string, key string) *string {
@@ -372,3 +877,16 @@ func (s *S3Backend) metadataPath(hash string, key string) *string {
 func (s *S3Backend) artifactPath(hash string, artifactPath string) string {
 	return path.Join(s.cfg.PathPrefix, "artifact", hash, artifactPath)
 }
+
+func (s *S3Backend) blobPath(digest string) string {
+	return path.Join(s.cfg.PathPrefix, "blobs", digest)
+}
+
+// artifactKey is where an artifact's content is stored in the backend's layout
+func (s *S3Backend) artifactKey(hash string, name string, artifact backends.Artifact) string {
+	if s.cfg.ArtifactLayout == LayoutBlobs {
+		return s.blobPath(artifact.Digest)
+	}
+
+	return s.artifactPath(hash, name)
+}
@@ -1,11 +1,29 @@
 package s3
 
 import (
+	"bytes"
+	"cas/backends"
+	"cas/localstorage"
 	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -143,3 +161,1311 @@ func TestRelative(t *testing.T) {
 	assert.Equal(t, "flagon", name)
 
 }
+
+func TestFindHashes(t *testing.T) {
+	cfg := createConfig()
+	EnsureBucket(context.Background(), cfg)
+
+	be, err := NewS3Backend(t.Context(), cfg)
+	require.NoError(t, err)
+
+	sha := uuid.Must(uuid.NewUUID()).String()
+	first := uuid.Must(uuid.NewUUID()).String()
+	second := uuid.Must(uuid.NewUUID()).String()
+
+	assert.NoError(t, be.WriteMetadata(t.Context(), first, "git.sha", strings.NewReader(sha)))
+	assert.NoError(t, be.WriteMetadata(t.Context(), first, "environment", strings.NewReader("production")))
+	assert.NoError(t, be.WriteMetadata(t.Context(), second, "git.sha", strings.NewReader(sha)))
+	assert.NoError(t, be.WriteMetadata(t.Context(), second, "environment", strings.NewReader("staging/eu")))
+
+	found, err := be.FindHashes(t.Context(), map[string]string{"git.sha": sha})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{first, second}, found)
+
+	found, err = be.FindHashes(t.Context(), map[string]string{"git.sha": sha, "environment": "staging/eu"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{second}, found)
+
+	// overwritten values are no longer found
+	assert.NoError(t, be.WriteMetadata(t.Context(), second, "environment", strings.NewReader("production")))
+
+	found, err = be.FindHashes(t.Context(), map[string]string{"git.sha": sha, "environment": "staging/eu"})
+	assert.NoError(t, err)
+	assert.Empty(t, found)
+
+	found, err = be.FindHashes(t.Context(), map[string]string{"git.sha": sha, "environment": "production"})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{first, second}, found)
+}
+
+func TestFindHashesDotValues(t *testing.T) {
+	cfg := createConfig()
+	EnsureBucket(context.Background(), cfg)
+
+	be, err := NewS3Backend(t.Context(), cfg)
+	require.NoError(t, err)
+
+	key := "dots-" + uuid.Must(uuid.NewUUID()).String()
+	values := []string{".", "..", "a/../b", "b", ".hidden"}
+	hashes := map[string]string{}
+
+	for _, value := range values {
+		hashes[value] = uuid.Must(uuid.NewUUID()).String()
+		require.NoError(t, be.WriteMetadata(t.Context(), hashes[value], key, strings.NewReader(value)))
+	}
+
+	// every value is a single segment of its index entry, rather than landing in the key's index,
+	// or the index of every key
+	for _, value := range values {
+		found, err := be.FindHashes(t.Context(), map[string]string{key: value})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{hashes[value]}, found, value)
+
+		entry := *be.indexPath(key, value, hashes[value])
+		assert.Equal(t, "tests/index/"+key, path.Dir(path.Dir(entry)), value)
+		assert.Equal(t, hashes[value], path.Base(entry), value)
+	}
+}
+
+func TestStoreArtifactsBlobs(t *testing.T) {
+	for _, layout := range []string{LayoutKeys, LayoutManifest} {
+		t.Run(layout, func(t *testing.T) {
+			cfg := createConfig()
+			cfg.ArtifactLayout = LayoutBlobs
+			cfg.MetadataLayout = layout
+			EnsureBucket(context.Background(), cfg)
+
+			testStoreArtifactsBlobs(t, cfg)
+		})
+	}
+}
+
+func testStoreArtifactsBlobs(t *testing.T, cfg S3Config) {
+
+	be, err := NewS3Backend(t.Context(), cfg)
+	require.NoError(t, err)
+
+	source := localstorage.NewMemoryStorage()
+	source.WriteFile(t.Context(), "dist/app", time.Now(), strings.NewReader("the same content "+uuid.NewString()))
+	source.WriteFile(t.Context(), "dist/other", time.Now(), strings.NewReader("other content"))
+
+	first := uuid.Must(uuid.NewUUID()).String()
+	second := uuid.Must(uuid.NewUUID()).String()
+
+	for _, hash := range []string{first, second} {
+		files, err := localstorage.ReadMany(t.Context(), source, []string{"dist/app", "dist/other"})
+		require.NoError(t, err)
+
+		written, err := be.StoreArtifacts(t.Context(), hash, files)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"dist/app", "dist/other"}, written)
+	}
+
+	firstManifest, found, err := backends.ReadArtifactManifest(t.Context(), be, first)
+	require.NoError(t, err)
+	require.True(t, found)
+
+	secondManifest, _, err := backends.ReadArtifactManifest(t.Context(), be, second)
+	require.NoError(t, err)
+	assert.Equal(t, firstManifest, secondManifest)
+
+	listed, err := be.ListArtifacts(t.Context(), second)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dist/app", "dist/other"}, listed)
+
+	file, err := be.FetchArtifact(t.Context(), second, "dist/other")
+	require.NoError(t, err)
+	defer file.Close()
+
+	content, _ := io.ReadAll(file.Content)
+	assert.Equal(t, "other content", string(content))
+
+	_, err = be.FetchArtifact(t.Context(), second, "dist/missing")
+	assert.ErrorContains(t, err, "does not exist")
+}
+
+func TestManifestLayout(t *testing.T) {
+	cfg := createConfig()
+	cfg.MetadataLayout = LayoutManifest
+	EnsureBucket(context.Background(), cfg)
+
+	hash := uuid.Must(uuid.NewUUID()).String()
+
+	be, err := NewS3Backend(t.Context(), cfg)
+	require.NoError(t, err)
+	assert.NoError(t, be.WriteMetadata(t.Context(), hash, "one", strings.NewReader("something")))
+
+	// a second process which has already read the manifest
+	other, err := NewS3Backend(t.Context(), cfg)
+	require.NoError(t, err)
+	_, err = other.ReadMetadata(t.Context(), hash, nil)
+	require.NoError(t, err)
+
+	assert.NoError(t, be.WriteMetadata(t.Context(), hash, "two", strings.NewReader("other thing")))
+	assert.NoError(t, other.WriteMetadata(t.Context(), hash, "three", strings.NewReader("third thing")))
+
+	fresh, err := NewS3Backend(t.Context(), cfg)
+	require.NoError(t, err)
+
+	meta, err := fresh.ReadMetadata(t.Context(), hash, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"one": "something", "two": "other thing", "three": "third thing"}, meta)
+
+	meta, err = fresh.ReadMetadata(t.Context(), hash, []string{"two"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"two": "other thing"}, meta)
+
+	exists, err := fresh.hasObject(t.Context(), *fresh.manifestPath(hash))
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	found, err := fresh.hasMetadata(t.Context(), hash, "one")
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	manifest, err := fresh.ReadManifest(t.Context(), hash, nil)
+	require.NoError(t, err)
+	assert.NotEmpty(t, manifest.Version)
+
+	unchanged, err := other.fetchManifest(t.Context(), hash, manifest)
+	assert.NoError(t, err)
+	assert.Same(t, manifest, unchanged)
+}
+
+func TestManifestMigration(t *testing.T) {
+	cfg := createConfig()
+	EnsureBucket(context.Background(), cfg)
+
+	hash := uuid.Must(uuid.NewUUID()).String()
+
+	keys, err := NewS3Backend(t.Context(), cfg)
+	require.NoError(t, err)
+	assert.NoError(t, keys.WriteMetadata(t.Context(), hash, "one", strings.NewReader("something")))
+	assert.NoError(t, keys.WriteMetadata(t.Context(), hash, "@debug/hashes", strings.NewReader("abc file.txt")))
+
+	cfg.MetadataLayout = LayoutManifest
+	be, err := NewS3Backend(t.Context(), cfg)
+	require.NoError(t, err)
+
+	// unmigrated hashes are still readable
+	meta, err := be.ReadMetadata(t.Context(), hash, []string{"one", "@debug/hashes"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"one": "something", "@debug/hashes": "abc file.txt"}, meta)
+
+	migrated, err := be.MigrateManifest(t.Context(), hash)
+	assert.NoError(t, err)
+	assert.True(t, migrated)
+
+	migrated, err = be.MigrateManifest(t.Context(), hash)
+	assert.NoError(t, err)
+	assert.False(t, migrated)
+
+	hashes, err := be.ListHashes(t.Context())
+	assert.NoError(t, err)
+	assert.Contains(t, hashes, hash)
+
+	fresh, err := NewS3Backend(t.Context(), cfg)
+	require.NoError(t, err)
+
+	manifest, err := fresh.ReadManifest(t.Context(), hash, nil)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, manifest.Version)
+	assert.Equal(t, map[string]string{"one": "something", "@debug/hashes": "abc file.txt"}, manifest.Metadata)
+}
+
+func TestArtifactMigration(t *testing.T) {
+	for _, layout := range []string{LayoutPath, LayoutBlobs} {
+		t.Run(layout, func(t *testing.T) {
+			cfg := createConfig()
+			cfg.ArtifactLayout = layout
+			EnsureBucket(context.Background(), cfg)
+
+			be, err := NewS3Backend(t.Context(), cfg)
+			require.NoError(t, err)
+
+			hash := uuid.Must(uuid.NewUUID()).String()
+			content := "pushed before manifests " + hash
+
+			// as pushed by earlier versions: a timestamp, and objects under the hash's prefix
+			require.NoError(t, backends.CreateHash(t.Context(), be, hash, time.Now()))
+
+			sha, _, err := hashFile(t.Context(), strings.NewReader(content))
+			require.NoError(t, err)
+
+			key := be.artifactPath(hash, "dist/app")
+			_, err = be.client.PutObject(t.Context(), &s3.PutObjectInput{
+				Bucket:   &cfg.BucketName,
+				Key:      &key,
+				Body:     strings.NewReader(content),
+				Metadata: map[string]string{"sha1": sha},
+			})
+			require.NoError(t, err)
+
+			listed, err := be.ListArtifacts(t.Context(), hash)
+			require.NoError(t, err)
+			assert.Empty(t, listed)
+
+			migrated, err := be.MigrateManifest(t.Context(), hash)
+			require.NoError(t, err)
+			assert.True(t, migrated)
+
+			fresh, err := NewS3Backend(t.Context(), cfg)
+			require.NoError(t, err)
+
+			listed, err = fresh.ListArtifacts(t.Context(), hash)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"dist/app"}, listed)
+
+			file, err := fresh.FetchArtifact(t.Context(), hash, "dist/app")
+			require.NoError(t, err)
+
+			fetched, err := io.ReadAll(file.Content)
+			file.Close()
+			require.NoError(t, err)
+			assert.Equal(t, content, string(fetched))
+
+			// the artifact is pushed again without a conflict
+			fresh.cfg.OnConflict = backends.ConflictFail
+
+			source := localstorage.NewMemoryStorage()
+			source.WriteFile(t.Context(), "dist/app", time.Now(), strings.NewReader(content))
+			files, err := localstorage.ReadMany(t.Context(), source, []string{"dist/app"})
+			require.NoError(t, err)
+
+			_, err = fresh.StoreArtifacts(t.Context(), hash, files)
+			require.NoError(t, err)
+
+			migrated, err = fresh.MigrateManifest(t.Context(), hash)
+			require.NoError(t, err)
+			assert.False(t, migrated)
+		})
+	}
+}
+
+type failingContent struct{}
+
+func (f *failingContent) Read(p []byte) (int, error)                   { return 0, errors.New("disk on fire") }
+func (f *failingContent) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+func (f *failingContent) Close() error                                 { return nil }
+
+func TestPartialPushIsNotVisible(t *testing.T) {
+	cfg := createConfig()
+	EnsureBucket(context.Background(), cfg)
+
+	be, err := NewS3Backend(t.Context(), cfg)
+	require.NoError(t, err)
+
+	hash := uuid.Must(uuid.NewUUID()).String()
+
+	source := localstorage.NewMemoryStorage()
+	source.WriteFile(t.Context(), "dist/app", time.Now(), strings.NewReader("content"))
+
+	good, err := source.ReadFile(t.Context(), "dist/app")
+	require.NoError(t, err)
+	bad := &localstorage.LocalFile{Path: "dist/broken", Content: &failingContent{}}
+
+	written, err := be.StoreArtifacts(t.Context(), hash, []*localstorage.LocalFile{good, bad})
+	assert.ErrorContains(t, err, "disk on fire")
+	assert.Equal(t, []string{"dist/app"}, written)
+
+	listed, err := be.ListArtifacts(t.Context(), hash)
+	assert.NoError(t, err)
+	assert.Empty(t, listed)
+
+	_, err = be.FetchArtifact(t.Context(), hash, "dist/app")
+	assert.ErrorContains(t, err, "does not exist")
+
+	// pushing again completes the hash
+	good, err = source.ReadFile(t.Context(), "dist/app")
+	require.NoError(t, err)
+
+	_, err = be.StoreArtifacts(t.Context(), hash, []*localstorage.LocalFile{good})
+	assert.NoError(t, err)
+
+	listed, err = be.ListArtifacts(t.Context(), hash)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dist/app"}, listed)
+}
+
+func TestConcurrentStoreArtifacts(t *testing.T) {
+	for _, layout := range []string{LayoutKeys, LayoutManifest} {
+		t.Run(layout, func(t *testing.T) {
+			EnsureBucket(context.Background(), createConfig())
+
+			hash := uuid.Must(uuid.NewUUID()).String()
+
+			// hold the first write of each push until both have read the manifest they merge into
+			var writes atomic.Int32
+			both := make(chan struct{})
+
+			server := requestProxy(t, func(r *http.Request) int {
+				committing := strings.HasSuffix(r.URL.Path, "/manifest/"+hash) || strings.HasSuffix(r.URL.Path, "/meta/"+hash+"/@artifacts")
+				if r.Method != http.MethodPut || !committing {
+					return 0
+				}
+
+				if writes.Add(1) == 2 {
+					close(both)
+				}
+
+				select {
+				case <-both:
+				case <-time.After(5 * time.Second):
+				}
+
+				return 0
+			})
+
+			cfg := createConfig()
+			cfg.Endpoint = server.URL
+			cfg.MetadataLayout = layout
+
+			setupCfg := createConfig()
+			setupCfg.MetadataLayout = layout
+
+			setup, err := NewS3Backend(t.Context(), setupCfg)
+			require.NoError(t, err)
+			require.NoError(t, backends.CreateHash(t.Context(), setup, hash, time.Now()))
+
+			wg := sync.WaitGroup{}
+			for _, name := range []string{"linux/app", "darwin/app"} {
+				be, err := NewS3Backend(t.Context(), cfg)
+				require.NoError(t, err)
+
+				source := localstorage.NewMemoryStorage()
+				source.WriteFile(t.Context(), name, time.Now(), strings.NewReader(name))
+
+				file, err := source.ReadFile(t.Context(), name)
+				require.NoError(t, err)
+
+				wg.Go(func() {
+					_, err := be.StoreArtifacts(t.Context(), hash, []*localstorage.LocalFile{file})
+					assert.NoError(t, err)
+				})
+			}
+			wg.Wait()
+
+			fresh, err := NewS3Backend(t.Context(), cfg)
+			require.NoError(t, err)
+
+			listed, err := fresh.ListArtifacts(t.Context(), hash)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"darwin/app", "linux/app"}, listed)
+		})
+	}
+}
+
+// requestProxy forwards requests to the real endpoint, unless handle returns a status for them
+func requestProxy(t *testing.T, handle func(r *http.Request) int) *httptest.Server {
+	target, err := url.Parse(os.Getenv("AWS_ENDPOINT_URL"))
+	require.NoError(t, err)
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status := handle(r); status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+
+		proxy.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestStoreArtifactsConflicts(t *testing.T) {
+	for _, layout := range []string{LayoutPath, LayoutBlobs} {
+		t.Run(layout, func(t *testing.T) {
+			cfg := createConfig()
+			cfg.ArtifactLayout = layout
+			EnsureBucket(context.Background(), cfg)
+
+			hash := uuid.Must(uuid.NewUUID()).String()
+
+			push := func(policy backends.ConflictPolicy, content string) ([]string, error) {
+				cfg.OnConflict = policy
+				be, err := NewS3Backend(t.Context(), cfg)
+				require.NoError(t, err)
+
+				source := localstorage.NewMemoryStorage()
+				source.WriteFile(t.Context(), "dist/app", time.Now(), strings.NewReader(content))
+				files, err := localstorage.ReadMany(t.Context(), source, []string{"dist/app"})
+				require.NoError(t, err)
+
+				return be.StoreArtifacts(t.Context(), hash, files)
+			}
+
+			read := func() string {
+				be, err := NewS3Backend(t.Context(), cfg)
+				require.NoError(t, err)
+
+				file, err := be.FetchArtifact(t.Context(), hash, "dist/app")
+				require.NoError(t, err)
+				defer file.Close()
+
+				content, _ := io.ReadAll(file.Content)
+				return string(content)
+			}
+
+			_, err := push(backends.ConflictFail, "first")
+			require.NoError(t, err)
+
+			// identical content is not a conflict
+			_, err = push(backends.ConflictFail, "first")
+			require.NoError(t, err)
+
+			_, err = push(backends.ConflictFail, "second")
+			var conflicts *backends.ConflictError
+			require.ErrorAs(t, err, &conflicts)
+			assert.Equal(t, "dist/app", conflicts.Conflicts[0].Path)
+			assert.Equal(t, "first", read())
+
+			_, err = push(backends.ConflictWarn, "second")
+			require.ErrorAs(t, err, &conflicts)
+			assert.Equal(t, backends.ConflictWarn, conflicts.Policy)
+			assert.Equal(t, "second", read())
+
+			_, err = push(backends.ConflictOverwrite, "third")
+			require.NoError(t, err)
+			assert.Equal(t, "third", read())
+
+			be, err := NewS3Backend(t.Context(), cfg)
+			require.NoError(t, err)
+
+			meta, err := be.ReadMetadata(t.Context(), hash, []string{backends.MetadataConflicts, backends.MetadataConflicted})
+			require.NoError(t, err)
+			assert.Equal(t, "true", meta[backends.MetadataConflicted])
+
+			recorded := []backends.Conflict{}
+			require.NoError(t, json.Unmarshal([]byte(meta[backends.MetadataConflicts]), &recorded))
+			assert.Len(t, recorded, 3)
+		})
+	}
+}
+
+func TestStoreArtifactsOrphans(t *testing.T) {
+	cfg := createConfig()
+	cfg.OnConflict = backends.ConflictFail
+	EnsureBucket(context.Background(), cfg)
+
+	hash := uuid.Must(uuid.NewUUID()).String()
+
+	be, err := NewS3Backend(t.Context(), cfg)
+	require.NoError(t, err)
+
+	key := be.artifactPath(hash, "dist/app")
+
+	orphan := func(content string) {
+		_, err := be.client.PutObject(t.Context(), &s3.PutObjectInput{
+			Bucket:   &cfg.BucketName,
+			Key:      &key,
+			Body:     strings.NewReader(content),
+			Metadata: map[string]string{"sha1": uuid.NewString()},
+		})
+		require.NoError(t, err)
+	}
+
+	// left by a failed push, so no manifest references it
+	orphan("orphaned")
+
+	// another process replaces the object between checking it and writing over it
+	puts := atomic.Int32{}
+	server := requestProxy(t, func(r *http.Request) int {
+		if r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/"+key) {
+			assert.NotEmpty(t, r.Header.Get("If-Match"))
+
+			if puts.Add(1) == 1 {
+				orphan("replaced")
+			}
+		}
+
+		return 0
+	})
+
+	proxied := cfg
+	proxied.Endpoint = server.URL
+
+	pusher, err := NewS3Backend(t.Context(), proxied)
+	require.NoError(t, err)
+
+	source := localstorage.NewMemoryStorage()
+	source.WriteFile(t.Context(), "dist/app", time.Now(), strings.NewReader("pushed"))
+	files, err := localstorage.ReadMany(t.Context(), source, []string{"dist/app"})
+	require.NoError(t, err)
+
+	_, err = pusher.StoreArtifacts(t.Context(), hash, files)
+	require.NoError(t, err)
+
+	// the first write was refused as the object had changed, and was retried over the new one
+	assert.Equal(t, int32(2), puts.Load())
+
+	file, err := be.FetchArtifact(t.Context(), hash, "dist/app")
+	require.NoError(t, err)
+
+	content, err := io.ReadAll(file.Content)
+	file.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "pushed", string(content))
+
+	meta, err := be.ReadMetadata(t.Context(), hash, []string{backends.MetadataConflicted})
+	require.NoError(t, err)
+	assert.Empty(t, meta)
+}
+
+func TestReleaseReplacedLease(t *testing.T) {
+	EnsureBucket(context.Background(), createConfig())
+
+	hash := uuid.Must(uuid.NewUUID()).String()
+
+	// each process keeps its own local state
+	builders := make([]*S3Backend, 3)
+	for i := range builders {
+		cfg := createConfig()
+		cfg.StatePath = t.TempDir()
+
+		be, err := NewS3Backend(t.Context(), cfg)
+		require.NoError(t, err)
+		builders[i] = be
+	}
+
+	first, second, third := builders[0], builders[1], builders[2]
+
+	// the first builder's lease expires while it builds, so the second takes over
+	acquired, err := first.AcquireLease(t.Context(), hash, -time.Second)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+
+	acquired, err = second.AcquireLease(t.Context(), hash, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+
+	// releasing the expired lease leaves the second builder's in place
+	require.NoError(t, first.ReleaseLease(t.Context(), hash))
+
+	acquired, err = third.AcquireLease(t.Context(), hash, time.Minute)
+	require.NoError(t, err)
+	assert.False(t, acquired, "the second builder still holds the lease")
+
+	// a process which never took the lease doesn't release it
+	require.NoError(t, third.ReleaseLease(t.Context(), hash))
+
+	acquired, err = third.AcquireLease(t.Context(), hash, time.Minute)
+	require.NoError(t, err)
+	assert.False(t, acquired)
+
+	require.NoError(t, second.ReleaseLease(t.Context(), hash))
+
+	acquired, err = third.AcquireLease(t.Context(), hash, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, acquired, "the second builder released its lease")
+}
+
+func TestLease(t *testing.T) {
+	cfg := createConfig()
+	cfg.StatePath = t.TempDir()
+	EnsureBucket(context.Background(), cfg)
+
+	hash := uuid.Must(uuid.NewUUID()).String()
+
+	be, err := NewS3Backend(t.Context(), cfg)
+	require.NoError(t, err)
+
+	acquired, err := be.AcquireLease(t.Context(), hash, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+
+	acquired, err = be.AcquireLease(t.Context(), hash, time.Minute)
+	require.NoError(t, err)
+	assert.False(t, acquired, "the lease is already held")
+
+	require.NoError(t, be.ReleaseLease(t.Context(), hash))
+	require.NoError(t, be.ReleaseLease(t.Context(), hash), "releasing twice is fine")
+
+	acquired, err = be.AcquireLease(t.Context(), hash, -time.Second)
+	require.NoError(t, err)
+	assert.True(t, acquired, "the lease was released")
+
+	acquired, err = be.AcquireLease(t.Context(), hash, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, acquired, "the previous lease had expired")
+}
+
+func TestAwaitLease(t *testing.T) {
+	cfg := createConfig()
+	cfg.StatePath = t.TempDir()
+	EnsureBucket(context.Background(), cfg)
+
+	hash := uuid.Must(uuid.NewUUID()).String()
+
+	be, err := NewS3Backend(t.Context(), cfg)
+	require.NoError(t, err)
+
+	state, err := backends.AwaitLease(t.Context(), be, hash, time.Minute, 0)
+	require.NoError(t, err)
+	assert.Equal(t, backends.LeaseHeld, state)
+
+	state, err = backends.AwaitLease(t.Context(), be, hash, time.Minute, 100*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, backends.LeaseTimeout, state)
+
+	_, err = be.StoreArtifacts(t.Context(), hash, []*localstorage.LocalFile{
+		{Path: "dist/out.txt", Content: &failingContent{}},
+	})
+	assert.Error(t, err)
+
+	state, err = backends.AwaitLease(t.Context(), be, hash, time.Minute, 0)
+	require.NoError(t, err)
+	assert.Equal(t, backends.LeaseTimeout, state, "an incomplete push doesn't end the wait")
+
+	source := localstorage.NewMemoryStorage()
+	source.WriteFile(t.Context(), "dist/out.txt", time.Now(), strings.NewReader("built"))
+
+	files, err := localstorage.ReadMany(t.Context(), source, []string{"dist/out.txt"})
+	require.NoError(t, err)
+
+	_, err = be.StoreArtifacts(t.Context(), hash, files)
+	require.NoError(t, err)
+
+	state, err = backends.AwaitLease(t.Context(), be, hash, time.Minute, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, backends.LeaseArtifacts, state)
+}
+
+func TestStoreArtifactsStream(t *testing.T) {
+	EnsureBucket(context.Background(), createConfig())
+
+	for _, layout := range []string{LayoutPath, LayoutBlobs} {
+		t.Run(layout, func(t *testing.T) {
+			cfg := createConfig()
+			cfg.ArtifactLayout = layout
+			cfg.PartSize = minPartSize
+
+			be, err := NewS3Backend(t.Context(), cfg)
+			require.NoError(t, err)
+
+			hash := uuid.Must(uuid.NewUUID()).String()
+
+			// larger than one part, so it is a multipart upload
+			large := strings.Repeat(uuid.NewString(), minPartSize/30)
+			small := "small " + uuid.NewString()
+
+			written, err := be.StoreArtifacts(t.Context(), hash, []*localstorage.LocalFile{
+				{Path: "large.tar", Content: io.NopCloser(strings.NewReader(large))},
+				{Path: "small.tar", Content: io.NopCloser(strings.NewReader(small))},
+			})
+			require.NoError(t, err)
+			assert.Equal(t, []string{"large.tar", "small.tar"}, written)
+
+			manifest, found, err := backends.ReadArtifactManifest(t.Context(), be, hash)
+			require.NoError(t, err)
+			require.True(t, found)
+			assert.Equal(t, int64(len(large)), manifest["large.tar"].Size)
+
+			for name, expected := range map[string]string{"large.tar": large, "small.tar": small} {
+				file, err := be.FetchArtifact(t.Context(), hash, name)
+				require.NoError(t, err)
+
+				content, err := io.ReadAll(file.Content)
+				file.Close()
+				require.NoError(t, err)
+				assert.Equal(t, expected, string(content), name)
+			}
+
+			// pushing the same stream again is detected as identical
+			_, err = be.StoreArtifacts(t.Context(), hash, []*localstorage.LocalFile{
+				{Path: "small.tar", Content: io.NopCloser(strings.NewReader(small))},
+			})
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestStoreArtifactsModes(t *testing.T) {
+	cfg := createConfig()
+	EnsureBucket(context.Background(), cfg)
+
+	be, err := NewS3Backend(t.Context(), cfg)
+	require.NoError(t, err)
+
+	hash := uuid.Must(uuid.NewUUID()).String()
+
+	source := localstorage.NewMemoryStorage()
+	source.WriteEntry(t.Context(), "bin/tool", time.Now(), 0755, strings.NewReader("#!/bin/sh"))
+	source.WriteEntry(t.Context(), "bin/link", time.Now(), os.ModeSymlink|0777, strings.NewReader("tool"))
+	source.WriteEntry(t.Context(), "bin/empty", time.Now(), os.ModeDir|0700, strings.NewReader(""))
+
+	files, err := localstorage.ReadMany(t.Context(), source, []string{"bin/tool", "bin/link", "bin/empty"})
+	require.NoError(t, err)
+
+	_, err = be.StoreArtifacts(t.Context(), hash, files)
+	require.NoError(t, err)
+
+	expected := map[string]os.FileMode{
+		"bin/tool":  0755,
+		"bin/link":  os.ModeSymlink | 0777,
+		"bin/empty": os.ModeDir | 0700,
+	}
+
+	for name, mode := range expected {
+		file, err := be.FetchArtifact(t.Context(), hash, name)
+		require.NoError(t, err)
+		file.Close()
+
+		assert.Equal(t, mode, file.Mode, name)
+	}
+}
+
+func TestFetchArtifactVerifiesDigest(t *testing.T) {
+	cfg := createConfig()
+	EnsureBucket(context.Background(), cfg)
+
+	be, err := NewS3Backend(t.Context(), cfg)
+	require.NoError(t, err)
+
+	hash := uuid.Must(uuid.NewUUID()).String()
+
+	source := localstorage.NewMemoryStorage()
+	source.WriteFile(t.Context(), "dist/app", time.Now(), strings.NewReader("the real content"))
+
+	files, err := localstorage.ReadMany(t.Context(), source, []string{"dist/app"})
+	require.NoError(t, err)
+
+	_, err = be.StoreArtifacts(t.Context(), hash, files)
+	require.NoError(t, err)
+
+	// replace the content behind the backend's back
+	key := be.artifactPath(hash, "dist/app")
+	_, err = be.client.PutObject(t.Context(), &s3.PutObjectInput{
+		Bucket: &cfg.BucketName,
+		Key:    &key,
+		Body:   strings.NewReader("corrupted content"),
+	})
+	require.NoError(t, err)
+
+	file, err := be.FetchArtifact(t.Context(), hash, "dist/app")
+	require.NoError(t, err)
+	defer file.Close()
+
+	_, err = io.ReadAll(file.Content)
+
+	var mismatch *backends.DigestError
+	require.ErrorAs(t, err, &mismatch)
+	assert.Equal(t, "dist/app", mismatch.Name)
+}
+
+func TestStoreArtifactsCompressed(t *testing.T) {
+	cfg := createConfig()
+	EnsureBucket(context.Background(), cfg)
+
+	compressedCfg := createConfig()
+	compressedCfg.Compression = CompressionGzip
+
+	compressed, err := NewS3Backend(t.Context(), compressedCfg)
+	require.NoError(t, err)
+
+	plain, err := NewS3Backend(t.Context(), cfg)
+	require.NoError(t, err)
+
+	hash := uuid.Must(uuid.NewUUID()).String()
+	content := strings.Repeat("compressible content ", 1000)
+
+	source := localstorage.NewMemoryStorage()
+	source.WriteFile(t.Context(), "dist/bundle.js", time.Now(), strings.NewReader(content))
+
+	files, err := localstorage.ReadMany(t.Context(), source, []string{"dist/bundle.js"})
+	require.NoError(t, err)
+	files = append(files, &localstorage.LocalFile{Path: "dist/streamed.js", Content: io.NopCloser(strings.NewReader(content))})
+
+	_, err = compressed.StoreArtifacts(t.Context(), hash, files)
+	require.NoError(t, err)
+
+	for _, name := range []string{"dist/bundle.js", "dist/streamed.js"} {
+		key := compressed.artifactPath(hash, name)
+		res, err := compressed.client.GetObject(t.Context(), &s3.GetObjectInput{Bucket: &cfg.BucketName, Key: &key})
+		require.NoError(t, err)
+
+		stored, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+
+		assert.Less(t, len(stored), len(content)/10, name)
+		assert.Equal(t, CompressionGzip, res.Metadata[compressionMetadata], name)
+
+		// compression is read from each object, so doesn't depend on the reader's configuration
+		for _, be := range []*S3Backend{compressed, plain} {
+			file, err := be.FetchArtifact(t.Context(), hash, name)
+			require.NoError(t, err)
+
+			fetched, err := io.ReadAll(file.Content)
+			file.Close()
+			require.NoError(t, err)
+			assert.Equal(t, content, string(fetched), name)
+		}
+	}
+
+	manifest, _, err := backends.ReadArtifactManifest(t.Context(), compressed, hash)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), manifest["dist/streamed.js"].Size)
+}
+
+// flakyProxy forwards requests to the real endpoint, except for those that fail returns a status
+func flakyProxy(t *testing.T, fail func(request int) int) (*httptest.Server, *atomic.Int32) {
+	target, err := url.Parse(os.Getenv("AWS_ENDPOINT_URL"))
+	require.NoError(t, err)
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	requests := &atomic.Int32{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status := fail(int(requests.Add(1))); status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+
+		proxy.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, requests
+}
+
+func TestRetries(t *testing.T) {
+	EnsureBucket(context.Background(), createConfig())
+
+	retry := backends.RetryPolicy{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	hash := uuid.Must(uuid.NewUUID()).String()
+
+	cases := []struct {
+		name     string
+		fail     func(request int) int
+		requests int32
+		class    backends.ErrorClass
+	}{
+		{
+			name:     "transient then ok",
+			fail:     func(request int) int { return map[int]int{1: 500, 2: 503}[request] },
+			requests: 3,
+		},
+		{
+			name:     "throttled then ok",
+			fail:     func(request int) int { return map[int]int{1: 429}[request] },
+			requests: 2,
+		},
+		{
+			name:     "always transient",
+			fail:     func(request int) int { return 502 },
+			requests: 3,
+			class:    backends.ErrorTransient,
+		},
+		{
+			name:     "auth is not retried",
+			fail:     func(request int) int { return 403 },
+			requests: 1,
+			class:    backends.ErrorAuth,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, requests := flakyProxy(t, tc.fail)
+
+			cfg := createConfig()
+			cfg.Endpoint = server.URL
+			cfg.Retry = retry
+
+			be, err := NewS3Backend(t.Context(), cfg)
+			require.NoError(t, err)
+
+			err = be.WriteMetadata(t.Context(), hash, "@retried", strings.NewReader(tc.name))
+			assert.Equal(t, tc.requests, requests.Load())
+
+			if tc.class == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.Equal(t, tc.class, backends.Classify(err))
+			}
+		})
+	}
+}
+
+func TestClassifyNotFound(t *testing.T) {
+	be, err := NewS3Backend(t.Context(), createConfig())
+	require.NoError(t, err)
+
+	_, err = be.client.GetObject(t.Context(), &s3.GetObjectInput{
+		Bucket: &be.cfg.BucketName,
+		Key:    aws.String("tests/missing/" + uuid.NewString()),
+	})
+	assert.Equal(t, backends.ErrorNotFound, backends.Classify(err))
+	assert.True(t, isNoSuchKey(err))
+}
+
+func writeRandomFile(t *testing.T, size int) (string, []byte) {
+	content := make([]byte, size)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+
+	filePath := filepath.Join(t.TempDir(), "large.bin")
+	require.NoError(t, os.WriteFile(filePath, content, 0644))
+
+	return filePath, content
+}
+
+func openFile(t *testing.T, filePath string) *localstorage.LocalFile {
+	file, err := os.Open(filePath)
+	require.NoError(t, err)
+
+	return &localstorage.LocalFile{Path: "large.bin", Content: file}
+}
+
+func TestMultipart(t *testing.T) {
+	EnsureBucket(context.Background(), createConfig())
+
+	filePath, content := writeRandomFile(t, 2*minPartSize+1024)
+
+	var uploads, ranges atomic.Int32
+	server := requestProxy(t, func(r *http.Request) int {
+		if r.URL.Query().Has("partNumber") {
+			uploads.Add(1)
+		}
+		if r.Method == http.MethodGet && r.Header.Get("Range") != "" {
+			ranges.Add(1)
+		}
+		return 0
+	})
+
+	cfg := createConfig()
+	cfg.Endpoint = server.URL
+	cfg.MultipartThreshold = minPartSize + 1
+	cfg.PartSize = minPartSize
+	cfg.StatePath = t.TempDir()
+
+	be, err := NewS3Backend(t.Context(), cfg)
+	require.NoError(t, err)
+
+	hash := uuid.Must(uuid.NewUUID()).String()
+
+	_, err = be.StoreArtifacts(t.Context(), hash, []*localstorage.LocalFile{openFile(t, filePath)})
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), uploads.Load())
+
+	file, err := be.FetchArtifact(t.Context(), hash, "large.bin")
+	require.NoError(t, err)
+
+	fetched, err := io.ReadAll(file.Content)
+	file.Close()
+	require.NoError(t, err)
+	assert.Equal(t, content, fetched)
+	assert.Equal(t, int32(3), ranges.Load())
+}
+
+func TestMultipartResume(t *testing.T) {
+	EnsureBucket(context.Background(), createConfig())
+
+	filePath, content := writeRandomFile(t, 2*minPartSize+1024)
+
+	var uploads atomic.Int32
+	failing := atomic.Bool{}
+	failing.Store(true)
+
+	server := requestProxy(t, func(r *http.Request) int {
+		if !r.URL.Query().Has("partNumber") {
+			return 0
+		}
+
+		uploads.Add(1)
+
+		// the connection drops while the second part is uploaded
+		if failing.Load() && r.URL.Query().Get("partNumber") == "2" {
+			return http.StatusForbidden
+		}
+		return 0
+	})
+
+	cfg := createConfig()
+	cfg.Endpoint = server.URL
+	cfg.MultipartThreshold = minPartSize + 1
+	cfg.PartSize = minPartSize
+	cfg.StatePath = t.TempDir()
+
+	be, err := NewS3Backend(t.Context(), cfg)
+	require.NoError(t, err)
+
+	hash := uuid.Must(uuid.NewUUID()).String()
+
+	_, err = be.StoreArtifacts(t.Context(), hash, []*localstorage.LocalFile{openFile(t, filePath)})
+	require.Error(t, err)
+	assert.Equal(t, int32(3), uploads.Load())
+
+	// the upload is recorded in the state path, so a push from another directory can resume it
+	state, err := filepath.Glob(filepath.Join(cfg.StatePath, "uploads", "*.json"))
+	require.NoError(t, err)
+	assert.Len(t, state, 1)
+
+	// pushing again only uploads the part which failed
+	failing.Store(false)
+	uploads.Store(0)
+
+	_, err = be.StoreArtifacts(t.Context(), hash, []*localstorage.LocalFile{openFile(t, filePath)})
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), uploads.Load())
+
+	file, err := be.FetchArtifact(t.Context(), hash, "large.bin")
+	require.NoError(t, err)
+
+	fetched, err := io.ReadAll(file.Content)
+	file.Close()
+	require.NoError(t, err)
+	assert.Equal(t, content, fetched)
+}
+
+func TestMultipartCopy(t *testing.T) {
+	EnsureBucket(context.Background(), createConfig())
+
+	// streams are staged and then copied into place, which needs parts above maxCopySize
+	previous := maxCopySize
+	maxCopySize = minPartSize
+	t.Cleanup(func() { maxCopySize = previous })
+
+	_, content := writeRandomFile(t, 2*minPartSize+1024)
+
+	cfg := createConfig()
+	cfg.PartSize = minPartSize
+
+	be, err := NewS3Backend(t.Context(), cfg)
+	require.NoError(t, err)
+
+	hash := uuid.Must(uuid.NewUUID()).String()
+
+	_, err = be.StoreArtifacts(t.Context(), hash, []*localstorage.LocalFile{
+		{Path: "large.bin", Content: io.NopCloser(bytes.NewReader(content))},
+	})
+	require.NoError(t, err)
+
+	file, err := be.FetchArtifact(t.Context(), hash, "large.bin")
+	require.NoError(t, err)
+
+	fetched, err := io.ReadAll(file.Content)
+	file.Close()
+	require.NoError(t, err)
+	assert.Equal(t, content, fetched)
+}
+
+func TestObjectSettings(t *testing.T) {
+	EnsureBucket(context.Background(), createConfig())
+
+	headers := map[string]http.Header{}
+	lock := sync.Mutex{}
+
+	server := requestProxy(t, func(r *http.Request) int {
+		if r.Method == http.MethodPut && !r.URL.Query().Has("partNumber") {
+			lock.Lock()
+			headers[r.URL.Path] = r.Header.Clone()
+			lock.Unlock()
+		}
+		return 0
+	})
+
+	cfg := createConfig()
+	cfg.Endpoint = server.URL
+	cfg.KMSKeyID = "alias/cas"
+	cfg.StorageClass = "STANDARD_IA"
+	cfg.ACL = "bucket-owner-full-control"
+
+	be, err := NewS3Backend(t.Context(), cfg)
+	require.NoError(t, err)
+
+	hash := uuid.Must(uuid.NewUUID()).String()
+
+	_, err = be.StoreArtifacts(t.Context(), hash, []*localstorage.LocalFile{
+		{Path: "dist/app.js", Content: io.NopCloser(strings.NewReader("app"))},
+	})
+	require.NoError(t, err)
+	require.NoError(t, be.WriteMetadata(t.Context(), hash, "branch", strings.NewReader("main")))
+
+	// every object written has the settings, not just the artifacts
+	require.NotEmpty(t, headers)
+	for path, header := range headers {
+		assert.Equal(t, "aws:kms", header.Get("X-Amz-Server-Side-Encryption"), path)
+		assert.Equal(t, "alias/cas", header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"), path)
+		assert.Equal(t, "STANDARD_IA", header.Get("X-Amz-Storage-Class"), path)
+		assert.Equal(t, "bucket-owner-full-control", header.Get("X-Amz-Acl"), path)
+	}
+}
+
+func TestObjectSettingsInvalid(t *testing.T) {
+	for name, cfg := range map[string]S3Config{
+		"sse":           {ServerSideEncryption: "rot13"},
+		"kms with s3":   {ServerSideEncryption: "AES256", KMSKeyID: "alias/cas"},
+		"storage class": {StorageClass: "CARDBOARD"},
+		"acl":           {ACL: "everyone"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewS3Backend(t.Context(), cfg)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestAssumeRole(t *testing.T) {
+	EnsureBucket(context.Background(), createConfig())
+
+	var assumed url.Values
+	var authorization atomic.Value
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		assumed = r.PostForm
+
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte(`<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>ASSUMEDKEY</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>token</SessionToken>
+      <Expiration>2100-01-01T00:00:00Z</Expiration>
+    </Credentials>
+    <AssumedRoleUser>
+      <Arn>arn:aws:sts::123456789012:assumed-role/cas/cas</Arn>
+      <AssumedRoleId>AROA:cas</AssumedRoleId>
+    </AssumedRoleUser>
+  </AssumeRoleResult>
+</AssumeRoleResponse>`))
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("AWS_ENDPOINT_URL_STS", server.URL)
+
+	s3Server := requestProxy(t, func(r *http.Request) int {
+		authorization.Store(r.Header.Get("Authorization"))
+		return 0
+	})
+
+	cfg := createConfig()
+	cfg.Endpoint = s3Server.URL
+	cfg.RoleARN = "arn:aws:iam::123456789012:role/cas"
+	cfg.ExternalID = "ci"
+
+	be, err := NewS3Backend(t.Context(), cfg)
+	require.NoError(t, err)
+
+	hash := uuid.Must(uuid.NewUUID()).String()
+	require.NoError(t, be.WriteMetadata(t.Context(), hash, "branch", strings.NewReader("main")))
+
+	assert.Equal(t, "AssumeRole", assumed.Get("Action"))
+	assert.Equal(t, cfg.RoleARN, assumed.Get("RoleArn"))
+	assert.Equal(t, "ci", assumed.Get("ExternalId"))
+
+	// requests are signed with the role's credentials
+	assert.Contains(t, authorization.Load(), "Credential=ASSUMEDKEY/")
+}
+
+func objectTags(t *testing.T, be *S3Backend, key string) map[string]string {
+	res, err := be.client.GetObjectTagging(t.Context(), &s3.GetObjectTaggingInput{
+		Bucket: &be.cfg.BucketName,
+		Key:    &key,
+	})
+	require.NoError(t, err)
+
+	tags := map[string]string{}
+	for _, tag := range res.TagSet {
+		tags[*tag.Key] = *tag.Value
+	}
+
+	return tags
+}
+
+func TestTags(t *testing.T) {
+	EnsureBucket(context.Background(), createConfig())
+
+	for _, layout := range []string{LayoutPath, LayoutBlobs} {
+		t.Run(layout, func(t *testing.T) {
+			cfg := createConfig()
+			cfg.ArtifactLayout = layout
+			cfg.Tags = "team=games"
+			cfg.TagKeys = "branch,retention"
+
+			be, err := NewS3Backend(t.Context(), cfg)
+			require.NoError(t, err)
+
+			hash := uuid.Must(uuid.NewUUID()).String()
+
+			require.NoError(t, be.WriteMetadata(t.Context(), hash, "branch", strings.NewReader("feature/new-level")))
+			require.NoError(t, be.WriteMetadata(t.Context(), hash, "@debug/hashes", strings.NewReader("{}")))
+
+			_, err = be.StoreArtifacts(t.Context(), hash, []*localstorage.LocalFile{
+				{Path: "dist/level.pak", Content: io.NopCloser(strings.NewReader("level " + layout))},
+			})
+			require.NoError(t, err)
+
+			hashTags := map[string]string{"team": "games", "branch": "feature/new-level"}
+
+			assert.Equal(t, hashTags, objectTags(t, be, *be.metadataPath(hash, "branch")))
+			assert.Equal(t, map[string]string{"team": "games", "branch": "feature/new-level", "debug": "true"}, objectTags(t, be, *be.metadataPath(hash, "@debug/hashes")))
+			assert.Equal(t, hashTags, objectTags(t, be, *be.metadataPath(hash, backends.MetadataArtifacts)))
+
+			manifest, _, err := backends.ReadArtifactManifest(t.Context(), be, hash)
+			require.NoError(t, err)
+
+			// blobs are shared between hashes, so they only have the configured tags
+			if layout == LayoutBlobs {
+				assert.Equal(t, map[string]string{"team": "games"}, objectTags(t, be, be.blobPath(manifest["dist/level.pak"].Digest)))
+			} else {
+				assert.Equal(t, hashTags, objectTags(t, be, be.artifactPath(hash, "dist/level.pak")))
+			}
+		})
+	}
+}
+
+func TestTagsReadOnce(t *testing.T) {
+	EnsureBucket(context.Background(), createConfig())
+
+	hash := uuid.Must(uuid.NewUUID()).String()
+
+	reads := atomic.Int32{}
+	server := requestProxy(t, func(r *http.Request) int {
+		if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/meta/"+hash+"/retention") {
+			reads.Add(1)
+		}
+
+		return 0
+	})
+
+	cfg := createConfig()
+	cfg.Endpoint = server.URL
+	cfg.TagKeys = "branch,retention"
+
+	be, err := NewS3Backend(t.Context(), cfg)
+	require.NoError(t, err)
+
+	// as written by the encryption backend
+	require.NoError(t, be.WriteMetadata(t.Context(), hash, "branch", strings.NewReader(backends.EncryptedValuePrefix+"c2VjcmV0")))
+	require.NoError(t, be.WriteMetadata(t.Context(), hash, "@debug/hashes", strings.NewReader("{}")))
+
+	_, err = be.StoreArtifacts(t.Context(), hash, []*localstorage.LocalFile{
+		{Path: "dist/app", Content: io.NopCloser(strings.NewReader("app"))},
+	})
+	require.NoError(t, err)
+
+	// the missing key is only read once, however many objects are written
+	assert.Equal(t, int32(1), reads.Load())
+
+	// and the encrypted value isn't a tag
+	assert.Empty(t, objectTags(t, be, *be.metadataPath(hash, "branch")))
+	assert.Empty(t, objectTags(t, be, be.artifactPath(hash, "dist/app")))
+}
+
+func TestTagsInvalid(t *testing.T) {
+	for name, cfg := range map[string]S3Config{
+		"not a pair":    {Tags: "team"},
+		"invalid value": {Tags: "team=games&more"},
+		"invalid key":   {TagKeys: "branch,wh*t"},
+		"too many":      {Tags: "a=1,b=2,c=3,d=4,e=5", TagKeys: "f,g,h,i,j"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewS3Backend(t.Context(), cfg)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package s3
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+)
+
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+)
+
+// objects record their compression in their metadata as well as their Content-Encoding, so that
+// a proxy or client decoding the Content-Encoding itself doesn't leave us guessing.
+const compressionMetadata = "compression"
+
+// objectMetadata is the metadata for an artifact object, compressed with the configured compression.
+// The file's own metadata can't replace the digest or compression.
+func (s *S3Backend) objectMetadata(sha string, fileMetadata map[string]string) map[string]string {
+	metadata := map[string]string{}
+	for key, value := range fileMetadata {
+		metadata[key] = value
+	}
+
+	metadata["sha1"] = sha
+
+	if s.cfg.Compression == CompressionGzip {
+		metadata[compressionMetadata] = CompressionGzip
+	}
+
+	return metadata
+}
+
+// contentEncoding is the Content-Encoding for new artifact objects, or nil if they aren't compressed
+func (s *S3Backend) contentEncoding() *string {
+	if s.cfg.Compression != CompressionGzip {
+		return nil
+	}
+
+	encoding := CompressionGzip
+	return &encoding
+}
+
+// compressReader returns the content compressed with gzip.  The returned reader must be closed,
+// so that the compression stops if the content isn't read completely.
+func compressReader(content io.Reader) io.ReadCloser {
+	reader, writer := io.Pipe()
+
+	go func() {
+		gz := gzip.NewWriter(writer)
+
+		_, err := io.Copy(gz, content)
+		if err == nil {
+			err = gz.Close()
+		}
+
+		writer.CloseWithError(err)
+	}()
+
+	return reader
+}
+
+// compressToFile writes the compressed content to a temporary file, as uploads need to know
+// their length.  The caller removes the file once it is finished with it.
+func compressToFile(content io.Reader) (*os.File, error) {
+	f, err := os.CreateTemp("", "cas-*.gz")
+	if err != nil {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(f)
+
+	if _, err := io.Copy(gz, content); err != nil {
+		return f, err
+	}
+
+	if err := gz.Close(); err != nil {
+		return f, err
+	}
+
+	if _, err := f.Seek(0, 0); err != nil {
+		return f, err
+	}
+
+	return f, nil
+}
+
+// decompressReader decompresses an artifact object's body based on how it was stored.  Objects
+// without compression metadata are returned as is.
+func decompressReader(body io.ReadCloser, metadata map[string]string) (io.ReadCloser, error) {
+	if metadata[compressionMetadata] != CompressionGzip {
+		return body, nil
+	}
+
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+
+	return &decompressingReader{Reader: gz, body: body}, nil
+}
+
+type decompressingReader struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (r *decompressingReader) Close() error {
+	r.Reader.Close()
+	return r.body.Close()
+}
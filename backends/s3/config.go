@@ -1,28 +1,106 @@
 package s3
 
 import (
+	"cas/backends"
 	"cas/config"
+	"time"
 )
 
 type S3Config struct {
 	Endpoint string
+	// Region and Profile override the AWS configuration's region and shared config profile
+	Region  string
+	Profile string
+	// VirtualHosted addresses the bucket as part of the host name, rather than the path
+	VirtualHosted bool
 
 	AccessKey string
 	SecretKey string
 
+	// RoleARN is a role to assume with the configured credentials, with ExternalID if the role
+	// requires one
+	RoleARN    string
+	ExternalID string
+
+	// applied to every object written
+	ServerSideEncryption string
+	KMSKeyID             string
+	StorageClass         string
+	ACL                  string
+
+	// Tags are `key=value` pairs set on every object written, and TagKeys are metadata keys
+	// whose values are set as tags on the hash's objects
+	Tags    string
+	TagKeys string
+
 	BucketName string
 	PathPrefix string
+
+	ArtifactLayout string
+	MetadataLayout string
+	Compression    string
+
+	// artifacts at least MultipartThreshold bytes are uploaded and downloaded in parts of
+	// PartSize, with PartConcurrency parts at once
+	MultipartThreshold int64
+	PartSize           int64
+	PartConcurrency    int
+
+	// StatePath is the local directory for state which outlives a process, such as the leases it
+	// holds and interrupted multipart uploads.  It is set by commands from their --state-path
+	StatePath string
+
+	// set from the backend configuration, as they apply to all backends
+	OnConflict backends.ConflictPolicy
+	Retry      backends.RetryPolicy
+
+	// Concurrency is the most requests an operation makes at once, or zero for the default
+	Concurrency int
+
+	// ConnectTimeout is how long to wait for a connection to the endpoint, or zero for the
+	// SDK's default
+	ConnectTimeout time.Duration
 }
 
+const (
+	// LayoutPath stores each artifact under `artifact/{hash}/{path}`
+	LayoutPath = "path"
+	// LayoutBlobs stores each artifact's content once under `blobs/{digest}`, with the path to
+	// digest mapping in the hash's `@artifacts` metadata
+	LayoutBlobs = "blobs"
+
+	// LayoutKeys stores each metadata key in its own object under `meta/{hash}/{key}`
+	LayoutKeys = "keys"
+	// LayoutManifest stores all of a hash's metadata in one object, `manifest/{hash}`
+	LayoutManifest = "manifest"
+)
+
 func (cfg *S3Config) Flags() *config.ConfigGroup {
 
 	group := config.NewConfigGroup("backend: s3")
 
 	group.StringFlag(&cfg.Endpoint, "s3-endpoint", "CAS_S3_ENDPOINT", "", "")
+	group.StringFlag(&cfg.Region, "s3-region", "CAS_S3_REGION", "", "the bucket's region, if not the AWS configuration's region")
+	group.StringFlag(&cfg.Profile, "s3-profile", "CAS_S3_PROFILE", "", "the shared AWS configuration profile to use")
+	group.BoolFlag(&cfg.VirtualHosted, "s3-virtual-hosted", "CAS_S3_VIRTUAL_HOSTED", false, "address the bucket in the host name rather than the path")
 	group.StringFlag(&cfg.AccessKey, "s3-access-key", "CAS_S3_ACCESS_KEY", "", "")
 	group.StringFlag(&cfg.SecretKey, "s3-secret-key", "CAS_S3_SECRET_KEY", "", "")
+	group.StringFlag(&cfg.RoleARN, "s3-role-arn", "CAS_S3_ROLE_ARN", "", "a role to assume for accessing the bucket")
+	group.StringFlag(&cfg.ExternalID, "s3-external-id", "CAS_S3_EXTERNAL_ID", "", "the external id required to assume the role")
+	group.StringFlag(&cfg.ServerSideEncryption, "s3-sse", "CAS_S3_SSE", "", "server side encryption for new objects: AES256, or aws:kms")
+	group.StringFlag(&cfg.KMSKeyID, "s3-sse-kms-key-id", "CAS_S3_SSE_KMS_KEY_ID", "", "the KMS key to encrypt new objects with, implies --s3-sse aws:kms")
+	group.StringFlag(&cfg.StorageClass, "s3-storage-class", "CAS_S3_STORAGE_CLASS", "", "the storage class of new objects, such as STANDARD_IA")
+	group.StringFlag(&cfg.ACL, "s3-acl", "CAS_S3_ACL", "", "the canned ACL of new objects, such as bucket-owner-full-control")
+	group.StringFlag(&cfg.Tags, "s3-tags", "CAS_S3_TAGS", "", "tags for every new object, as key=value pairs separated by commas")
+	group.StringFlag(&cfg.TagKeys, "s3-tag-keys", "CAS_S3_TAG_KEYS", "", "metadata keys, separated by commas, whose values are tags on the hash's new objects")
 	group.StringFlag(&cfg.BucketName, "s3-bucket-name", "CAS_S3_BUCKET", "", "")
 	group.StringFlag(&cfg.PathPrefix, "s3-path-prefix", "CAS_S3_PATH_PREFIX", "", "")
+	group.StringFlag(&cfg.ArtifactLayout, "s3-artifact-layout", "CAS_S3_ARTIFACT_LAYOUT", LayoutPath, "how artifacts are stored: path, or blobs to store identical content once")
+	group.StringFlag(&cfg.MetadataLayout, "s3-metadata-layout", "CAS_S3_METADATA_LAYOUT", LayoutKeys, "how metadata is stored: keys, or manifest to store all of a hash's metadata in one object")
+	group.StringFlag(&cfg.Compression, "s3-compression", "CAS_S3_COMPRESSION", CompressionNone, "how new artifacts are compressed: none, or gzip")
+	group.SizeFlag(&cfg.MultipartThreshold, "s3-multipart-threshold", "CAS_S3_MULTIPART_THRESHOLD", DefaultMultipartThreshold, "artifacts of at least this size are uploaded and downloaded in parts")
+	group.SizeFlag(&cfg.PartSize, "s3-part-size", "CAS_S3_PART_SIZE", DefaultPartSize, "the size of each part, at least 5MiB")
+	group.IntFlag(&cfg.PartConcurrency, "s3-part-concurrency", "CAS_S3_PART_CONCURRENCY", DefaultPartConcurrency, "how many parts of an artifact are transferred at once")
 
 	return group
 }
@@ -0,0 +1,203 @@
+package s3
+
+import (
+	"cas/backends"
+	"cas/tracing"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// CopyHash copies a hash from another S3 backend, which can have a different bucket, prefix or
+// layout.  Artifacts are copied by S3 when both backends use the same endpoint, and otherwise
+// are downloaded and uploaded again.  Metadata values are copied as stored, so encrypted values
+// and signatures stay valid.
+func (s *S3Backend) CopyHash(ctx context.Context, source backends.Backend, hash string) (int, error) {
+	ctx, span := tr.Start(ctx, "copy_hash")
+	defer span.End()
+
+	from, ok := source.(*S3Backend)
+	if !ok {
+		return 0, tracing.Error(span, backends.ErrCopyUnsupported)
+	}
+
+	metadata, err := from.ReadMetadata(ctx, hash, nil)
+	if err != nil {
+		return 0, tracing.Error(span, err)
+	}
+
+	if _, found := metadata[backends.MetadataTimeStamp]; !found {
+		return 0, tracing.Errorf(span, "hash %s does not exist", hash)
+	}
+
+	manifest, _, err := backends.ReadArtifactManifest(ctx, from, hash)
+	if err != nil {
+		return 0, tracing.Error(span, err)
+	}
+
+	serverSide := s.sameEndpoint(from)
+
+	span.SetAttributes(
+		attribute.Int("artifacts", len(manifest)),
+		attribute.Int("metadata_keys", len(metadata)),
+		attribute.Bool("server_side", serverSide),
+	)
+
+	// the tag keys are in the metadata being copied, rather than the destination
+	if s.cfg.ArtifactLayout == LayoutPath {
+		tags, err := s.hashTags(ctx, hash, metadata)
+		if err != nil {
+			return 0, tracing.Error(span, err)
+		}
+
+		ctx = withTags(ctx, tags)
+	}
+
+	names := slices.Sorted(maps.Keys(manifest))
+
+	copied, err := backends.ForEach(ctx, s.cfg.Concurrency, names, func(ctx context.Context, name string) (bool, error) {
+		return s.copyArtifact(ctx, from, hash, name, manifest[name], serverSide)
+	})
+	if err != nil {
+		return 0, tracing.Error(span, err)
+	}
+
+	transferred := 0
+	for _, done := range copied {
+		if done {
+			transferred++
+		}
+	}
+
+	span.SetAttributes(attribute.Int("transferred", transferred))
+
+	// the artifact manifest is written last, so the hash has no artifacts until they are all copied
+	keys := slices.Sorted(maps.Keys(metadata))
+	keys = slices.DeleteFunc(keys, func(key string) bool { return key == backends.MetadataArtifacts })
+
+	if _, found := metadata[backends.MetadataArtifacts]; found {
+		keys = append(keys, backends.MetadataArtifacts)
+	}
+
+	for _, key := range keys {
+		if err := s.WriteMetadata(ctx, hash, key, strings.NewReader(metadata[key])); err != nil {
+			return transferred, tracing.Error(span, err)
+		}
+	}
+
+	return transferred, nil
+}
+
+// sameEndpoint is true if requests to the other backend's bucket can be made with this backend's
+// client, so objects can be copied between them by S3
+func (s *S3Backend) sameEndpoint(other *S3Backend) bool {
+	return s.cfg.Endpoint == other.cfg.Endpoint &&
+		s.cfg.Region == other.cfg.Region &&
+		s.cfg.Profile == other.cfg.Profile &&
+		s.cfg.RoleARN == other.cfg.RoleARN
+}
+
+// copyArtifact copies an artifact's object, returning false if it had already been copied
+func (s *S3Backend) copyArtifact(ctx context.Context, from *S3Backend, hash string, name string, artifact backends.Artifact, serverSide bool) (bool, error) {
+	ctx, span := tr.Start(ctx, "copy_artifact")
+	defer span.End()
+
+	source := from.artifactKey(hash, name, artifact)
+	key := s.artifactKey(hash, name, artifact)
+
+	span.SetAttributes(
+		attribute.String("artifact_name", name),
+		attribute.String("source", source),
+		attribute.String("key", key),
+	)
+
+	existing, _, err := s.objectDigest(ctx, key)
+	if err != nil {
+		return false, tracing.Error(span, err)
+	}
+
+	if existing == artifact.Digest {
+		span.SetAttributes(attribute.Bool("skipped", true))
+		return false, nil
+	}
+
+	if existing != "" {
+		span.AddEvent("replaced", trace.WithAttributes(attribute.String("existing_hash", existing)))
+	}
+
+	head, err := from.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &from.cfg.BucketName,
+		Key:    &source,
+	})
+	if err != nil {
+		return false, tracing.Error(span, err)
+	}
+
+	// larger objects would need copying in parts, which can't keep the source's metadata
+	if serverSide && *head.ContentLength <= maxCopySize {
+		copySource := copySource(from.cfg.BucketName, source)
+
+		_, err := s.client.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:            &s.cfg.BucketName,
+			Key:               &key,
+			CopySource:        &copySource,
+			MetadataDirective: types.MetadataDirectiveCopy,
+		})
+		if err != nil {
+			return false, tracing.Error(span, err)
+		}
+
+		return true, nil
+	}
+
+	span.SetAttributes(attribute.Bool("downloaded", true))
+
+	if err := s.transferArtifact(ctx, from, hash, name, artifact, key, head.Metadata); err != nil {
+		return false, tracing.Error(span, err)
+	}
+
+	return true, nil
+}
+
+// transferArtifact downloads an artifact from the other backend, checking its digest, and stores
+// it with this backend's compression.  It is written to a temporary file first, so large
+// artifacts can be uploaded in parts.
+func (s *S3Backend) transferArtifact(ctx context.Context, from *S3Backend, hash string, name string, artifact backends.Artifact, key string, objectMetadata map[string]string) error {
+	file, err := from.ReadArtifact(ctx, hash, name, artifact, time.Time{})
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	temp, err := os.CreateTemp("", "cas-copy-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+
+	if _, err := io.Copy(temp, file.Content); err != nil {
+		return fmt.Errorf("downloading %s: %w", name, err)
+	}
+
+	if _, err := temp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	// such as the encryption key id, while the digest and compression are set for this backend
+	metadata := maps.Clone(objectMetadata)
+	delete(metadata, "sha1")
+	delete(metadata, compressionMetadata)
+
+	return s.putArtifact(ctx, key, temp, artifact.Digest, metadata, anyVersion)
+}
@@ -2,51 +2,62 @@ package s3
 
 import (
 	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
 )
 
-func collectErrors(errChan chan error) error {
-
-	errs := []error{}
-	for {
-		select {
-		case e := <-errChan:
-			errs = append(errs, e)
-		default:
-			close(errChan)
-			return errors.Join(errs...)
-		}
+func statusCode(err error) int {
+	var res *smithyhttp.ResponseError
+	if errors.As(err, &res) {
+		return res.HTTPStatusCode()
 	}
+
+	return 0
 }
 
-type pair struct {
-	key   string
-	value string
+func isNoSuchKey(err error) bool {
+	var nokey *types.NoSuchKey
+	return errors.As(err, &nokey)
 }
 
-func collectMap(writtenChan chan pair) map[string]string {
-
-	written := map[string]string{}
-	for {
-		select {
-		case pair := <-writtenChan:
-			written[pair.key] = pair.value
-		default:
-			close(writtenChan)
-			return written
-		}
+func isNotModified(err error) bool {
+	return statusCode(err) == http.StatusNotModified
+}
+
+func isPreconditionFailed(err error) bool {
+	return err != nil && statusCode(err) == http.StatusPreconditionFailed
+}
+
+// an object's version, for conditional writes: anyVersion writes unconditionally, absentVersion
+// only creates the object, and an ETag only replaces that version of it
+const (
+	anyVersion    = ""
+	absentVersion = "*"
+)
+
+// writeConditions returns the If-Match and If-None-Match headers which only write over version
+func writeConditions(version string) (*string, *string) {
+	switch version {
+	case anyVersion:
+		return nil, nil
+	case absentVersion:
+		return nil, &version
+	default:
+		return &version, nil
 	}
 }
 
-func collectArray(writtenChan chan string) []string {
-
-	written := []string{}
-	for {
-		select {
-		case val := <-writtenChan:
-			written = append(written, val)
-		default:
-			close(writtenChan)
-			return written
-		}
+// copySource is an object's CopySource, which S3 requires to be URL-encoded.  Each segment is
+// query escaped, as path escaping leaves `+` which S3 would decode as a space.
+func copySource(bucket string, key string) string {
+	segments := strings.Split(bucket+"/"+key, "/")
+	for i, segment := range segments {
+		segments[i] = strings.ReplaceAll(url.QueryEscape(segment), "+", "%20")
 	}
+
+	return strings.Join(segments, "/")
 }
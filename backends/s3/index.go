@@ -0,0 +1,151 @@
+package s3
+
+import (
+	"cas/tracing"
+	"context"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// values longer than this are not indexed; they are unlikely to be searched for, and the
+// value is part of the index object's key, which S3 limits to 1024 bytes.
+const maxIndexedValueLength = 256
+
+// isIndexed decides if a metadata pair should be written to the index.  Keys starting with
+// `@` are internal to cas (timestamps, debug data), so are never indexed.
+func isIndexed(key string, value string) bool {
+	return !strings.HasPrefix(key, "@") &&
+		value != "" &&
+		len(value) <= maxIndexedValueLength &&
+		!strings.ContainsAny(value, "\r\n")
+}
+
+func (s *S3Backend) writeIndex(ctx context.Context, hash string, key string, value string) error {
+	ctx, span := tr.Start(ctx, "write_index")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("key", key))
+
+	req := &s3.PutObjectInput{
+		Bucket: &s.cfg.BucketName,
+		Key:    s.indexPath(key, value, hash),
+		Body:   strings.NewReader(""),
+	}
+
+	if _, err := s.client.PutObject(ctx, req); err != nil {
+		return tracing.Error(span, err)
+	}
+
+	return nil
+}
+
+func (s *S3Backend) FindHashes(ctx context.Context, query map[string]string) ([]string, error) {
+	ctx, span := tr.Start(ctx, "find_hashes")
+	defer span.End()
+
+	span.SetAttributes(attribute.Int("predicates", len(query)))
+
+	var candidates map[string]bool
+	keys := make([]string, 0, len(query))
+
+	for key, value := range query {
+		keys = append(keys, key)
+
+		hashes, err := s.listIndex(ctx, key, value)
+		if err != nil {
+			return nil, tracing.Error(span, err)
+		}
+
+		if candidates == nil {
+			candidates = hashes
+			continue
+		}
+
+		for hash := range candidates {
+			if !hashes[hash] {
+				delete(candidates, hash)
+			}
+		}
+	}
+
+	span.SetAttributes(attribute.Int("candidates", len(candidates)))
+
+	// the index is only ever appended to, so when a key is overwritten the index still has the
+	// old value; check each candidate's current values to filter these out.
+	found := []string{}
+	for hash := range candidates {
+		meta, err := s.ReadMetadata(ctx, hash, keys)
+		if err != nil {
+			return nil, tracing.Error(span, err)
+		}
+
+		if matches(meta, query) {
+			found = append(found, hash)
+		}
+	}
+
+	sort.Strings(found)
+	span.SetAttributes(attribute.Int("found", len(found)))
+
+	return found, nil
+}
+
+func (s *S3Backend) listIndex(ctx context.Context, key string, value string) (map[string]bool, error) {
+	ctx, span := tr.Start(ctx, "list_index")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("key", key))
+
+	prefix := *s.indexPath(key, value, "") + "/"
+	hashes := map[string]bool{}
+
+	pages := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: &s.cfg.BucketName,
+		Prefix: &prefix,
+	})
+
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, tracing.Error(span, err)
+		}
+
+		for _, o := range page.Contents {
+			hashes[strings.TrimPrefix(*o.Key, prefix)] = true
+		}
+	}
+
+	return hashes, nil
+}
+
+func matches(meta map[string]string, query map[string]string) bool {
+	for key, value := range query {
+		if meta[key] != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *S3Backend) indexPath(key string, value string, hash string) *string {
+	p := path.Join(s.cfg.PathPrefix, "index", indexSegment(key), indexSegment(value), hash)
+	return &p
+}
+
+// indexSegment escapes a key or value as a single path segment.  Path escaping leaves dots
+// alone, so a leading dot is escaped too, otherwise `.` and `..` would be collapsed by path.Join
+// and move the entry into another key's or value's index.
+func indexSegment(value string) string {
+	escaped := url.PathEscape(value)
+	if strings.HasPrefix(escaped, ".") {
+		escaped = "%2E" + escaped[1:]
+	}
+
+	return escaped
+}
@@ -0,0 +1,222 @@
+package s3
+
+import (
+	"bytes"
+	"cas/tracing"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// taking a lease is retried if other processes take or release it in between our requests
+const maxLeaseAttempts = 5
+
+type leaseDocument struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// AcquireLease creates the hash's lease object, or replaces it if it has expired.  Both are
+// conditional writes, so only one process can take the lease.  The lease's version is recorded
+// in the local state, so that the push which finishes the build releases only this lease.  The
+// hash's remembered manifest is forgotten, so that artifacts pushed by the lease holder are seen.
+func (s *S3Backend) AcquireLease(ctx context.Context, hash string, ttl time.Duration) (bool, error) {
+	ctx, span := tr.Start(ctx, "acquire_lease")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("hash", hash),
+		attribute.String("ttl", ttl.String()),
+	)
+
+	s.forgetManifest(hash)
+
+	for attempt := 1; attempt <= maxLeaseAttempts; attempt++ {
+		span.SetAttributes(attribute.Int("attempts", attempt))
+
+		version, err := s.putLease(ctx, hash, ttl, "")
+		if err == nil {
+			span.SetAttributes(attribute.Bool("acquired", true))
+			return s.leased(span, hash, version)
+		}
+		if !isPreconditionFailed(err) {
+			return false, tracing.Error(span, err)
+		}
+
+		current, version, err := s.readLease(ctx, hash)
+		if err != nil {
+			return false, tracing.Error(span, err)
+		}
+
+		// released since we tried to create it
+		if current == nil {
+			continue
+		}
+
+		span.SetAttributes(attribute.String("owner", current.Owner))
+
+		if time.Now().Before(current.Expires) {
+			span.SetAttributes(attribute.Bool("acquired", false))
+			return false, nil
+		}
+
+		// the holder has expired, so replace its lease unless someone else already has
+		version, err = s.putLease(ctx, hash, ttl, version)
+		if err == nil {
+			span.SetAttributes(attribute.Bool("acquired", true), attribute.Bool("expired", true))
+			return s.leased(span, hash, version)
+		}
+		if !isPreconditionFailed(err) {
+			return false, tracing.Error(span, err)
+		}
+	}
+
+	span.SetAttributes(attribute.Bool("acquired", false))
+	return false, nil
+}
+
+// ReleaseLease removes the lease this process took, if it still holds it.  A lease which
+// expired while building can have been taken by another process, whose lease is left in place.
+func (s *S3Backend) ReleaseLease(ctx context.Context, hash string) error {
+	ctx, span := tr.Start(ctx, "release_lease")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("hash", hash))
+
+	recordPath := s.leaseRecordPath(hash)
+
+	version, err := os.ReadFile(recordPath)
+	if errors.Is(err, os.ErrNotExist) {
+		span.SetAttributes(attribute.Bool("held", false))
+		return nil
+	}
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	ifMatch := string(version)
+	_, err = s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:  &s.cfg.BucketName,
+		Key:     s.leasePath(hash),
+		IfMatch: &ifMatch,
+	})
+
+	if isPreconditionFailed(err) {
+		span.SetAttributes(attribute.Bool("replaced", true))
+	} else if err != nil && !isNoSuchKey(err) {
+		return tracing.Error(span, err)
+	}
+
+	if err := os.Remove(recordPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return tracing.Error(span, err)
+	}
+
+	return nil
+}
+
+// putLease writes a new lease if the current lease is still at the given version, or if there
+// is no lease when the version is empty, returning the new lease's version.
+func (s *S3Backend) putLease(ctx context.Context, hash string, ttl time.Duration, version string) (string, error) {
+	content, err := json.Marshal(leaseDocument{
+		Owner:   leaseOwner(),
+		Expires: time.Now().Add(ttl).UTC(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req := &s3.PutObjectInput{
+		Bucket: &s.cfg.BucketName,
+		Key:    s.leasePath(hash),
+		Body:   bytes.NewReader(content),
+	}
+
+	if version == "" {
+		wildcard := "*"
+		req.IfNoneMatch = &wildcard
+	} else {
+		req.IfMatch = &version
+	}
+
+	res, err := s.client.PutObject(ctx, req)
+	if err != nil {
+		return "", err
+	}
+
+	return *res.ETag, nil
+}
+
+// leased records the version of a lease this process took, for ReleaseLease
+func (s *S3Backend) leased(span trace.Span, hash string, version string) (bool, error) {
+	recordPath := s.leaseRecordPath(hash)
+
+	if err := os.MkdirAll(path.Dir(recordPath), os.ModePerm); err != nil {
+		return false, tracing.Error(span, err)
+	}
+
+	if err := os.WriteFile(recordPath, []byte(version), 0666); err != nil {
+		return false, tracing.Error(span, err)
+	}
+
+	return true, nil
+}
+
+// readLease returns the current lease and its version, or nil if there is no lease
+func (s *S3Backend) readLease(ctx context.Context, hash string) (*leaseDocument, string, error) {
+	res, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &s.cfg.BucketName,
+		Key:    s.leasePath(hash),
+	})
+	if err != nil {
+		if isNoSuchKey(err) {
+			return nil, "", nil
+		}
+
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	lease := &leaseDocument{}
+	if err := json.NewDecoder(res.Body).Decode(lease); err != nil {
+		return nil, "", err
+	}
+
+	return lease, *res.ETag, nil
+}
+
+func leaseOwner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+func (s *S3Backend) leaseRecordPath(hash string) string {
+	id := sha1.Sum([]byte(s.cfg.BucketName + "/" + *s.leasePath(hash)))
+	return s.localStatePath("leases", fmt.Sprintf("%x", id))
+}
+
+// DefaultStatePath is where local state is kept when the configuration doesn't set StatePath,
+// matching the commands' default --state-path
+const DefaultStatePath = ".cas/state"
+
+func (s *S3Backend) localStatePath(elements ...string) string {
+	statePath := s.cfg.StatePath
+	if statePath == "" {
+		statePath = DefaultStatePath
+	}
+
+	return path.Join(append([]string{statePath}, elements...)...)
+}
+
+func (s *S3Backend) leasePath(hash string) *string {
+	p := path.Join(s.cfg.PathPrefix, "lease", hash)
+	return &p
+}
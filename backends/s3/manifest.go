@@ -0,0 +1,481 @@
+package s3
+
+import (
+	"bytes"
+	"cas/backends"
+	"cas/tracing"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// writing a key is a read-modify-write of the manifest, which is retried if another process
+// changes the manifest in between.
+const maxManifestWriteAttempts = 5
+
+type manifestDocument struct {
+	Metadata  map[string]string `json:"metadata"`
+	Artifacts json.RawMessage   `json:"artifacts,omitempty"`
+}
+
+func (s *S3Backend) ReadManifest(ctx context.Context, hash string, cached *backends.Manifest) (*backends.Manifest, error) {
+	if s.cfg.MetadataLayout != LayoutManifest {
+		return nil, backends.ErrManifestUnsupported
+	}
+
+	return s.readManifest(ctx, hash, cached)
+}
+
+func (s *S3Backend) readManifest(ctx context.Context, hash string, cached *backends.Manifest) (*backends.Manifest, error) {
+	ctx, span := tr.Start(ctx, "read_manifest")
+	defer span.End()
+
+	s.manifestsLock.Lock()
+	manifest, found := s.manifests[hash]
+	s.manifestsLock.Unlock()
+
+	span.SetAttributes(attribute.Bool("memory_hit", found))
+
+	if found {
+		return manifest, nil
+	}
+
+	manifest, err := s.fetchManifest(ctx, hash, cached)
+	if err != nil {
+		return nil, tracing.Error(span, err)
+	}
+
+	s.rememberManifest(hash, manifest)
+
+	return manifest, nil
+}
+
+func (s *S3Backend) fetchManifest(ctx context.Context, hash string, cached *backends.Manifest) (*backends.Manifest, error) {
+	ctx, span := tr.Start(ctx, "fetch_manifest")
+	defer span.End()
+
+	req := &s3.GetObjectInput{
+		Bucket: &s.cfg.BucketName,
+		Key:    s.manifestPath(hash),
+	}
+
+	if cached != nil && cached.Version != "" {
+		req.IfNoneMatch = &cached.Version
+	}
+
+	res, err := s.client.GetObject(ctx, req)
+	if err != nil {
+		if isNotModified(err) {
+			span.SetAttributes(attribute.Bool("not_modified", true))
+			return cached, nil
+		}
+
+		if isNoSuchKey(err) {
+			// hashes written before the manifest layout was used only have separate keys
+			span.SetAttributes(attribute.Bool("keys_fallback", true))
+
+			meta, err := s.readMetadataKeys(ctx, hash, nil)
+			if err != nil {
+				return nil, tracing.Error(span, err)
+			}
+
+			return &backends.Manifest{Metadata: meta}, nil
+		}
+
+		return nil, tracing.Error(span, err)
+	}
+	defer res.Body.Close()
+
+	doc := manifestDocument{}
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		return nil, tracing.Error(span, err)
+	}
+
+	metadata := doc.Metadata
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+
+	if len(doc.Artifacts) > 0 {
+		metadata[backends.MetadataArtifacts] = string(doc.Artifacts)
+	}
+
+	return &backends.Manifest{
+		Metadata: metadata,
+		Version:  *res.ETag,
+	}, nil
+}
+
+func (s *S3Backend) writeManifestKey(ctx context.Context, hash string, key string, value string) error {
+	ctx, span := tr.Start(ctx, "write_manifest_key")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("key", key))
+
+	err := s.updateManifest(ctx, hash, func(metadata map[string]string) error {
+		metadata[key] = value
+		return nil
+	})
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	return nil
+}
+
+// updateManifest applies the update to the hash's current metadata and writes the manifest back,
+// starting again from the new manifest if another process changes it in between.
+func (s *S3Backend) updateManifest(ctx context.Context, hash string, update func(metadata map[string]string) error) error {
+	ctx, span := tr.Start(ctx, "update_manifest")
+	defer span.End()
+
+	for attempt := 1; attempt <= maxManifestWriteAttempts; attempt++ {
+		span.SetAttributes(attribute.Int("attempts", attempt))
+
+		current, err := s.readManifest(ctx, hash, nil)
+		if err != nil {
+			return tracing.Error(span, err)
+		}
+
+		metadata := backends.SelectMetadata(current.Metadata, nil)
+		if err := update(metadata); err != nil {
+			return tracing.Error(span, err)
+		}
+
+		version, err := s.putManifest(ctx, hash, metadata, current.Version)
+		if isPreconditionFailed(err) {
+			s.forgetManifest(hash)
+			continue
+		}
+		if err != nil {
+			return tracing.Error(span, err)
+		}
+
+		s.rememberManifest(hash, &backends.Manifest{Metadata: metadata, Version: version})
+
+		return nil
+	}
+
+	return tracing.Errorf(span, "the manifest for %s was modified by another process %d times, giving up", hash, maxManifestWriteAttempts)
+}
+
+// commitArtifacts adds the stored artifacts to the hash's artifact manifest.  Several pushes can
+// commit to the same hash at once (e.g. matrix jobs with different outputs), so the manifest is
+// only written if it hasn't changed since it was read, and merged again if it has.
+func (s *S3Backend) commitArtifacts(ctx context.Context, hash string, stored backends.ArtifactManifest) error {
+	ctx, span := tr.Start(ctx, "commit_artifacts")
+	defer span.End()
+
+	span.SetAttributes(attribute.Int("artifacts", len(stored)))
+
+	tags, err := s.hashTags(ctx, hash, nil)
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	ctx = withTags(ctx, tags)
+
+	if s.cfg.MetadataLayout == LayoutManifest {
+		err := s.updateManifest(ctx, hash, func(metadata map[string]string) error {
+			merged, err := backends.MergeArtifactManifest(metadata[backends.MetadataArtifacts], stored)
+			metadata[backends.MetadataArtifacts] = merged
+			return err
+		})
+		if err != nil {
+			return tracing.Error(span, err)
+		}
+
+		return nil
+	}
+
+	key := s.metadataPath(hash, backends.MetadataArtifacts)
+
+	for attempt := 1; attempt <= maxManifestWriteAttempts; attempt++ {
+		span.SetAttributes(attribute.Int("attempts", attempt))
+
+		current, version, err := s.readObject(ctx, *key)
+		if err != nil {
+			return tracing.Error(span, err)
+		}
+
+		merged, err := backends.MergeArtifactManifest(current, stored)
+		if err != nil {
+			return tracing.Error(span, err)
+		}
+
+		req := &s3.PutObjectInput{
+			Bucket: &s.cfg.BucketName,
+			Key:    key,
+			Body:   strings.NewReader(merged),
+		}
+
+		if version == "" {
+			wildcard := "*"
+			req.IfNoneMatch = &wildcard
+		} else {
+			req.IfMatch = &version
+		}
+
+		_, err = s.client.PutObject(ctx, req)
+		if isPreconditionFailed(err) {
+			continue
+		}
+		if err != nil {
+			return tracing.Error(span, err)
+		}
+
+		return nil
+	}
+
+	return tracing.Errorf(span, "the artifacts of %s were modified by another process %d times, giving up", hash, maxManifestWriteAttempts)
+}
+
+// readObject returns an object's content and ETag, or empty strings if it doesn't exist.
+func (s *S3Backend) readObject(ctx context.Context, key string) (string, string, error) {
+	res, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &s.cfg.BucketName,
+		Key:    &key,
+	})
+	if isNoSuchKey(err) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	defer res.Body.Close()
+
+	content, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", "", err
+	}
+
+	return string(content), *res.ETag, nil
+}
+
+// putManifest writes the manifest if it is still at the given version, or if it doesn't exist
+// when the version is empty.
+func (s *S3Backend) putManifest(ctx context.Context, hash string, metadata map[string]string, version string) (string, error) {
+	ctx, span := tr.Start(ctx, "put_manifest")
+	defer span.End()
+
+	doc := manifestDocument{
+		Metadata: backends.SelectMetadata(metadata, nil),
+	}
+
+	if artifacts, found := doc.Metadata[backends.MetadataArtifacts]; found && json.Valid([]byte(artifacts)) {
+		doc.Artifacts = json.RawMessage(artifacts)
+		delete(doc.Metadata, backends.MetadataArtifacts)
+	}
+
+	content, err := json.Marshal(doc)
+	if err != nil {
+		return "", tracing.Error(span, err)
+	}
+
+	contentType := "application/json"
+	req := &s3.PutObjectInput{
+		Bucket:      &s.cfg.BucketName,
+		Key:         s.manifestPath(hash),
+		Body:        bytes.NewReader(content),
+		ContentType: &contentType,
+	}
+
+	if version == "" {
+		wildcard := "*"
+		req.IfNoneMatch = &wildcard
+	} else {
+		req.IfMatch = &version
+	}
+
+	res, err := s.client.PutObject(ctx, req)
+	if err != nil {
+		return "", tracing.Error(span, err)
+	}
+
+	return *res.ETag, nil
+}
+
+// MigrateManifest copies the hash's separate metadata keys into a manifest.  The keys are left
+// in place so that older versions of cas can still read them.  Hashes pushed before artifact
+// manifests also get one, listing the artifacts stored under `artifact/{hash}/`.
+func (s *S3Backend) MigrateManifest(ctx context.Context, hash string) (bool, error) {
+	ctx, span := tr.Start(ctx, "migrate_manifest")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("hash", hash))
+
+	metadata, err := s.migrateMetadata(ctx, hash)
+	if err != nil {
+		return false, tracing.Error(span, err)
+	}
+
+	artifacts, err := s.migrateArtifacts(ctx, hash)
+	if err != nil {
+		return false, tracing.Error(span, err)
+	}
+
+	span.SetAttributes(
+		attribute.Bool("metadata_migrated", metadata),
+		attribute.Bool("artifacts_migrated", artifacts),
+	)
+
+	return metadata || artifacts, nil
+}
+
+func (s *S3Backend) migrateMetadata(ctx context.Context, hash string) (bool, error) {
+	exists, err := s.hasObject(ctx, *s.manifestPath(hash))
+	if err != nil {
+		return false, err
+	}
+
+	if exists {
+		return false, nil
+	}
+
+	metadata, err := s.readMetadataKeys(ctx, hash, nil)
+	if err != nil {
+		return false, err
+	}
+
+	if len(metadata) == 0 {
+		return false, nil
+	}
+
+	if _, err := s.putManifest(ctx, hash, metadata, ""); err != nil {
+		if isPreconditionFailed(err) {
+			// another process has written the manifest since we checked
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	s.forgetManifest(hash)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("keys", len(metadata)))
+
+	return true, nil
+}
+
+// migrateArtifacts commits the artifacts of a hash pushed before artifact manifests, which are
+// the objects under `artifact/{hash}/` with the digest in their metadata.  In the blobs layout,
+// they are also copied to their blobs.
+func (s *S3Backend) migrateArtifacts(ctx context.Context, hash string) (bool, error) {
+	_, found, err := backends.ReadArtifactManifest(ctx, s, hash)
+	if err != nil {
+		return false, err
+	}
+
+	if found {
+		return false, nil
+	}
+
+	prefix := s.artifactPath(hash, "") + "/"
+	keys := []string{}
+
+	pages := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: &s.cfg.BucketName,
+		Prefix: &prefix,
+	})
+
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return false, err
+		}
+
+		for _, o := range page.Contents {
+			keys = append(keys, *o.Key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return false, nil
+	}
+
+	artifacts, err := backends.ForEach(ctx, s.cfg.Concurrency, keys, func(ctx context.Context, key string) (backends.Artifact, error) {
+		head, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: &s.cfg.BucketName,
+			Key:    &key,
+		})
+		if err != nil {
+			return backends.Artifact{}, err
+		}
+
+		artifact := backends.Artifact{Digest: head.Metadata["sha1"], Size: aws.ToInt64(head.ContentLength)}
+		if artifact.Digest == "" {
+			return artifact, fmt.Errorf("%s has no digest, so can't be migrated", key)
+		}
+
+		if s.cfg.ArtifactLayout == LayoutBlobs {
+			return artifact, s.copyToBlob(ctx, key, artifact.Digest)
+		}
+
+		return artifact, nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	stored := backends.ArtifactManifest{}
+	for i, key := range keys {
+		stored[strings.TrimPrefix(key, prefix)] = artifacts[i]
+	}
+
+	if err := s.commitArtifacts(ctx, hash, stored); err != nil {
+		return false, err
+	}
+
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("artifacts", len(stored)))
+
+	return true, nil
+}
+
+// copyToBlob copies an artifact's object to its blob, keeping its metadata, unless the blob
+// already exists.  Objects pushed before artifact manifests were stored with a single request,
+// so are small enough to be copied with one.
+func (s *S3Backend) copyToBlob(ctx context.Context, key string, digest string) error {
+	source := copySource(s.cfg.BucketName, key)
+	blob := s.blobPath(digest)
+	wildcard := "*"
+
+	_, err := s.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:            &s.cfg.BucketName,
+		Key:               &blob,
+		CopySource:        &source,
+		MetadataDirective: types.MetadataDirectiveCopy,
+		IfNoneMatch:       &wildcard,
+	})
+	if isPreconditionFailed(err) {
+		return nil
+	}
+
+	return err
+}
+
+func (s *S3Backend) rememberManifest(hash string, manifest *backends.Manifest) {
+	s.manifestsLock.Lock()
+	defer s.manifestsLock.Unlock()
+
+	s.manifests[hash] = manifest
+}
+
+func (s *S3Backend) forgetManifest(hash string) {
+	s.manifestsLock.Lock()
+	defer s.manifestsLock.Unlock()
+
+	delete(s.manifests, hash)
+}
+
+func (s *S3Backend) manifestPath(hash string) *string {
+	p := path.Join(s.cfg.PathPrefix, "manifest", hash)
+	return &p
+}
@@ -0,0 +1,540 @@
+package s3
+
+import (
+	"bytes"
+	"cas/backends"
+	"cas/tracing"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	DefaultMultipartThreshold = 64 * 1024 * 1024
+	DefaultPartSize           = 16 * 1024 * 1024
+	DefaultPartConcurrency    = 4
+
+	// S3's limits on multipart uploads
+	minPartSize = 5 * 1024 * 1024
+	maxParts    = 10000
+)
+
+// maxCopySize is the largest object CopyObject can copy, larger objects are copied in parts
+var maxCopySize int64 = 5 * 1024 * 1024 * 1024
+
+// partSize is the configured part size, grown if needed so that size fits in maxParts parts
+func (s *S3Backend) partSize(size int64) int64 {
+	partSize := max(s.cfg.PartSize, minPartSize)
+
+	for size > partSize*maxParts {
+		partSize *= 2
+	}
+
+	return partSize
+}
+
+// uploadState is written when a multipart upload starts, and removed when it completes
+type uploadState struct {
+	Key      string `json:"key"`
+	UploadId string `json:"upload_id"`
+	Digest   string `json:"digest"`
+	Size     int64  `json:"size"`
+	PartSize int64  `json:"part_size"`
+}
+
+// uploadStatePath is where the state of a multipart upload which hasn't completed is kept, so
+// that an interrupted push can resume it
+func (s *S3Backend) uploadStatePath(key string, sha string) string {
+	id := sha1.Sum([]byte(s.cfg.BucketName + "/" + key + "/" + sha))
+	return s.localStatePath("uploads", fmt.Sprintf("%x.json", id))
+}
+
+func readUploadState(statePath string) *uploadState {
+	content, err := os.ReadFile(statePath)
+	if err != nil {
+		return nil
+	}
+
+	state := &uploadState{}
+	if err := json.Unmarshal(content, state); err != nil {
+		return nil
+	}
+
+	return state
+}
+
+func writeUploadState(statePath string, state *uploadState) error {
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path.Dir(statePath), os.ModePerm); err != nil {
+		return err
+	}
+
+	return os.WriteFile(statePath, content, 0666)
+}
+
+// putMultipart uploads content in parts, several at once.  If a previous upload of the same
+// content to the same key was interrupted, only the parts it didn't upload are sent.  The upload
+// is only completed over the given version of the object, see writeConditions.
+func (s *S3Backend) putMultipart(ctx context.Context, key string, content io.ReadSeeker, size int64, sha string, headers objectHeaders, version string) error {
+	ctx, span := tr.Start(ctx, "put_multipart")
+	defer span.End()
+
+	partSize := s.partSize(size)
+	statePath := s.uploadStatePath(key, sha)
+
+	span.SetAttributes(
+		attribute.String("key", key),
+		attribute.Int64("size", size),
+		attribute.Int64("part_size", partSize),
+	)
+
+	uploadId, uploaded, err := s.resumeUpload(ctx, statePath, key, sha, size, partSize)
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	span.SetAttributes(
+		attribute.Bool("resumed", uploadId != ""),
+		attribute.Int("parts_resumed", len(uploaded)),
+	)
+
+	if uploadId == "" {
+		upload, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+			Bucket:          &s.cfg.BucketName,
+			Key:             &key,
+			Metadata:        headers.Metadata,
+			ContentEncoding: headers.ContentEncoding,
+			ContentType:     headers.ContentType,
+		})
+		if err != nil {
+			return tracing.Error(span, err)
+		}
+
+		uploadId = *upload.UploadId
+		uploaded = map[int32]types.CompletedPart{}
+
+		state := &uploadState{Key: key, UploadId: uploadId, Digest: sha, Size: size, PartSize: partSize}
+		if err := writeUploadState(statePath, state); err != nil {
+			return tracing.Error(span, s.abortUpload(ctx, key, &uploadId, err))
+		}
+	}
+
+	partCount := int32((size + partSize - 1) / partSize)
+	pending := []int32{}
+	for number := int32(1); number <= partCount; number++ {
+		if _, done := uploaded[number]; !done {
+			pending = append(pending, number)
+		}
+	}
+
+	sections := newSectionReader(content)
+
+	completed, err := backends.ForEach(ctx, s.cfg.PartConcurrency, pending, func(ctx context.Context, number int32) (types.CompletedPart, error) {
+		offset := int64(number-1) * partSize
+		body, err := sections.section(offset, min(partSize, size-offset))
+		if err != nil {
+			return types.CompletedPart{}, err
+		}
+
+		part, err := s.client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     &s.cfg.BucketName,
+			Key:        &key,
+			UploadId:   &uploadId,
+			PartNumber: &number,
+			Body:       body,
+		})
+		if err != nil {
+			return types.CompletedPart{}, err
+		}
+
+		return types.CompletedPart{ETag: part.ETag, PartNumber: &number}, nil
+	})
+	if err != nil {
+		// the upload is kept, so that pushing again only uploads the parts which failed
+		span.SetAttributes(attribute.Bool("resumable", true))
+		return tracing.Error(span, err)
+	}
+
+	for i, number := range pending {
+		uploaded[number] = completed[i]
+	}
+
+	parts := make([]types.CompletedPart, 0, partCount)
+	for number := int32(1); number <= partCount; number++ {
+		parts = append(parts, uploaded[number])
+	}
+
+	span.SetAttributes(attribute.Int("parts", len(parts)))
+
+	req := &s3.CompleteMultipartUploadInput{
+		Bucket:          &s.cfg.BucketName,
+		Key:             &key,
+		UploadId:        &uploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	}
+
+	req.IfMatch, req.IfNoneMatch = writeConditions(version)
+
+	_, err = s.client.CompleteMultipartUpload(ctx, req)
+
+	// the upload can't be resumed once it is complete, or the object was created by someone
+	// else
+	if err == nil || isPreconditionFailed(err) {
+		os.Remove(statePath)
+	}
+
+	if isPreconditionFailed(err) {
+		return s.abortUpload(ctx, key, &uploadId, err)
+	}
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	return nil
+}
+
+// resumeUpload returns the id and uploaded parts of a previous upload of the same content, or
+// an empty id if there isn't one which can be resumed
+func (s *S3Backend) resumeUpload(ctx context.Context, statePath string, key string, sha string, size int64, partSize int64) (string, map[int32]types.CompletedPart, error) {
+	state := readUploadState(statePath)
+	if state == nil {
+		return "", nil, nil
+	}
+
+	if state.Key != key || state.Digest != sha || state.Size != size || state.PartSize != partSize {
+		os.Remove(statePath)
+		return "", nil, nil
+	}
+
+	uploaded := map[int32]types.CompletedPart{}
+
+	pages := s3.NewListPartsPaginator(s.client, &s3.ListPartsInput{
+		Bucket:   &s.cfg.BucketName,
+		Key:      &key,
+		UploadId: &state.UploadId,
+	})
+
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			// the upload has been aborted or expired, so start again
+			if backends.Classify(err) == backends.ErrorNotFound {
+				os.Remove(statePath)
+				return "", nil, nil
+			}
+
+			return "", nil, err
+		}
+
+		for _, part := range page.Parts {
+			number := *part.PartNumber
+			offset := int64(number-1) * partSize
+
+			// a part which is the wrong size was interrupted, so is uploaded again
+			if part.Size == nil || *part.Size != min(partSize, size-offset) {
+				continue
+			}
+
+			uploaded[number] = types.CompletedPart{ETag: part.ETag, PartNumber: part.PartNumber}
+		}
+	}
+
+	trace.SpanFromContext(ctx).AddEvent("resume_upload", trace.WithAttributes(
+		attribute.String("upload_id", state.UploadId),
+		attribute.Int("parts", len(uploaded)),
+	))
+
+	return state.UploadId, uploaded, nil
+}
+
+// copyMultipart copies an object which is too large for CopyObject, a part at a time
+func (s *S3Backend) copyMultipart(ctx context.Context, source string, key string, size int64, sha string, metadata map[string]string, version string) error {
+	ctx, span := tr.Start(ctx, "copy_multipart")
+	defer span.End()
+
+	partSize := s.partSize(size)
+	partCount := int32((size + partSize - 1) / partSize)
+
+	span.SetAttributes(
+		attribute.Int64("size", size),
+		attribute.Int64("part_size", partSize),
+		attribute.Int("parts", int(partCount)),
+	)
+
+	upload, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:          &s.cfg.BucketName,
+		Key:             &key,
+		Metadata:        s.objectMetadata(sha, metadata),
+		ContentEncoding: s.contentEncoding(),
+	})
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	numbers := make([]int32, partCount)
+	for i := range numbers {
+		numbers[i] = int32(i + 1)
+	}
+
+	parts, err := backends.ForEach(ctx, s.cfg.PartConcurrency, numbers, func(ctx context.Context, number int32) (types.CompletedPart, error) {
+		offset := int64(number-1) * partSize
+
+		part, err := s.client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:          &s.cfg.BucketName,
+			Key:             &key,
+			UploadId:        upload.UploadId,
+			PartNumber:      &number,
+			CopySource:      &source,
+			CopySourceRange: byteRange(offset, min(partSize, size-offset)),
+		})
+		if err != nil {
+			return types.CompletedPart{}, err
+		}
+
+		return types.CompletedPart{ETag: part.CopyPartResult.ETag, PartNumber: &number}, nil
+	})
+	if err != nil {
+		return tracing.Error(span, s.abortUpload(ctx, key, upload.UploadId, err))
+	}
+
+	req := &s3.CompleteMultipartUploadInput{
+		Bucket:          &s.cfg.BucketName,
+		Key:             &key,
+		UploadId:        upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	}
+
+	req.IfMatch, req.IfNoneMatch = writeConditions(version)
+
+	if _, err := s.client.CompleteMultipartUpload(ctx, req); err != nil {
+		return tracing.Error(span, s.abortUpload(ctx, key, upload.UploadId, err))
+	}
+
+	return nil
+}
+
+// sectionReader reads sections of content for parts uploaded at once.  Content which can be
+// read at an offset is read directly, anything else is read into memory one part at a time.
+type sectionReader struct {
+	content io.ReadSeeker
+	lock    sync.Mutex
+}
+
+func newSectionReader(content io.ReadSeeker) *sectionReader {
+	return &sectionReader{content: content}
+}
+
+func (r *sectionReader) section(offset int64, length int64) (io.ReadSeeker, error) {
+	if at, ok := r.content.(io.ReaderAt); ok {
+		return io.NewSectionReader(at, offset, length), nil
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, err := r.content.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	buffer := make([]byte, length)
+	if _, err := io.ReadFull(r.content, buffer); err != nil {
+		return nil, errors.Join(fmt.Errorf("reading part at %d", offset), err)
+	}
+
+	return bytes.NewReader(buffer), nil
+}
+
+// getRanged downloads an object in parts, several at once, returning its content in order and
+// its metadata.  Only PartConcurrency parts are held in memory at once.
+func (s *S3Backend) getRanged(ctx context.Context, key string) (io.ReadCloser, map[string]string, error) {
+	ctx, span := tr.Start(ctx, "get_ranged")
+	defer span.End()
+
+	partSize := s.partSize(0)
+
+	// the first part also says how large the object is
+	first, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &s.cfg.BucketName,
+		Key:    &key,
+		Range:  byteRange(0, partSize),
+	})
+	if err != nil {
+		return nil, nil, tracing.Error(span, err)
+	}
+	defer first.Body.Close()
+
+	content, err := io.ReadAll(first.Body)
+	if err != nil {
+		return nil, nil, tracing.Error(span, err)
+	}
+
+	total := int64(len(content))
+	if first.ContentRange != nil {
+		if _, err := fmt.Sscanf(*first.ContentRange, "bytes %d-%d/%d", new(int64), new(int64), &total); err != nil {
+			return nil, nil, tracing.Errorf(span, "unexpected content range '%s'", *first.ContentRange)
+		}
+	}
+
+	// unlike uploads, downloads have no limit on the number of parts
+	count := int((total + partSize - 1) / partSize)
+
+	span.SetAttributes(
+		attribute.Int64("size", total),
+		attribute.Int("parts", count),
+	)
+
+	if total <= int64(len(content)) {
+		return io.NopCloser(bytes.NewReader(content)), first.Metadata, nil
+	}
+
+	return s.newRangedReader(ctx, key, first.ETag, content, total, partSize), first.Metadata, nil
+}
+
+// getRange reads part of an object.  Reading the body is retried too, as the SDK only retries
+// the request.
+func (s *S3Backend) getRange(ctx context.Context, key string, etag *string, offset int64, length int64) ([]byte, error) {
+	ctx, span := tr.Start(ctx, "get_range")
+	defer span.End()
+
+	span.SetAttributes(attribute.Int64("offset", offset))
+
+	for attempt := 1; ; attempt++ {
+		res, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: &s.cfg.BucketName,
+			Key:    &key,
+			Range:  byteRange(offset, length),
+			// every part must come from the same version of the object
+			IfMatch: etag,
+		})
+		if err != nil {
+			return nil, tracing.Error(span, err)
+		}
+
+		content, err := io.ReadAll(res.Body)
+		res.Body.Close()
+
+		if err == nil {
+			return content, nil
+		}
+
+		if attempt >= max(s.cfg.Retry.Attempts, 1) || ctx.Err() != nil {
+			return nil, tracing.Error(span, err)
+		}
+
+		span.AddEvent("read_failed", trace.WithAttributes(
+			attribute.Int("attempt", attempt),
+			attribute.String("error", err.Error()),
+		))
+	}
+}
+
+func byteRange(offset int64, length int64) *string {
+	r := fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	return &r
+}
+
+// rangedReader reads the parts of an object in order, while the following parts are downloaded
+type rangedReader struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	parts []chan rangedPart
+	// a slot is taken for each part being downloaded or waiting to be read
+	slots chan struct{}
+
+	index   int
+	current *bytes.Reader
+}
+
+type rangedPart struct {
+	content []byte
+	err     error
+}
+
+func (s *S3Backend) newRangedReader(ctx context.Context, key string, etag *string, first []byte, total int64, partSize int64) *rangedReader {
+	ctx, cancel := context.WithCancel(ctx)
+
+	count := int((total + partSize - 1) / partSize)
+
+	r := &rangedReader{
+		ctx:     ctx,
+		cancel:  cancel,
+		parts:   make([]chan rangedPart, count),
+		slots:   make(chan struct{}, s.cfg.PartConcurrency),
+		current: bytes.NewReader(first),
+	}
+
+	for i := range r.parts {
+		r.parts[i] = make(chan rangedPart, 1)
+	}
+
+	go func() {
+		for i := 1; i < count; i++ {
+			select {
+			case r.slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			offset := int64(i) * partSize
+			go func() {
+				content, err := s.getRange(ctx, key, etag, offset, min(partSize, total-offset))
+				r.parts[i] <- rangedPart{content: content, err: err}
+			}()
+		}
+	}()
+
+	return r
+}
+
+func (r *rangedReader) Read(p []byte) (int, error) {
+	for {
+		if r.current != nil {
+			if n, err := r.current.Read(p); n > 0 || err != io.EOF {
+				return n, err
+			}
+
+			// the part has been read, so another can be downloaded
+			if r.index > 0 {
+				<-r.slots
+			}
+
+			r.current = nil
+			r.index++
+		}
+
+		if r.index >= len(r.parts) {
+			return 0, io.EOF
+		}
+
+		select {
+		case part := <-r.parts[r.index]:
+			if part.err != nil {
+				return 0, part.err
+			}
+			r.current = bytes.NewReader(part.content)
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		}
+	}
+}
+
+func (r *rangedReader) Close() error {
+	r.cancel()
+	return nil
+}
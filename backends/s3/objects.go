@@ -0,0 +1,100 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go/middleware"
+)
+
+func (cfg *S3Config) validateObjectSettings() error {
+	if cfg.ServerSideEncryption != "" && !slices.Contains(types.ServerSideEncryption("").Values(), types.ServerSideEncryption(cfg.ServerSideEncryption)) {
+		return fmt.Errorf("unsupported server side encryption '%s', expected one of: %v", cfg.ServerSideEncryption, types.ServerSideEncryption("").Values())
+	}
+
+	if cfg.KMSKeyID != "" && cfg.ServerSideEncryption == string(types.ServerSideEncryptionAes256) {
+		return fmt.Errorf("a KMS key can't be used with %s server side encryption", cfg.ServerSideEncryption)
+	}
+
+	if cfg.StorageClass != "" && !slices.Contains(types.StorageClass("").Values(), types.StorageClass(cfg.StorageClass)) {
+		return fmt.Errorf("unsupported storage class '%s', expected one of: %v", cfg.StorageClass, types.StorageClass("").Values())
+	}
+
+	if cfg.ACL != "" && !slices.Contains(types.ObjectCannedACL("").Values(), types.ObjectCannedACL(cfg.ACL)) {
+		return fmt.Errorf("unsupported acl '%s', expected one of: %v", cfg.ACL, types.ObjectCannedACL("").Values())
+	}
+
+	tags, err := parseTags(cfg.Tags)
+	if err != nil {
+		return err
+	}
+
+	tagKeys := parseTagKeys(cfg.TagKeys)
+	for _, key := range tagKeys {
+		if len(key) > maxTagKeyLen || tagValue(key) != key {
+			return fmt.Errorf("metadata key '%s' can't be used as a tag", key)
+		}
+	}
+
+	// the debug tag is added to `@debug/*` keys
+	if len(tags)+len(tagKeys)+1 > maxTags {
+		return fmt.Errorf("objects can have at most %d tags, including %s", maxTags, TagDebug)
+	}
+
+	return nil
+}
+
+// objectSettings applies the configured encryption, storage class, acl and tags to every request
+// which creates an object, so that metadata, leases and staged streams get them as well as
+// artifacts.  Tags added to the request's context with withTags are set too.
+func objectSettings(cfg S3Config) func(*middleware.Stack) error {
+	sse := types.ServerSideEncryption(cfg.ServerSideEncryption)
+	storageClass := types.StorageClass(cfg.StorageClass)
+	acl := types.ObjectCannedACL(cfg.ACL)
+
+	// invalid tags are rejected by NewS3Backend
+	configured, _ := parseTags(cfg.Tags)
+
+	var kmsKeyID *string
+	if cfg.KMSKeyID != "" {
+		kmsKeyID = &cfg.KMSKeyID
+	}
+
+	step := middleware.InitializeMiddlewareFunc("ObjectSettings", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+		tags := map[string]string{}
+		maps.Copy(tags, configured)
+		maps.Copy(tags, tagsFromContext(ctx))
+
+		var tagging *string
+		if len(tags) > 0 {
+			encoded := encodeTags(tags)
+			tagging = &encoded
+		}
+
+		switch req := in.Parameters.(type) {
+		case *s3.PutObjectInput:
+			req.ServerSideEncryption, req.SSEKMSKeyId = sse, kmsKeyID
+			req.StorageClass, req.ACL, req.Tagging = storageClass, acl, tagging
+		case *s3.CreateMultipartUploadInput:
+			req.ServerSideEncryption, req.SSEKMSKeyId = sse, kmsKeyID
+			req.StorageClass, req.ACL, req.Tagging = storageClass, acl, tagging
+		case *s3.CopyObjectInput:
+			req.ServerSideEncryption, req.SSEKMSKeyId = sse, kmsKeyID
+			req.StorageClass, req.ACL, req.Tagging = storageClass, acl, tagging
+			// without this the copy keeps the tags of the staged object
+			if tagging != nil {
+				req.TaggingDirective = types.TaggingDirectiveReplace
+			}
+		}
+
+		return next.HandleInitialize(ctx, in)
+	})
+
+	return func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(step, middleware.Before)
+	}
+}
@@ -0,0 +1,116 @@
+package s3
+
+import (
+	"cas/backends"
+	"cas/tracing"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// MaxPresignExpiry is the longest a presigned url can be valid for.  A url signed with temporary
+// credentials, such as an assumed role's, stops working when they expire.
+const MaxPresignExpiry = 7 * 24 * time.Hour
+
+// PresignArtifact returns a url which downloads an artifact.  Artifacts stored compressed are
+// downloaded with a `Content-Encoding: gzip` header.
+func (s *S3Backend) PresignArtifact(ctx context.Context, hash string, name string, expires time.Duration) (string, error) {
+	ctx, span := tr.Start(ctx, "presign_artifact")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("artifact_name", name))
+
+	manifest, _, err := backends.ReadArtifactManifest(ctx, s, hash)
+	if err != nil {
+		return "", tracing.Error(span, err)
+	}
+
+	artifact, found := manifest[name]
+	if !found {
+		return "", tracing.Errorf(span, "artifact %s does not exist in hash %s", name, hash)
+	}
+
+	url, err := s.presign(ctx, s.artifactKey(hash, name, artifact), path.Base(name), expires)
+	if err != nil {
+		return "", tracing.Error(span, err)
+	}
+
+	return url, nil
+}
+
+// PresignArchive writes the archive to a temporary file and stores it at
+// `archive/{hash}.tar.gz`, replacing any previous archive of the hash, then returns a url which
+// downloads it.  Large archives are uploaded in parts, like artifacts.
+func (s *S3Backend) PresignArchive(ctx context.Context, hash string, write func(io.Writer) error, expires time.Duration) (string, error) {
+	ctx, span := tr.Start(ctx, "presign_archive")
+	defer span.End()
+
+	archive, err := os.CreateTemp("", "cas-archive-*.tar.gz")
+	if err != nil {
+		return "", tracing.Error(span, err)
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+
+	// the digest identifies the archive, so an interrupted upload of it can be resumed
+	digest := sha1.New()
+	if err := write(io.MultiWriter(archive, digest)); err != nil {
+		return "", tracing.Error(span, err)
+	}
+
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return "", tracing.Error(span, err)
+	}
+
+	key := s.archivePath(hash)
+	sha := fmt.Sprintf("%x", digest.Sum(nil))
+	contentType := "application/gzip"
+
+	// the archive is already compressed, so it is stored as it is
+	headers := objectHeaders{
+		Metadata:    map[string]string{"sha1": sha},
+		ContentType: &contentType,
+	}
+
+	if err := s.putObject(ctx, key, archive, sha, headers, anyVersion); err != nil {
+		return "", tracing.Error(span, err)
+	}
+
+	url, err := s.presign(ctx, key, hash+".tar.gz", expires)
+	if err != nil {
+		return "", tracing.Error(span, err)
+	}
+
+	return url, nil
+}
+
+func (s *S3Backend) presign(ctx context.Context, key string, filename string, expires time.Duration) (string, error) {
+	if expires <= 0 || expires > MaxPresignExpiry {
+		return "", fmt.Errorf("urls can expire after at most %s, not %s", MaxPresignExpiry, expires)
+	}
+
+	// browsers save the download with the artifact's name, rather than the object's key
+	disposition := fmt.Sprintf(`attachment; filename="%s"`, filename)
+
+	req, err := s3.NewPresignClient(s.client).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket:                     &s.cfg.BucketName,
+		Key:                        &key,
+		ResponseContentDisposition: &disposition,
+	}, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", err
+	}
+
+	return req.URL, nil
+}
+
+func (s *S3Backend) archivePath(hash string) string {
+	return path.Join(s.cfg.PathPrefix, "archive", hash+".tar.gz")
+}
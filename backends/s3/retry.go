@@ -0,0 +1,151 @@
+package s3
+
+import (
+	"cas/backends"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var authErrorCodes = map[string]bool{
+	"AccessDenied":          true,
+	"InvalidAccessKeyId":    true,
+	"SignatureDoesNotMatch": true,
+	"ExpiredToken":          true,
+	"InvalidToken":          true,
+}
+
+// classify sorts the SDK's errors into the classes shared by all backends
+func classify(err error) backends.ErrorClass {
+	var apiErr smithy.APIError
+	code := ""
+	if errors.As(err, &apiErr) {
+		code = apiErr.ErrorCode()
+	}
+
+	status := statusCode(err)
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return backends.ErrorPermanent
+	case errors.Is(err, context.DeadlineExceeded):
+		return backends.ErrorTransient
+	case status == http.StatusNotFound || isNoSuchKey(err) || code == "NotFound":
+		return backends.ErrorNotFound
+	case status == http.StatusUnauthorized || status == http.StatusForbidden || authErrorCodes[code]:
+		return backends.ErrorAuth
+	case status == http.StatusTooManyRequests || retry.IsErrorThrottles(retry.DefaultThrottles).IsErrorThrottle(err) == aws.TrueTernary:
+		return backends.ErrorThrottled
+	case retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err) == aws.TrueTernary:
+		return backends.ErrorTransient
+	}
+
+	return backends.ErrorPermanent
+}
+
+// retryer replaces the SDK's own retries with the backend's retry policy, so that retries are
+// the same for every backend and can be configured.
+type retryer struct {
+	policy backends.RetryPolicy
+}
+
+func (r *retryer) IsErrorRetryable(err error) bool {
+	return classify(err).Retryable()
+}
+
+func (r *retryer) MaxAttempts() int {
+	return max(r.policy.Attempts, 1)
+}
+
+func (r *retryer) RetryDelay(attempt int, err error) (time.Duration, error) {
+	return r.policy.Delay(attempt), nil
+}
+
+func (r *retryer) GetRetryToken(ctx context.Context, err error) (func(error) error, error) {
+	return releaseToken, nil
+}
+
+func (r *retryer) GetInitialToken() func(error) error {
+	return releaseToken
+}
+
+func (r *retryer) GetAttemptToken(ctx context.Context) (func(error) error, error) {
+	return releaseToken, nil
+}
+
+func releaseToken(error) error {
+	return nil
+}
+
+// classifyErrors records each failed attempt on the caller's span, and wraps the final error
+// with its class.  The operation's deadline covers all of its attempts, and reading the body of
+// a GetObject, so it is only cancelled when the body is closed.
+func classifyErrors(policy backends.RetryPolicy) func(*middleware.Stack) error {
+	step := middleware.InitializeMiddlewareFunc("ClassifyErrors", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+		cancel := func() {}
+		if policy.Timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, policy.Timeout)
+		}
+
+		out, metadata, err := next.HandleInitialize(ctx, in)
+
+		span := trace.SpanFromContext(ctx)
+		operation := middleware.GetOperationName(ctx)
+
+		if results, found := retry.GetAttemptResults(metadata); found {
+			for i, result := range results.Results {
+				if result.Err == nil {
+					continue
+				}
+
+				span.AddEvent("attempt_failed", trace.WithAttributes(
+					attribute.String("operation", operation),
+					attribute.Int("attempt", i+1),
+					attribute.String("error.class", string(classify(result.Err))),
+					attribute.String("error", result.Err.Error()),
+				))
+			}
+		}
+
+		if err != nil {
+			cancel()
+
+			class := classify(err)
+			span.SetAttributes(attribute.String("error.class", string(class)))
+
+			return out, metadata, &backends.ClassifiedError{Class: class, Err: err}
+		}
+
+		if res, ok := out.Result.(*s3.GetObjectOutput); ok {
+			res.Body = &cancellingBody{ReadCloser: res.Body, cancel: cancel}
+		} else {
+			cancel()
+		}
+
+		return out, metadata, nil
+	})
+
+	return func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(step, middleware.Before)
+	}
+}
+
+type cancellingBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancellingBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
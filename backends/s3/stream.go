@@ -0,0 +1,181 @@
+package s3
+
+import (
+	"bytes"
+	"cas/tracing"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// stageStream uploads content which can only be read once to a staging key, hashing it on the
+// way.  Once the digest is known, the staged object is copied to its real key.  Streams are
+// uploaded in parts of the configured size, so that only one part is held in memory.  It
+// returns the staging key, the content's digest and size, and the size of the staged object.
+func (s *S3Backend) stageStream(ctx context.Context, content io.Reader) (string, string, int64, int64, error) {
+	ctx, span := tr.Start(ctx, "stage_stream")
+	defer span.End()
+
+	key := path.Join(s.cfg.PathPrefix, "staging", uuid.NewString())
+	span.SetAttributes(attribute.String("staging_key", key))
+
+	hash := sha1.New()
+	raw := &countingWriter{}
+
+	// the digest and size are of the content before it's compressed
+	var reader io.Reader = io.TeeReader(content, io.MultiWriter(hash, raw))
+
+	if s.cfg.Compression == CompressionGzip {
+		compressed := compressReader(reader)
+		defer compressed.Close()
+
+		reader = compressed
+	}
+
+	buffer := make([]byte, s.partSize(0))
+	stored := int64(0)
+
+	n, err := io.ReadFull(reader, buffer)
+	if err != nil && !isShortRead(err) {
+		return "", "", 0, 0, tracing.Error(span, err)
+	}
+
+	// small streams don't need a multipart upload
+	if isShortRead(err) {
+		_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: &s.cfg.BucketName,
+			Key:    &key,
+			Body:   bytes.NewReader(buffer[:n]),
+		})
+		if err != nil {
+			return "", "", 0, 0, tracing.Error(span, err)
+		}
+
+		span.SetAttributes(attribute.Int("parts", 1))
+		return key, fmt.Sprintf("%x", hash.Sum(nil)), raw.size, int64(n), nil
+	}
+
+	upload, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: &s.cfg.BucketName,
+		Key:    &key,
+	})
+	if err != nil {
+		return "", "", 0, 0, tracing.Error(span, err)
+	}
+
+	parts := []types.CompletedPart{}
+
+	for partNumber := int32(1); n > 0; partNumber++ {
+		part, err := s.client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     &s.cfg.BucketName,
+			Key:        &key,
+			UploadId:   upload.UploadId,
+			PartNumber: &partNumber,
+			Body:       bytes.NewReader(buffer[:n]),
+		})
+		if err != nil {
+			return "", "", 0, 0, tracing.Error(span, s.abortUpload(ctx, key, upload.UploadId, err))
+		}
+
+		parts = append(parts, types.CompletedPart{ETag: part.ETag, PartNumber: &partNumber})
+		stored += int64(n)
+
+		n, err = io.ReadFull(reader, buffer)
+		if err != nil && !isShortRead(err) {
+			return "", "", 0, 0, tracing.Error(span, s.abortUpload(ctx, key, upload.UploadId, err))
+		}
+	}
+
+	span.SetAttributes(attribute.Int("parts", len(parts)))
+
+	_, err = s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          &s.cfg.BucketName,
+		Key:             &key,
+		UploadId:        upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return "", "", 0, 0, tracing.Error(span, s.abortUpload(ctx, key, upload.UploadId, err))
+	}
+
+	return key, fmt.Sprintf("%x", hash.Sum(nil)), raw.size, stored, nil
+}
+
+// abortUpload removes the parts of a failed upload, returning the error which caused the failure
+func (s *S3Backend) abortUpload(ctx context.Context, key string, uploadId *string, cause error) error {
+	_, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   &s.cfg.BucketName,
+		Key:      &key,
+		UploadId: uploadId,
+	})
+
+	return errors.Join(cause, err)
+}
+
+// copyStaged copies a staged object to its real key, only over the given version of the object,
+// see writeConditions.
+func (s *S3Backend) copyStaged(ctx context.Context, staged string, key string, size int64, sha string, metadata map[string]string, version string) error {
+	ctx, span := tr.Start(ctx, "copy_staged")
+	defer span.End()
+
+	source := copySource(s.cfg.BucketName, staged)
+
+	if size > maxCopySize {
+		return s.copyMultipart(ctx, source, key, size, sha, metadata, version)
+	}
+
+	req := &s3.CopyObjectInput{
+		Bucket:            &s.cfg.BucketName,
+		Key:               &key,
+		CopySource:        &source,
+		MetadataDirective: types.MetadataDirectiveReplace,
+		Metadata:          s.objectMetadata(sha, metadata),
+		ContentEncoding:   s.contentEncoding(),
+	}
+
+	req.IfMatch, req.IfNoneMatch = writeConditions(version)
+
+	if _, err := s.client.CopyObject(ctx, req); err != nil {
+		return tracing.Error(span, err)
+	}
+
+	return nil
+}
+
+func (s *S3Backend) deleteObject(ctx context.Context, key string) error {
+	ctx, span := tr.Start(ctx, "delete_object")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("key", key))
+
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: &s.cfg.BucketName,
+		Key:    &key,
+	})
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	return nil
+}
+
+type countingWriter struct {
+	size int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.size += int64(len(p))
+	return len(p), nil
+}
+
+func isShortRead(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,175 @@
+package s3
+
+import (
+	"cas/backends"
+	"context"
+	"fmt"
+	"maps"
+	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TagDebug is set to true on metadata objects holding `@debug/*` keys, so lifecycle rules can
+// expire them sooner than the rest of a hash
+const TagDebug = "debug"
+
+// S3 allows at most 10 tags on an object, with keys up to 128 and values up to 256 characters
+const (
+	maxTags        = 10
+	maxTagKeyLen   = 128
+	maxTagValueLen = 256
+)
+
+type tagsKey struct{}
+
+// withTags adds tags to every object written with the context, as well as the configured tags
+func withTags(ctx context.Context, tags map[string]string) context.Context {
+	if len(tags) == 0 {
+		return ctx
+	}
+
+	merged := maps.Clone(tagsFromContext(ctx))
+	if merged == nil {
+		merged = map[string]string{}
+	}
+	maps.Copy(merged, tags)
+
+	return context.WithValue(ctx, tagsKey{}, merged)
+}
+
+func tagsFromContext(ctx context.Context) map[string]string {
+	tags, _ := ctx.Value(tagsKey{}).(map[string]string)
+	return tags
+}
+
+// parseTags parses `key=value` pairs separated by commas
+func parseTags(value string) (map[string]string, error) {
+	tags := map[string]string{}
+
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		key, value, found := strings.Cut(pair, "=")
+		if !found || key == "" {
+			return nil, fmt.Errorf("invalid tag '%s', expected key=value", pair)
+		}
+
+		if len(key) > maxTagKeyLen || len(value) > maxTagValueLen || tagValue(key) != key || tagValue(value) != value {
+			return nil, fmt.Errorf("invalid tag '%s', tags can only contain letters, numbers, spaces and + - = . _ : / @", pair)
+		}
+
+		tags[key] = value
+	}
+
+	return tags, nil
+}
+
+// parseTagKeys parses metadata keys separated by commas
+func parseTagKeys(value string) []string {
+	keys := []string{}
+
+	for _, key := range strings.Split(value, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// tagValue replaces the characters S3 doesn't allow in tags, and truncates it to the longest
+// value allowed
+func tagValue(value string) string {
+	cleaned := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune(" +-=._:/@", r):
+			return r
+		}
+		return '_'
+	}, value)
+
+	if len(cleaned) > maxTagValueLen {
+		cleaned = cleaned[:maxTagValueLen]
+	}
+
+	return cleaned
+}
+
+// encodeTags formats tags for the `x-amz-tagging` header
+func encodeTags(tags map[string]string) string {
+	values := url.Values{}
+	for key, value := range tags {
+		values.Set(key, value)
+	}
+
+	return values.Encode()
+}
+
+// hashTags returns the tags for the hash's objects, from the values of the configured metadata
+// keys.  Values in written are used rather than read, as they are being stored.  Encrypted values
+// are left out, as their tags would be meaningless.
+func (s *S3Backend) hashTags(ctx context.Context, hash string, written map[string]string) (map[string]string, error) {
+	tags := map[string]string{}
+
+	if len(s.tagKeys) == 0 {
+		return tags, nil
+	}
+
+	s.tagValuesLock.Lock()
+	known := s.tagValues[hash]
+	if known == nil {
+		known = map[string]string{}
+		s.tagValues[hash] = known
+	}
+
+	missing := []string{}
+	for _, key := range s.tagKeys {
+		if value, found := written[key]; found {
+			known[key] = value
+		}
+
+		if _, found := known[key]; !found {
+			missing = append(missing, key)
+		}
+	}
+	s.tagValuesLock.Unlock()
+
+	if len(missing) > 0 {
+		values, err := s.ReadMetadata(ctx, hash, missing)
+		if err != nil {
+			return nil, err
+		}
+
+		s.tagValuesLock.Lock()
+		for _, key := range missing {
+			known[key] = values[key]
+		}
+		s.tagValuesLock.Unlock()
+	}
+
+	s.tagValuesLock.Lock()
+	defer s.tagValuesLock.Unlock()
+
+	for _, key := range s.tagKeys {
+		value := known[key]
+
+		if strings.HasPrefix(value, backends.EncryptedValuePrefix) {
+			trace.SpanFromContext(ctx).AddEvent("encrypted_tag_skipped", trace.WithAttributes(attribute.String("key", key)))
+			continue
+		}
+
+		if value != "" {
+			tags[key] = tagValue(value)
+		}
+	}
+
+	return tags, nil
+}
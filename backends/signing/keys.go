@@ -0,0 +1,128 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// KeySource says where to read keys from, either a file or the keys themselves
+type KeySource struct {
+	File  string
+	Value string
+}
+
+func (src KeySource) IsEmpty() bool {
+	return src.File == "" && src.Value == ""
+}
+
+func (src KeySource) read() (string, error) {
+	if src.File == "" {
+		return src.Value, nil
+	}
+
+	content, err := os.ReadFile(src.File)
+	if err != nil {
+		return "", err
+	}
+
+	return string(content), nil
+}
+
+type PrivateKey struct {
+	ID  string
+	Key ed25519.PrivateKey
+}
+
+// TrustList maps key ids to the public keys whose signatures are accepted
+type TrustList map[string]ed25519.PublicKey
+
+// LoadPrivateKey reads an `id=base64-seed` pair, where the seed is the 32 byte ed25519 private key
+func LoadPrivateKey(src KeySource) (*PrivateKey, error) {
+	text, err := src.read()
+	if err != nil {
+		return nil, err
+	}
+
+	pairs, err := parsePairs(text, ed25519.SeedSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pairs) != 1 {
+		return nil, fmt.Errorf("expected one signing key, but got %d", len(pairs))
+	}
+
+	return &PrivateKey{
+		ID:  pairs[0].id,
+		Key: ed25519.NewKeyFromSeed(pairs[0].key),
+	}, nil
+}
+
+// LoadTrustList reads `id=base64-public-key` pairs, separated by newlines or commas
+func LoadTrustList(src KeySource) (TrustList, error) {
+	text, err := src.read()
+	if err != nil {
+		return nil, err
+	}
+
+	pairs, err := parsePairs(text, ed25519.PublicKeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("no trusted keys were given")
+	}
+
+	trusted := TrustList{}
+	for _, pair := range pairs {
+		if _, exists := trusted[pair.id]; exists {
+			return nil, fmt.Errorf("trusted key '%s' is given more than once", pair.id)
+		}
+
+		trusted[pair.id] = ed25519.PublicKey(pair.key)
+	}
+
+	return trusted, nil
+}
+
+type keyPair struct {
+	id  string
+	key []byte
+}
+
+func parsePairs(text string, size int) ([]keyPair, error) {
+	entries := strings.FieldsFunc(text, func(r rune) bool {
+		return r == '\n' || r == ','
+	})
+
+	pairs := []keyPair{}
+
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		id, encoded, found := strings.Cut(entry, "=")
+		if !found || id == "" {
+			return nil, fmt.Errorf("signing keys should be in the format id=base64-key")
+		}
+
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("signing key '%s' is not valid base64: %w", id, err)
+		}
+
+		if len(key) != size {
+			return nil, fmt.Errorf("signing key '%s' should be %d bytes, but is %d", id, size, len(key))
+		}
+
+		pairs = append(pairs, keyPair{id: id, key: key})
+	}
+
+	return pairs, nil
+}
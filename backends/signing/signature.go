@@ -0,0 +1,185 @@
+package signing
+
+import (
+	"bytes"
+	"cas/backends"
+	"cas/provenance"
+	"cas/tracing"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// MetadataSignature holds the json Signature of a hash's artifacts and metadata
+const MetadataSignature = "@signature"
+
+var (
+	ErrNotSigned = errors.New("hash is not signed")
+	ErrUntrusted = errors.New("hash is not signed by a trusted key")
+)
+
+// IsRejected is true when the hash is readable, but its signature isn't accepted
+func IsRejected(err error) bool {
+	return errors.Is(err, ErrNotSigned) || errors.Is(err, ErrUntrusted)
+}
+
+type Signature struct {
+	// Key is the id of the key which made the signature
+	Key       string `json:"key"`
+	Signature []byte `json:"signature"`
+
+	// Metadata is the keys whose values were signed, as metadata can be written after signing
+	Metadata []string `json:"metadata"`
+}
+
+// signedContent is what is signed, so that a signature can't be moved to another hash, or
+// kept after the artifacts or metadata change.
+type signedContent struct {
+	Hash      string                    `json:"hash"`
+	Artifacts backends.ArtifactManifest `json:"artifacts"`
+	Metadata  map[string]string         `json:"metadata"`
+}
+
+const signaturePrefix = "cas signature v1\n"
+
+// isSigned decides which metadata is signed.  Keys starting with `@` are written by cas, and
+// either are signed through the artifacts, or change after pushing (timestamps, debug data),
+// except for the provenance which is written with the artifacts.
+func isSigned(key string) bool {
+	if key == provenance.MetadataProvenance {
+		return true
+	}
+
+	return !strings.HasPrefix(key, "@") && key != backends.MetadataConflicted
+}
+
+// Sign signs the hash's current artifacts and metadata, replacing any existing signature.
+func Sign(ctx context.Context, backend backends.Backend, hash string, key *PrivateKey) error {
+	ctx, span := otel.Tracer("signing").Start(ctx, "sign")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("key", key.ID))
+
+	manifest, _, err := backends.ReadArtifactManifest(ctx, backend, hash)
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	all, err := backend.ReadMetadata(ctx, hash, []string{})
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	metadata := map[string]string{}
+	keys := []string{}
+
+	for k, v := range all {
+		if isSigned(k) {
+			metadata[k] = v
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+
+	content, err := contentToSign(hash, manifest, metadata)
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	signature, err := json.Marshal(Signature{
+		Key:       key.ID,
+		Signature: ed25519.Sign(key.Key, content),
+		Metadata:  keys,
+	})
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	if err := backend.WriteMetadata(ctx, hash, MetadataSignature, bytes.NewReader(signature)); err != nil {
+		return tracing.Error(span, err)
+	}
+
+	return nil
+}
+
+// Verify checks the hash's signature was made by a trusted key, and still matches the hash's
+// artifacts and the metadata it signed.  ErrNotSigned is returned if there is no signature.
+func Verify(ctx context.Context, backend backends.Backend, hash string, trusted TrustList) error {
+	_, err := VerifyManifest(ctx, backend, hash, trusted)
+	return err
+}
+
+// VerifyManifest is Verify, returning the artifact manifest which the signature matched, so
+// that exactly those artifacts can be fetched.
+func VerifyManifest(ctx context.Context, backend backends.Backend, hash string, trusted TrustList) (backends.ArtifactManifest, error) {
+	ctx, span := otel.Tracer("signing").Start(ctx, "verify")
+	defer span.End()
+
+	meta, err := backend.ReadMetadata(ctx, hash, []string{MetadataSignature})
+	if err != nil {
+		return nil, tracing.Error(span, err)
+	}
+
+	encoded, found := meta[MetadataSignature]
+	if !found {
+		return nil, tracing.Error(span, ErrNotSigned)
+	}
+
+	signature := Signature{}
+	if err := json.Unmarshal([]byte(encoded), &signature); err != nil {
+		return nil, tracing.Error(span, fmt.Errorf("reading signature: %w", err))
+	}
+
+	span.SetAttributes(attribute.String("key", signature.Key))
+
+	publicKey, found := trusted[signature.Key]
+	if !found {
+		return nil, tracing.Error(span, fmt.Errorf("%w: it is signed by '%s'", ErrUntrusted, signature.Key))
+	}
+
+	manifest, _, err := backends.ReadArtifactManifest(ctx, backend, hash)
+	if err != nil {
+		return nil, tracing.Error(span, err)
+	}
+
+	metadata := map[string]string{}
+	if len(signature.Metadata) > 0 {
+		metadata, err = backend.ReadMetadata(ctx, hash, signature.Metadata)
+		if err != nil {
+			return nil, tracing.Error(span, err)
+		}
+	}
+
+	content, err := contentToSign(hash, manifest, metadata)
+	if err != nil {
+		return nil, tracing.Error(span, err)
+	}
+
+	if !ed25519.Verify(publicKey, content, signature.Signature) {
+		return nil, tracing.Error(span, fmt.Errorf("%w: the signature by '%s' doesn't match its artifacts and metadata", ErrUntrusted, signature.Key))
+	}
+
+	return manifest, nil
+}
+
+func contentToSign(hash string, manifest backends.ArtifactManifest, metadata map[string]string) ([]byte, error) {
+	// maps are marshalled with sorted keys, so the content is the same wherever it is built
+	content, err := json.Marshal(signedContent{
+		Hash:      hash,
+		Artifacts: manifest,
+		Metadata:  metadata,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(signaturePrefix), content...), nil
+}
@@ -0,0 +1,139 @@
+package signing
+
+import (
+	"bytes"
+	"cas/backends"
+	"cas/backends/s3"
+	"cas/localstorage"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func createKeys(t *testing.T, id string) (*PrivateKey, string) {
+	seed := bytes.Repeat([]byte(id[:1]), ed25519.SeedSize)
+
+	key, err := LoadPrivateKey(KeySource{Value: id + "=" + base64.StdEncoding.EncodeToString(seed)})
+	require.NoError(t, err)
+
+	public := key.Key.Public().(ed25519.PublicKey)
+
+	return key, id + "=" + base64.StdEncoding.EncodeToString(public)
+}
+
+func TestLoadKeys(t *testing.T) {
+	_, err := LoadPrivateKey(KeySource{Value: "one=" + base64.StdEncoding.EncodeToString([]byte("short"))})
+	assert.ErrorContains(t, err, "should be 32 bytes")
+
+	_, first := createKeys(t, "first")
+	_, second := createKeys(t, "second")
+
+	trusted, err := LoadTrustList(KeySource{Value: first + "," + second})
+	require.NoError(t, err)
+	assert.Len(t, trusted, 2)
+
+	_, err = LoadTrustList(KeySource{Value: first + "\n" + first})
+	assert.ErrorContains(t, err, "more than once")
+}
+
+func TestSignAndVerify(t *testing.T) {
+	cfg := s3.S3Config{
+		BucketName: "cas",
+		PathPrefix: "tests",
+	}
+	s3.EnsureBucket(context.Background(), cfg)
+
+	be, err := s3.NewS3Backend(t.Context(), cfg)
+	require.NoError(t, err)
+
+	hash := uuid.Must(uuid.NewUUID()).String()
+
+	_, err = be.StoreArtifacts(t.Context(), hash, []*localstorage.LocalFile{
+		{Path: "dist/app", Content: io.NopCloser(strings.NewReader("app " + hash))},
+	})
+	require.NoError(t, err)
+	require.NoError(t, be.WriteMetadata(t.Context(), hash, "branch", strings.NewReader("main")))
+
+	signer, public := createKeys(t, "main")
+	_, other := createKeys(t, "other")
+
+	trusted, err := LoadTrustList(KeySource{Value: public})
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, Verify(t.Context(), be, hash, trusted), ErrNotSigned)
+
+	require.NoError(t, Sign(t.Context(), be, hash, signer))
+	assert.NoError(t, Verify(t.Context(), be, hash, trusted))
+
+	untrusted, err := LoadTrustList(KeySource{Value: other})
+	require.NoError(t, err)
+	assert.ErrorIs(t, Verify(t.Context(), be, hash, untrusted), ErrUntrusted)
+
+	// metadata written after signing isn't signed, so doesn't break the signature
+	require.NoError(t, be.WriteMetadata(t.Context(), hash, "later", strings.NewReader("value")))
+	assert.NoError(t, Verify(t.Context(), be, hash, trusted))
+
+	// but changing signed metadata or artifacts does
+	require.NoError(t, be.WriteMetadata(t.Context(), hash, "branch", strings.NewReader("fork")))
+	assert.ErrorIs(t, Verify(t.Context(), be, hash, trusted), ErrUntrusted)
+
+	require.NoError(t, Sign(t.Context(), be, hash, signer))
+	require.NoError(t, backends.UpdateArtifactManifest(t.Context(), be, hash, backends.ArtifactManifest{
+		"dist/extra": {Digest: "0000", Size: 4},
+	}))
+	assert.ErrorIs(t, Verify(t.Context(), be, hash, trusted), ErrUntrusted)
+}
+
+func TestFetchVerifiedManifest(t *testing.T) {
+	cfg := s3.S3Config{
+		BucketName: "cas",
+		PathPrefix: "tests",
+	}
+	s3.EnsureBucket(context.Background(), cfg)
+
+	be, err := s3.NewS3Backend(t.Context(), cfg)
+	require.NoError(t, err)
+
+	hash := uuid.Must(uuid.NewUUID()).String()
+
+	_, err = be.StoreArtifacts(t.Context(), hash, []*localstorage.LocalFile{
+		{Path: "dist/app", Content: io.NopCloser(strings.NewReader("app " + hash))},
+	})
+	require.NoError(t, err)
+
+	signer, public := createKeys(t, "main")
+	trusted, err := LoadTrustList(KeySource{Value: public})
+	require.NoError(t, err)
+
+	require.NoError(t, Sign(t.Context(), be, hash, signer))
+
+	manifest, err := VerifyManifest(t.Context(), be, hash, trusted)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"dist/app"}, manifest.Paths())
+
+	// an artifact is pushed between verifying the manifest and fetching its artifacts
+	_, err = be.StoreArtifacts(t.Context(), hash, []*localstorage.LocalFile{
+		{Path: "dist/injected", Content: io.NopCloser(strings.NewReader("unsigned"))},
+	})
+	require.NoError(t, err)
+
+	verified := backends.WithArtifactManifest(t.Context(), hash, manifest)
+
+	_, err = be.FetchArtifact(verified, hash, "dist/injected")
+	assert.ErrorContains(t, err, "does not exist")
+
+	file, err := be.FetchArtifact(verified, hash, "dist/app")
+	require.NoError(t, err)
+	file.Close()
+
+	listed, _, err := backends.ReadArtifactManifest(verified, be, hash)
+	require.NoError(t, err)
+	assert.Equal(t, manifest, listed)
+}
@@ -48,3 +48,23 @@ func CreateHash(ctx context.Context, backend Backend, hash string, ts time.Time)
 
 	return nil
 }
+
+// SelectMetadata copies the given keys, or all keys if none are given.
+func SelectMetadata(metadata map[string]string, keys []string) map[string]string {
+	if len(keys) == 0 {
+		all := make(map[string]string, len(metadata))
+		for k, v := range metadata {
+			all[k] = v
+		}
+		return all
+	}
+
+	selected := make(map[string]string, len(keys))
+	for _, key := range keys {
+		if val, found := metadata[key]; found {
+			selected[key] = val
+		}
+	}
+
+	return selected
+}
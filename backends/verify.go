@@ -0,0 +1,71 @@
+package backends
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// DigestError is returned when an artifact's content doesn't match the digest it was stored with
+type DigestError struct {
+	Name     string
+	Expected string
+	Actual   string
+}
+
+func (e *DigestError) Error() string {
+	return fmt.Sprintf("%s is corrupt: expected digest %s, but got %s", e.Name, e.Expected, e.Actual)
+}
+
+// NewVerifyingReader hashes the content as it is read.  Once all of the content has been read,
+// a *DigestError is returned instead of io.EOF if it doesn't match the expected digest.
+func NewVerifyingReader(name string, content io.ReadCloser, expected string) io.ReadCloser {
+	return &verifyingReader{
+		name:     name,
+		content:  content,
+		expected: expected,
+		hash:     sha1.New(),
+	}
+}
+
+type verifyingReader struct {
+	name     string
+	content  io.ReadCloser
+	expected string
+	hash     hash.Hash
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.content.Read(p)
+	r.hash.Write(p[:n])
+
+	if err == io.EOF {
+		if actual := fmt.Sprintf("%x", r.hash.Sum(nil)); actual != r.expected {
+			return n, &DigestError{Name: r.name, Expected: r.expected, Actual: actual}
+		}
+	}
+
+	return n, err
+}
+
+func (r *verifyingReader) Close() error {
+	return r.content.Close()
+}
+
+// FileDigest returns the digest of a file's content, as stored in an artifact manifest
+func FileDigest(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha1.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
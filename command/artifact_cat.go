@@ -0,0 +1,95 @@
+package command
+
+import (
+	"cas/config"
+	"cas/localstorage"
+	"cas/tracing"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+func NewArtifactCatCommand(storage localstorage.Storage) *ArtifactCatCommand {
+	cmd := &ArtifactCatCommand{
+		storage:    storage,
+		backendCfg: NewBackendConfiguration(),
+		stdout:     os.Stdout,
+	}
+
+	cmd.cfg = append(cmd.cfg, cmd.commandFlags())
+	cmd.cfg = append(cmd.cfg, cmd.backendCfg.Flags()...)
+	cmd.cfg = append(cmd.cfg, globalFlags(&cmd.format))
+
+	return cmd
+}
+
+type ArtifactCatCommand struct {
+	cfg        []*config.ConfigGroup
+	backendCfg *BackendConfiguration
+
+	storage   localstorage.Storage
+	statePath string
+	format    string
+
+	stdout io.Writer
+}
+
+func (c *ArtifactCatCommand) Synopsis() string {
+	return "Writes an artifact to stdout"
+}
+
+func (c *ArtifactCatCommand) Usages() []string {
+	return []string{
+		`cas artifact cat "${hash}" dist.tar | tar -x`,
+	}
+}
+
+func (c *ArtifactCatCommand) commandFlags() *config.ConfigGroup {
+	cfg := config.NewConfigGroup("")
+
+	cfg.StringFlag(&c.statePath, "state-path", "", ".cas/state", "the directory to hold local state")
+
+	return cfg
+}
+
+func (c *ArtifactCatCommand) Configuration() []*config.ConfigGroup {
+	return c.cfg
+}
+
+func (c *ArtifactCatCommand) RunContext(ctx context.Context, args []string) error {
+	ctx, span := otel.Tracer("artifact_cat").Start(ctx, "run")
+	defer span.End()
+
+	if len(args) != 2 {
+		return fmt.Errorf("this command takes exactly 2 arguments: hash, and artifact name")
+	}
+
+	// we support receiving the hash directly, or the state file path
+	// i.e. makefile using  `cas artifact cat "$<" some-file`)
+	hash := strings.TrimPrefix(strings.TrimPrefix(args[0], c.statePath), "/")
+	name := args[1]
+
+	span.SetAttributes(attribute.String("artifact_name", name))
+
+	backend, err := c.backendCfg.Create(ctx)
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	file, err := backend.FetchArtifact(ctx, hash, name)
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(c.stdout, file.Content); err != nil {
+		return tracing.Error(span, err)
+	}
+
+	return nil
+}
@@ -19,7 +19,7 @@ func NewArtifactListCommand(storage localstorage.Storage) *ArtifactListCommand {
 
 	cmd.cfg = append(cmd.cfg, cmd.commandFlags())
 	cmd.cfg = append(cmd.cfg, cmd.backendCfg.Flags()...)
-	cmd.cfg = append(cmd.cfg, globalFlags())
+	cmd.cfg = append(cmd.cfg, globalFlags(&cmd.format))
 
 	return cmd
 }
@@ -30,6 +30,7 @@ type ArtifactListCommand struct {
 
 	storage   localstorage.Storage
 	statePath string
+	format    string
 }
 
 func (c *ArtifactListCommand) Synopsis() string {
@@ -39,6 +40,7 @@ func (c *ArtifactListCommand) Synopsis() string {
 func (c *ArtifactListCommand) Usages() []string {
 	return []string{
 		`cas artifact list "${hash}"`,
+		`cas artifact list "${hash}" --format json`,
 	}
 }
 
@@ -62,6 +64,10 @@ func (c *ArtifactListCommand) RunContext(ctx context.Context, args []string) err
 		return fmt.Errorf("this command takes exactly 1 argument: hash")
 	}
 
+	if err := validateFormat(c.format); err != nil {
+		return tracing.Error(span, err)
+	}
+
 	// we support receiving the hash directly, or the state file path
 	// i.e. makefile using  `cas artifact "$<" some-file`)
 	hash := strings.TrimPrefix(strings.TrimPrefix(args[0], c.statePath), "/")
@@ -76,6 +82,10 @@ func (c *ArtifactListCommand) RunContext(ctx context.Context, args []string) err
 		return tracing.Error(span, err)
 	}
 
+	if c.format == FormatJson {
+		return printJson(artifacts)
+	}
+
 	for _, artifact := range artifacts {
 		fmt.Println(artifact)
 	}
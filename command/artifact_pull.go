@@ -1,35 +1,42 @@
 package command
 
 import (
+	"cas/backends"
+	"cas/backends/signing"
 	"cas/config"
 	"cas/localstorage"
+	"cas/progress"
 	"cas/tracing"
 	"context"
 	"fmt"
 	"strings"
 
+	"github.com/hashicorp/cli"
 	"go.opentelemetry.io/otel"
 )
 
-func NewArtifactPullCommand(storage localstorage.Storage) *ArtifactPullCommand {
+func NewArtifactPullCommand(ui cli.Ui, storage localstorage.Storage) *ArtifactPullCommand {
 	cmd := &ArtifactPullCommand{
+		ui:         ui,
 		storage:    storage,
 		backendCfg: NewBackendConfiguration(),
 	}
 
 	cmd.cfg = append(cmd.cfg, cmd.commandFlags())
 	cmd.cfg = append(cmd.cfg, cmd.backendCfg.Flags()...)
-	cmd.cfg = append(cmd.cfg, globalFlags())
+	cmd.cfg = append(cmd.cfg, globalFlags(&cmd.format))
 
 	return cmd
 }
 
 type ArtifactPullCommand struct {
+	ui         cli.Ui
 	cfg        []*config.ConfigGroup
 	backendCfg *BackendConfiguration
 
 	storage   localstorage.Storage
 	statePath string
+	format    string
 }
 
 func (c *ArtifactPullCommand) Synopsis() string {
@@ -73,6 +80,26 @@ func (c *ArtifactPullCommand) RunContext(ctx context.Context, args []string) err
 		return tracing.Error(span, err)
 	}
 
+	trusted, err := c.backendCfg.TrustList()
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	if trusted != nil {
+		manifest, err := signing.VerifyManifest(ctx, backend, hash, trusted)
+		if err != nil {
+			return tracing.Error(span, err)
+		}
+
+		// only the verified artifacts are pulled, even if the manifest is written since
+		ctx = backends.WithArtifactManifest(ctx, hash, manifest)
+	}
+
+	tracker := progress.NewTracker(c.ui, progress.Pull, progress.IsTerminal())
+	defer tracker.Finish()
+
+	ctx = progress.WithTracker(ctx, tracker)
+
 	if len(paths) > 0 {
 		for _, name := range paths {
 			file, err := backend.FetchArtifact(ctx, hash, name)
@@ -81,7 +108,7 @@ func (c *ArtifactPullCommand) RunContext(ctx context.Context, args []string) err
 			}
 			defer file.Close()
 
-			if err := c.storage.WriteFile(ctx, file.Name, file.Timestamp, file.Content); err != nil {
+			if err := c.storage.WriteEntry(ctx, file.Name, file.Timestamp, file.Mode, file.Content); err != nil {
 				return tracing.Error(span, err)
 			}
 		}
@@ -93,7 +120,7 @@ func (c *ArtifactPullCommand) RunContext(ctx context.Context, args []string) err
 		for _, file := range files {
 			defer file.Close()
 
-			if err := c.storage.WriteFile(ctx, file.Name, file.Timestamp, file.Content); err != nil {
+			if err := c.storage.WriteEntry(ctx, file.Name, file.Timestamp, file.Mode, file.Content); err != nil {
 				return tracing.Error(span, err)
 			}
 		}
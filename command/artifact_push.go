@@ -1,41 +1,58 @@
 package command
 
 import (
+	"cas/backends"
+	"cas/backends/failopen"
+	"cas/backends/signing"
 	"cas/config"
 	"cas/debug"
 	"cas/localstorage"
+	"cas/progress"
+	"cas/provenance"
 	"cas/tracing"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"strings"
 
+	"github.com/hashicorp/cli"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func NewArtifactPushCommand(storage localstorage.Storage) *ArtifactPushCommand {
+func NewArtifactPushCommand(ui cli.Ui, storage localstorage.Storage) *ArtifactPushCommand {
 	cmd := &ArtifactPushCommand{
+		ui:         ui,
 		debugger:   debug.NewDebugger(),
 		storage:    storage,
 		backendCfg: NewBackendConfiguration(),
+		stdin:      os.Stdin,
 	}
 
 	cmd.cfg = append(cmd.cfg, cmd.commandFlags())
 	cmd.cfg = append(cmd.cfg, cmd.backendCfg.Flags()...)
 	cmd.cfg = append(cmd.cfg, cmd.debugger.Flags())
-	cmd.cfg = append(cmd.cfg, globalFlags())
+	cmd.cfg = append(cmd.cfg, globalFlags(&cmd.format))
 
 	return cmd
 }
 
 type ArtifactPushCommand struct {
+	ui         cli.Ui
 	cfg        []*config.ConfigGroup
 	debugger   *debug.Debugger
 	backendCfg *BackendConfiguration
 
-	storage   localstorage.Storage
-	statePath string
+	storage    localstorage.Storage
+	statePath  string
+	format     string
+	name       string
+	provenance bool
+
+	stdin io.ReadCloser
 }
 
 func (c *ArtifactPushCommand) Synopsis() string {
@@ -46,6 +63,7 @@ func (c *ArtifactPushCommand) Usages() []string {
 	return []string{
 		`cas artifact push "${hash}" ./path/to/artifact`,
 		`cas artifact push "$<" "$@"`,
+		`tar -c dist | cas artifact push "${hash}" --name dist.tar -`,
 	}
 }
 
@@ -53,6 +71,8 @@ func (c *ArtifactPushCommand) commandFlags() *config.ConfigGroup {
 	cfg := config.NewConfigGroup("")
 
 	cfg.StringFlag(&c.statePath, "state-path", "", ".cas/state", "the directory to hold local state")
+	cfg.StringFlag(&c.name, "name", "", "", "the artifact name to store stdin as, when the path is -")
+	cfg.BoolFlag(&c.provenance, "provenance", "CAS_PROVENANCE", false, "record SLSA provenance of the hash's artifacts in @provenance")
 
 	return cfg
 }
@@ -74,21 +94,75 @@ func (c *ArtifactPushCommand) RunContext(ctx context.Context, args []string) err
 	hash := strings.TrimPrefix(strings.TrimPrefix(args[0], c.statePath), "/")
 	paths := args[1:]
 
+	if c.backendCfg.readOnly {
+		span.SetAttributes(attribute.Bool("read_only", true))
+		fmt.Fprintf(os.Stderr, "Warning: the backend is read only, so artifacts for %s were not pushed\n", hash)
+
+		return nil
+	}
+
+	// interrupted multipart uploads are resumed, and leases released, from the local state
+	c.backendCfg.s3.StatePath = c.statePath
+
 	backend, err := c.backendCfg.Create(ctx)
 	if err != nil {
 		return tracing.Error(span, err)
 	}
 
-	localFiles, err := localstorage.ReadMany(ctx, c.storage, paths)
+	signingKey, err := c.backendCfg.SigningKey()
 	if err != nil {
 		return tracing.Error(span, err)
 	}
 
-	written, err := backend.StoreArtifacts(ctx, hash, localFiles)
+	localFiles, err := c.readFiles(ctx, paths)
 	if err != nil {
 		return tracing.Error(span, err)
 	}
 
+	tracker := progress.NewTracker(c.ui, progress.Push, progress.IsTerminal())
+	defer tracker.Finish()
+
+	trackFiles(tracker, localFiles)
+
+	written, err := backend.StoreArtifacts(ctx, hash, localFiles)
+
+	var conflicts *backends.ConflictError
+	if errors.As(err, &conflicts) && conflicts.Policy == backends.ConflictWarn {
+		for _, conflict := range conflicts.Conflicts {
+			fmt.Fprintf(os.Stderr, "Warning: %s was replaced with different content (%s, was %s)\n", conflict.Path, conflict.Incoming, conflict.Existing)
+		}
+	} else if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	// the outage has already been reported, and the build shouldn't fail because of it
+	if failopen.Outage(backend) != nil {
+		span.SetAttributes(attribute.Bool("backend.unavailable", true))
+		fmt.Fprintf(os.Stderr, "Warning: the backend is unavailable, so artifacts for %s were not pushed\n", hash)
+
+		return nil
+	}
+
+	if c.provenance {
+		if _, err := provenance.Record(ctx, backend, hash); err != nil {
+			return tracing.Error(span, err)
+		}
+	}
+
+	// the signature covers every artifact in the hash, not just those in this push
+	if signingKey != nil {
+		if err := signing.Sign(ctx, backend, hash, signingKey); err != nil {
+			return tracing.Error(span, err)
+		}
+	}
+
+	// the artifacts are committed, so processes waiting on the lease can fetch them
+	if c.backendCfg.lease {
+		if err := backends.ReleaseLease(ctx, backend, hash); err != nil {
+			return tracing.Error(span, err)
+		}
+	}
+
 	debugFiles, err := c.debugger.All(ctx, hash)
 
 	for name, reader := range debugFiles {
@@ -108,3 +182,62 @@ func (c *ArtifactPushCommand) RunContext(ctx context.Context, args []string) err
 
 	return nil
 }
+
+// trackFiles reports the progress of reading each file's content.  Seekable files are measured,
+// so the total size is known unless stdin is being pushed.
+func trackFiles(tracker *progress.Tracker, files []*localstorage.LocalFile) {
+	total := int64(0)
+
+	for _, file := range files {
+		size := int64(-1)
+
+		if seeker, ok := file.Content.(io.ReadSeeker); ok {
+			if end, err := seeker.Seek(0, io.SeekEnd); err == nil {
+				size = end
+				total += end
+			}
+			seeker.Seek(0, io.SeekStart)
+		}
+
+		file.Content = tracker.Reader(file.Path, size, file.Content)
+	}
+
+	tracker.Expect(len(files), total)
+}
+
+// readFiles reads the paths from local storage, except for `-` which streams stdin as the
+// artifact given by --name.
+func (c *ArtifactPushCommand) readFiles(ctx context.Context, paths []string) ([]*localstorage.LocalFile, error) {
+	local := make([]string, 0, len(paths))
+	streams := 0
+
+	for _, p := range paths {
+		if p == "-" {
+			streams++
+		} else {
+			local = append(local, p)
+		}
+	}
+
+	if streams == 0 {
+		return localstorage.ReadMany(ctx, c.storage, local)
+	}
+
+	if streams > 1 {
+		return nil, fmt.Errorf("stdin can only be pushed once")
+	}
+
+	if c.name == "" {
+		return nil, fmt.Errorf("--name is required to push stdin")
+	}
+
+	files, err := localstorage.ReadMany(ctx, c.storage, local)
+	if err != nil {
+		return nil, err
+	}
+
+	// stdin isn't seekable, so the backend streams it rather than reading it twice
+	stdin := struct{ io.ReadCloser }{c.stdin}
+
+	return append(files, &localstorage.LocalFile{Path: c.name, Content: stdin}), nil
+}
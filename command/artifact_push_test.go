@@ -1,15 +1,28 @@
 package command
 
 import (
+	"bytes"
+	"cas/backends/readonly"
 	"cas/backends/s3"
+	"cas/backends/signing"
 	"cas/localstorage"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/hashicorp/cli"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func configureTestEnvironment() *BackendConfiguration {
@@ -33,7 +46,7 @@ func TestArtifactHashBased(t *testing.T) {
 	hash := uuid.New().String()
 
 	source := localstorage.NewMemoryStorage()
-	artifact := NewArtifactPushCommand(localstorage.NewArchiveDecorator(source))
+	artifact := NewArtifactPushCommand(cli.NewMockUi(), localstorage.NewArchiveDecorator(source))
 	artifact.backendCfg = cfg
 
 	source.WriteFile(context.Background(), "dist/bin/test", now, strings.NewReader("this is a test"))
@@ -46,7 +59,7 @@ func TestArtifactHashBased(t *testing.T) {
 	//
 
 	dest := localstorage.NewMemoryStorage()
-	fetch := NewFetchCommand(localstorage.NewArchiveDecorator(dest))
+	fetch := NewFetchCommand(cli.NewMockUi(), localstorage.NewArchiveDecorator(dest))
 	fetch.backendCfg = cfg
 	fetch.testHash = hash
 
@@ -59,3 +72,253 @@ func TestArtifactHashBased(t *testing.T) {
 		now.Add(-time.Second),
 		now.Add(+time.Second))
 }
+
+func TestArtifactPushStdinAndCat(t *testing.T) {
+	cfg := configureTestEnvironment()
+	hash := uuid.New().String()
+
+	push := NewArtifactPushCommand(cli.NewMockUi(), localstorage.NewMemoryStorage())
+	push.backendCfg = cfg
+	push.stdin = io.NopCloser(strings.NewReader("streamed content"))
+
+	err := push.RunContext(context.Background(), []string{hash, "-"})
+	assert.ErrorContains(t, err, "--name")
+
+	push.name = "dist/streamed.tar"
+	require.NoError(t, push.RunContext(context.Background(), []string{hash, "-"}))
+
+	stdout := &bytes.Buffer{}
+	cat := NewArtifactCatCommand(localstorage.NewMemoryStorage())
+	cat.backendCfg = cfg
+	cat.stdout = stdout
+
+	require.NoError(t, cat.RunContext(context.Background(), []string{hash, "dist/streamed.tar"}))
+	assert.Equal(t, "streamed content", stdout.String())
+
+	err = cat.RunContext(context.Background(), []string{hash, "dist/missing.tar"})
+	assert.ErrorContains(t, err, "does not exist")
+}
+
+func TestSignedHashes(t *testing.T) {
+	cfg := configureTestEnvironment()
+	cfg.trustedKeys.Value = "main=" + base64.StdEncoding.EncodeToString(ed25519.NewKeyFromSeed(bytes.Repeat([]byte("m"), ed25519.SeedSize)).Public().(ed25519.PublicKey))
+
+	push := func(signed bool) string {
+		hash := uuid.New().String()
+
+		source := localstorage.NewMemoryStorage()
+		source.WriteFile(context.Background(), "dist/app", time.Now(), strings.NewReader("app "+hash))
+
+		pushCfg := *cfg
+		if signed {
+			pushCfg.signingKey.Value = "main=" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("m"), ed25519.SeedSize))
+		}
+
+		artifact := NewArtifactPushCommand(cli.NewMockUi(), source)
+		artifact.backendCfg = &pushCfg
+		require.NoError(t, artifact.RunContext(context.Background(), []string{hash, "dist/app"}))
+
+		return hash
+	}
+
+	for _, signed := range []bool{true, false} {
+		hash := push(signed)
+
+		dest := localstorage.NewMemoryStorage()
+		fetch := NewFetchCommand(cli.NewMockUi(), dest)
+		fetch.backendCfg = cfg
+		fetch.testHash = hash
+		require.NoError(t, fetch.RunContext(context.Background(), []string{}))
+
+		pull := NewArtifactPullCommand(cli.NewMockUi(), dest)
+		pull.backendCfg = cfg
+		err := pull.RunContext(context.Background(), []string{hash})
+
+		if signed {
+			assert.NoError(t, err)
+			assert.Equal(t, "app "+hash, string(dest.Store["dist/app"]))
+		} else {
+			// fetch treats unsigned hashes as a miss, and pull refuses them
+			assert.ErrorIs(t, err, signing.ErrNotSigned)
+			assert.NotContains(t, dest.Store, "dist/app")
+		}
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	cfg := configureTestEnvironment()
+	cfg.readOnly = true
+
+	hash := uuid.New().String()
+
+	fetch := NewFetchCommand(cli.NewMockUi(), localstorage.NewMemoryStorage())
+	fetch.backendCfg = cfg
+	fetch.testHash = hash
+	require.NoError(t, fetch.RunContext(context.Background(), []string{}))
+
+	source := localstorage.NewMemoryStorage()
+	source.WriteFile(context.Background(), "dist/app", time.Now(), strings.NewReader("app"))
+
+	push := NewArtifactPushCommand(cli.NewMockUi(), source)
+	push.backendCfg = cfg
+	require.NoError(t, push.RunContext(context.Background(), []string{hash, "dist/app"}))
+
+	write := NewMetaWriteCommand(localstorage.NewMemoryStorage())
+	write.backendCfg = cfg
+	assert.ErrorIs(t, write.RunContext(context.Background(), []string{hash, "key=value"}), readonly.ErrReadOnly)
+
+	// nothing was written, not even the hash's timestamp
+	writable := configureTestEnvironment()
+	backend, err := writable.Create(context.Background())
+	require.NoError(t, err)
+
+	meta, err := backend.ReadMetadata(context.Background(), hash, []string{})
+	require.NoError(t, err)
+	assert.Empty(t, meta)
+}
+
+func TestFailOpen(t *testing.T) {
+	requests := atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	cfg := configureTestEnvironment()
+	cfg.failOpen = true
+	cfg.lease = true
+	cfg.retry.Attempts = 2
+	cfg.retry.BaseDelay = time.Millisecond
+	cfg.s3.Endpoint = server.URL
+
+	hash := uuid.New().String()
+
+	fetch := NewFetchCommand(cli.NewMockUi(), localstorage.NewMemoryStorage())
+	fetch.backendCfg = cfg
+	fetch.testHash = hash
+	require.NoError(t, fetch.RunContext(context.Background(), []string{}))
+
+	// the first operation's attempts open the circuit, and nothing else is sent
+	assert.Equal(t, int32(2), requests.Load())
+
+	source := localstorage.NewMemoryStorage()
+	source.WriteFile(context.Background(), "dist/app", time.Now(), strings.NewReader("app"))
+
+	push := NewArtifactPushCommand(cli.NewMockUi(), source)
+	push.backendCfg = cfg
+	require.NoError(t, push.RunContext(context.Background(), []string{hash, "dist/app"}))
+
+	// without fail open, the outage fails the command
+	cfg.failOpen = false
+
+	fetch = NewFetchCommand(cli.NewMockUi(), localstorage.NewMemoryStorage())
+	fetch.backendCfg = cfg
+	fetch.testHash = hash
+	assert.Error(t, fetch.RunContext(context.Background(), []string{}))
+}
+
+func TestFailOpenUnreachable(t *testing.T) {
+	// a closed server's address refuses connections
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	cfg := configureTestEnvironment()
+	cfg.failOpen = true
+	cfg.retry.Attempts = 1
+	cfg.connectTimeout = time.Second
+	cfg.s3.Endpoint = server.URL
+
+	hash := uuid.New().String()
+
+	fetch := NewFetchCommand(cli.NewMockUi(), localstorage.NewMemoryStorage())
+	fetch.backendCfg = cfg
+	fetch.testHash = hash
+	require.NoError(t, fetch.RunContext(context.Background(), []string{}))
+
+	source := localstorage.NewMemoryStorage()
+	source.WriteFile(context.Background(), "dist/app", time.Now(), strings.NewReader("app"))
+
+	push := NewArtifactPushCommand(cli.NewMockUi(), source)
+	push.backendCfg = cfg
+	require.NoError(t, push.RunContext(context.Background(), []string{hash, "dist/app"}))
+}
+
+func TestFailOpenRejectedCredentials(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	cfg := configureTestEnvironment()
+	cfg.failOpen = true
+	cfg.retry.Attempts = 1
+	cfg.s3.Endpoint = server.URL
+
+	// credentials which need fixing still fail the command, rather than every build running uncached
+	fetch := NewFetchCommand(cli.NewMockUi(), localstorage.NewMemoryStorage())
+	fetch.backendCfg = cfg
+	fetch.testHash = uuid.New().String()
+	assert.Error(t, fetch.RunContext(context.Background(), []string{}))
+}
+
+// readAtOnly content can only be read from the start or at an offset, so a multipart upload
+// fails if a part is read by seeking to it
+type readAtOnly struct {
+	*bytes.Reader
+}
+
+func (r readAtOnly) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 {
+		return 0, fmt.Errorf("seeking to %d, rather than reading at it", offset)
+	}
+
+	return r.Reader.Seek(offset, whence)
+}
+
+func (r readAtOnly) Close() error {
+	return nil
+}
+
+type readAtStorage struct {
+	*localstorage.MemoryStorage
+}
+
+func (s readAtStorage) ReadFile(ctx context.Context, p string) (*localstorage.LocalFile, error) {
+	file, err := s.MemoryStorage.ReadFile(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := io.ReadAll(file.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	file.Content = readAtOnly{bytes.NewReader(content)}
+
+	return file, nil
+}
+
+func TestArtifactPushMultipart(t *testing.T) {
+	cfg := configureTestEnvironment()
+	cfg.s3.MultipartThreshold = 5*1024*1024 + 1
+	cfg.s3.PartSize = 5 * 1024 * 1024
+
+	hash := uuid.New().String()
+
+	content := make([]byte, 2*cfg.s3.PartSize+1024)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+
+	source := readAtStorage{localstorage.NewMemoryStorage()}
+	source.WriteFile(context.Background(), "dist/large.bin", time.Now(), bytes.NewReader(content))
+
+	// the progress of each file is tracked, and its parts are still read at their offsets
+	push := NewArtifactPushCommand(cli.NewMockUi(), source)
+	push.backendCfg = cfg
+	push.statePath = t.TempDir()
+	require.NoError(t, push.RunContext(context.Background(), []string{hash, "dist/large.bin"}))
+
+	assert.Equal(t, string(content), catArtifact(t, cfg, hash, "dist/large.bin"))
+}
@@ -0,0 +1,179 @@
+package command
+
+import (
+	"archive/tar"
+	"cas/backends"
+	"cas/config"
+	"cas/localstorage"
+	"cas/tracing"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+func NewArtifactUrlCommand(storage localstorage.Storage) *ArtifactUrlCommand {
+	cmd := &ArtifactUrlCommand{
+		storage:    storage,
+		backendCfg: NewBackendConfiguration(),
+		stdout:     os.Stdout,
+	}
+
+	cmd.cfg = append(cmd.cfg, cmd.commandFlags())
+	cmd.cfg = append(cmd.cfg, cmd.backendCfg.Flags()...)
+	cmd.cfg = append(cmd.cfg, globalFlags(&cmd.format))
+
+	return cmd
+}
+
+type ArtifactUrlCommand struct {
+	cfg        []*config.ConfigGroup
+	backendCfg *BackendConfiguration
+
+	storage   localstorage.Storage
+	statePath string
+	expires   time.Duration
+	format    string
+
+	stdout io.Writer
+}
+
+func (c *ArtifactUrlCommand) Synopsis() string {
+	return "Prints a url which downloads an artifact, or all of a hash's artifacts, until it expires"
+}
+
+func (c *ArtifactUrlCommand) Usages() []string {
+	return []string{
+		`cas artifact url "${hash}" dist/game.pak`,
+		`cas artifact url "${hash}" --expires 72h`,
+	}
+}
+
+func (c *ArtifactUrlCommand) commandFlags() *config.ConfigGroup {
+	cfg := config.NewConfigGroup("")
+
+	cfg.StringFlag(&c.statePath, "state-path", "", ".cas/state", "the directory to hold local state")
+	cfg.DurationFlag(&c.expires, "expires", "CAS_URL_EXPIRES", 24*time.Hour, "how long the url works for, at most 7 days")
+
+	return cfg
+}
+
+func (c *ArtifactUrlCommand) Configuration() []*config.ConfigGroup {
+	return c.cfg
+}
+
+func (c *ArtifactUrlCommand) RunContext(ctx context.Context, args []string) error {
+	ctx, span := otel.Tracer("artifact_url").Start(ctx, "run")
+	defer span.End()
+
+	if len(args) != 1 && len(args) != 2 {
+		return fmt.Errorf("this command takes 1 or 2 arguments: hash, and optionally an artifact name")
+	}
+
+	// we support receiving the hash directly, or the state file path
+	// i.e. makefile using  `cas artifact url "$<" some-file`)
+	hash := strings.TrimPrefix(strings.TrimPrefix(args[0], c.statePath), "/")
+
+	span.SetAttributes(attribute.String("expires", c.expires.String()))
+
+	// an interrupted upload of a large archive is resumed from the local state
+	c.backendCfg.s3.StatePath = c.statePath
+
+	backend, err := c.backendCfg.Create(ctx)
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	var url string
+
+	if len(args) == 2 {
+		span.SetAttributes(attribute.String("artifact_name", args[1]))
+
+		url, err = backends.PresignArtifact(ctx, backend, hash, args[1], c.expires)
+	} else {
+		// without an artifact, the url downloads an archive of all of them
+		url, err = backends.PresignArchive(ctx, backend, hash, func(w io.Writer) error {
+			return writeArchive(ctx, backend, hash, w)
+		}, c.expires)
+	}
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	fmt.Fprintln(c.stdout, url)
+
+	return nil
+}
+
+// writeArchive writes a tar.gz of the hash's artifacts, keeping their permissions and links
+func writeArchive(ctx context.Context, backend backends.Backend, hash string, w io.Writer) error {
+	manifest, found, err := backends.ReadArtifactManifest(ctx, backend, hash)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("hash %s has no artifacts", hash)
+	}
+
+	files, err := backend.FetchArtifacts(ctx, hash)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	compressed := gzip.NewWriter(w)
+	archive := tar.NewWriter(compressed)
+
+	for _, file := range files {
+		header := &tar.Header{
+			Name:     file.Name,
+			ModTime:  file.Timestamp,
+			Mode:     int64(file.Mode.Perm()),
+			Typeflag: tar.TypeReg,
+			Size:     manifest[file.Name].Size,
+		}
+
+		switch {
+		case file.Mode&os.ModeSymlink != 0:
+			target, err := io.ReadAll(file.Content)
+			if err != nil {
+				return err
+			}
+
+			header.Typeflag, header.Linkname, header.Size = tar.TypeSymlink, string(target), 0
+		case file.Mode.IsDir():
+			header.Typeflag, header.Size = tar.TypeDir, 0
+		}
+
+		if header.Mode == 0 {
+			header.Mode = 0644
+		}
+
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if header.Typeflag == tar.TypeReg {
+			if _, err := io.Copy(archive, file.Content); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return err
+	}
+
+	return compressed.Close()
+}
@@ -0,0 +1,152 @@
+package command
+
+import (
+	"archive/tar"
+	"bytes"
+	"cas/backends"
+	"cas/backends/readonly"
+	"cas/localstorage"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/cli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func download(t *testing.T, url string) []byte {
+	res, err := http.Get(url)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	content, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	return content
+}
+
+func TestArtifactUrl(t *testing.T) {
+	cfg := configureTestEnvironment()
+	hash := uuid.New().String()
+
+	source := localstorage.NewMemoryStorage()
+	source.WriteFile(context.Background(), "dist/app.js", time.Now(), strings.NewReader("the app"))
+	source.WriteFile(context.Background(), "dist/app.css", time.Now(), strings.NewReader("the styles"))
+
+	push := NewArtifactPushCommand(cli.NewMockUi(), source)
+	push.backendCfg = cfg
+	require.NoError(t, push.RunContext(context.Background(), []string{hash, "dist/app.js", "dist/app.css"}))
+
+	stdout := &bytes.Buffer{}
+	cmd := NewArtifactUrlCommand(localstorage.NewMemoryStorage())
+	cmd.backendCfg = cfg
+	cmd.expires = time.Hour
+	cmd.stdout = stdout
+
+	require.NoError(t, cmd.RunContext(context.Background(), []string{hash, "dist/app.js"}))
+
+	url := strings.TrimSpace(stdout.String())
+	assert.Contains(t, url, "X-Amz-Expires=3600")
+	assert.Equal(t, "the app", string(download(t, url)))
+
+	// without an artifact, the url is for an archive of all of them
+	stdout.Reset()
+	require.NoError(t, cmd.RunContext(context.Background(), []string{hash}))
+
+	compressed, err := gzip.NewReader(bytes.NewReader(download(t, strings.TrimSpace(stdout.String()))))
+	require.NoError(t, err)
+
+	archived := map[string]string{}
+	archive := tar.NewReader(compressed)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		content, err := io.ReadAll(archive)
+		require.NoError(t, err)
+		archived[header.Name] = string(content)
+	}
+
+	assert.Equal(t, map[string]string{"dist/app.js": "the app", "dist/app.css": "the styles"}, archived)
+
+	// artifacts which don't exist have no url
+	assert.Error(t, cmd.RunContext(context.Background(), []string{hash, "dist/missing.js"}))
+
+	cmd.expires = 30 * 24 * time.Hour
+	assert.ErrorContains(t, cmd.RunContext(context.Background(), []string{hash, "dist/app.js"}), "at most")
+}
+
+func TestArtifactUrlMultipartArchive(t *testing.T) {
+	cfg := configureTestEnvironment()
+	cfg.s3.MultipartThreshold = 5*1024*1024 + 1
+	cfg.s3.PartSize = 5 * 1024 * 1024
+
+	hash := uuid.New().String()
+
+	// random content doesn't compress, so the archive is uploaded in parts
+	content := make([]byte, cfg.s3.PartSize+1024)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+
+	source := localstorage.NewMemoryStorage()
+	source.WriteFile(context.Background(), "dist/large.bin", time.Now(), bytes.NewReader(content))
+
+	push := NewArtifactPushCommand(cli.NewMockUi(), source)
+	push.backendCfg = cfg
+	push.statePath = t.TempDir()
+	require.NoError(t, push.RunContext(context.Background(), []string{hash, "dist/large.bin"}))
+
+	stdout := &bytes.Buffer{}
+	cmd := NewArtifactUrlCommand(localstorage.NewMemoryStorage())
+	cmd.backendCfg = cfg
+	cmd.expires = time.Hour
+	cmd.statePath = t.TempDir()
+	cmd.stdout = stdout
+	require.NoError(t, cmd.RunContext(context.Background(), []string{hash}))
+
+	compressed, err := gzip.NewReader(bytes.NewReader(download(t, strings.TrimSpace(stdout.String()))))
+	require.NoError(t, err)
+
+	archive := tar.NewReader(compressed)
+	header, err := archive.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "dist/large.bin", header.Name)
+
+	archived, err := io.ReadAll(archive)
+	require.NoError(t, err)
+	assert.Equal(t, content, archived)
+}
+
+func TestArtifactUrlUnsupported(t *testing.T) {
+	cfg := configureTestEnvironment()
+	hash := uuid.New().String()
+
+	cmd := NewArtifactUrlCommand(localstorage.NewMemoryStorage())
+	cmd.backendCfg = cfg
+	cmd.expires = time.Hour
+	cmd.stdout = &bytes.Buffer{}
+
+	// the archive has to be written, which a read only process can't do
+	cfg.readOnly = true
+	assert.ErrorIs(t, cmd.RunContext(context.Background(), []string{hash}), readonly.ErrReadOnly)
+
+	// encrypted artifacts can't be downloaded without their key
+	cfg.readOnly = false
+	cfg.encryptionKeys.Value = "k1=" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+
+	assert.ErrorIs(t, cmd.RunContext(context.Background(), []string{hash, "dist/app.js"}), backends.ErrPresignUnsupported)
+	assert.ErrorIs(t, cmd.RunContext(context.Background(), []string{hash}), backends.ErrPresignUnsupported)
+}
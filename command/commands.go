@@ -12,10 +12,19 @@ func Commands(ui cli.Ui) map[string]cli.CommandFactory {
 
 	return map[string]cli.CommandFactory{
 		"version":       NewCommand("version", NewVersionCommand()),
-		"fetch":         NewCommand("fetch", NewFetchCommand(storage)),
+		"verify":        NewCommand("verify", NewVerifyCommand(storage)),
+		"fetch":         NewCommand("fetch", NewFetchCommand(ui, storage)),
 		"artifact list": NewCommand("artifact list", NewArtifactListCommand(storage)),
-		"artifact push": NewCommand("artifact push", NewArtifactPushCommand(storage)),
-		"artifact pull": NewCommand("artifact pull", NewArtifactPullCommand(storage)),
+		"artifact cat":  NewCommand("artifact cat", NewArtifactCatCommand(storage)),
+		"artifact url":  NewCommand("artifact url", NewArtifactUrlCommand(storage)),
+		"artifact push": NewCommand("artifact push", NewArtifactPushCommand(ui, storage)),
+		"artifact pull": NewCommand("artifact pull", NewArtifactPullCommand(ui, storage)),
+		"meta find":     NewCommand("meta find", NewMetaFindCommand(storage)),
+		"meta read":     NewCommand("meta read", NewMetaReadCommand(storage)),
+		"meta write":    NewCommand("meta write", NewMetaWriteCommand(storage)),
 		"hash":          NewCommand("hash", NewHashCommand()),
+		"migrate":       NewCommand("migrate", NewMigrateCommand()),
+		"copy":          NewCommand("copy", NewCopyCommand()),
+		"provenance":    NewCommand("provenance", NewProvenanceCommand(storage)),
 	}
 }
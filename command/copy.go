@@ -0,0 +1,331 @@
+package command
+
+import (
+	"bufio"
+	"cas/backends"
+	"cas/backends/readonly"
+	"cas/backends/s3"
+	"cas/config"
+	"cas/tracing"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type hashLister interface {
+	ListHashes(ctx context.Context) ([]string, error)
+}
+
+func NewCopyCommand() *CopyCommand {
+	cmd := &CopyCommand{
+		backendCfg: NewBackendConfiguration(),
+	}
+
+	cmd.cfg = append(cmd.cfg, cmd.commandFlags())
+	cmd.cfg = append(cmd.cfg, cmd.backendCfg.Flags()...)
+	cmd.cfg = append(cmd.cfg, globalFlags(&cmd.format))
+
+	return cmd
+}
+
+type CopyCommand struct {
+	cfg        []*config.ConfigGroup
+	backendCfg *BackendConfiguration
+
+	from string
+	to   string
+
+	toEndpoint  string
+	toRegion    string
+	toProfile   string
+	toAccessKey string
+	toSecretKey string
+
+	all            bool
+	since          string
+	checkpointPath string
+	format         string
+}
+
+func (c *CopyCommand) Synopsis() string {
+	return "Copies hashes' metadata and artifacts to another prefix, bucket or endpoint"
+}
+
+func (c *CopyCommand) Usages() []string {
+	return []string{
+		`cas copy "${hash}" --from ci --to release`,
+		`cas copy --all --since 168h --to s3://archive-bucket/release`,
+		`cas copy --all --to s3://cas-artifacts --to-endpoint https://s3.eu-west-1.amazonaws.com`,
+	}
+}
+
+func (c *CopyCommand) commandFlags() *config.ConfigGroup {
+	cfg := config.NewConfigGroup("")
+
+	cfg.StringFlag(&c.from, "from", "", "", "the prefix, or s3://bucket/prefix, to copy from.  Defaults to the backend's bucket and prefix")
+	cfg.StringFlag(&c.to, "to", "", "", "the prefix, or s3://bucket/prefix, to copy to")
+	cfg.StringFlag(&c.toEndpoint, "to-endpoint", "", "", "the S3 endpoint to copy to, if not the backend's")
+	cfg.StringFlag(&c.toRegion, "to-region", "", "", "the region of the bucket to copy to, if not the backend's")
+	cfg.StringFlag(&c.toProfile, "to-profile", "", "", "the AWS configuration profile to copy to with, if not the backend's")
+	cfg.StringFlag(&c.toAccessKey, "to-access-key", "CAS_COPY_TO_ACCESS_KEY", "", "the access key to copy to with, if not the backend's")
+	cfg.StringFlag(&c.toSecretKey, "to-secret-key", "CAS_COPY_TO_SECRET_KEY", "", "the secret key to copy to with, if not the backend's")
+	cfg.BoolFlag(&c.all, "all", "", false, "copy every hash in the source")
+	cfg.StringFlag(&c.since, "since", "", "", "only copy hashes created since this date (2006-01-02 or RFC3339) or duration ago (72h)")
+	cfg.StringFlag(&c.checkpointPath, "checkpoint-path", "", ".cas/copy", "the directory to record copied hashes in, so an interrupted copy can resume")
+
+	return cfg
+}
+
+func (c *CopyCommand) Configuration() []*config.ConfigGroup {
+	return c.cfg
+}
+
+func (c *CopyCommand) RunContext(ctx context.Context, args []string) error {
+	ctx, span := otel.Tracer("copy").Start(ctx, "run")
+	defer span.End()
+
+	if len(args) == 0 && !c.all {
+		return fmt.Errorf("this command takes either hashes to copy, or --all")
+	}
+
+	if c.to == "" {
+		return fmt.Errorf("--to is required")
+	}
+
+	if c.backendCfg.readOnly {
+		return tracing.Error(span, readonly.ErrReadOnly)
+	}
+
+	since, err := parseSince(c.since, time.Now())
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	fromCfg, toCfg := *c.backendCfg, *c.backendCfg
+
+	if c.from != "" {
+		fromCfg.s3 = withLocation(fromCfg.s3, c.from)
+	}
+
+	toCfg.s3 = c.destination(toCfg.s3)
+
+	span.SetAttributes(
+		attribute.String("from", location(fromCfg.s3)),
+		attribute.String("to", location(toCfg.s3)),
+	)
+
+	if location(fromCfg.s3) == location(toCfg.s3) && fromCfg.s3.Endpoint == toCfg.s3.Endpoint {
+		return fmt.Errorf("the source and destination are both %s", location(toCfg.s3))
+	}
+
+	source, err := fromCfg.CreateRemote(ctx)
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	destination, err := toCfg.CreateRemote(ctx)
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	copier, ok := destination.(backends.HashCopier)
+	if !ok {
+		return tracing.Error(span, backends.ErrCopyUnsupported)
+	}
+
+	hashes := args
+	if c.all {
+		lister, ok := source.(hashLister)
+		if !ok {
+			return tracing.Errorf(span, "the %s backend can't list its hashes", c.backendCfg.name)
+		}
+
+		hashes, err = lister.ListHashes(ctx)
+		if err != nil {
+			return tracing.Error(span, err)
+		}
+	}
+
+	checkpoint, err := openCheckpoint(path.Join(c.checkpointPath, checkpointName(fromCfg.s3, toCfg.s3)))
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+	defer checkpoint.Close()
+
+	span.SetAttributes(
+		attribute.Int("hashes", len(hashes)),
+		attribute.Int("checkpointed", len(checkpoint.done)),
+	)
+
+	copied, skipped := 0, 0
+	for _, hash := range hashes {
+		if checkpoint.done[hash] {
+			skipped++
+			continue
+		}
+
+		if !since.IsZero() {
+			ts, found, err := backends.ReadTimestamp(ctx, source, hash)
+			if err != nil {
+				return tracing.Error(span, err)
+			}
+
+			if !found || ts.Before(since) {
+				skipped++
+				continue
+			}
+		}
+
+		artifacts, err := copier.CopyHash(ctx, source, hash)
+		if err != nil {
+			return tracing.Error(span, err)
+		}
+
+		if err := checkpoint.add(hash); err != nil {
+			return tracing.Error(span, err)
+		}
+
+		copied++
+		fmt.Fprintf(os.Stderr, "- %s (%d artifacts transferred)\n", hash, artifacts)
+	}
+
+	span.SetAttributes(
+		attribute.Int("copied", copied),
+		attribute.Int("skipped", skipped),
+	)
+	fmt.Fprintf(os.Stderr, "Copied %d of %d hashes\n", copied, len(hashes))
+
+	// the copy is complete, so a later copy checks every hash again
+	return checkpoint.remove()
+}
+
+// destination is the S3 configuration to copy to.  The backend's static keys take priority over
+// a profile, and belong to the backend's endpoint, so they are only kept when copying within it.
+func (c *CopyCommand) destination(cfg s3.S3Config) s3.S3Config {
+	cfg = withLocation(cfg, c.to)
+
+	if c.toEndpoint != "" || c.toProfile != "" {
+		cfg.AccessKey, cfg.SecretKey = "", ""
+	}
+
+	if c.toEndpoint != "" {
+		cfg.Endpoint = c.toEndpoint
+	}
+	if c.toRegion != "" {
+		cfg.Region = c.toRegion
+	}
+	if c.toProfile != "" {
+		cfg.Profile = c.toProfile
+	}
+	if c.toAccessKey != "" || c.toSecretKey != "" {
+		cfg.AccessKey, cfg.SecretKey = c.toAccessKey, c.toSecretKey
+	}
+
+	return cfg
+}
+
+// withLocation sets the bucket and prefix from `s3://bucket/prefix`, or just the prefix
+func withLocation(cfg s3.S3Config, location string) s3.S3Config {
+	if bucketPath, found := strings.CutPrefix(location, "s3://"); found {
+		cfg.BucketName, cfg.PathPrefix, _ = strings.Cut(bucketPath, "/")
+	} else {
+		cfg.PathPrefix = location
+	}
+
+	cfg.PathPrefix = strings.Trim(cfg.PathPrefix, "/")
+
+	return cfg
+}
+
+func location(cfg s3.S3Config) string {
+	return "s3://" + path.Join(cfg.BucketName, cfg.PathPrefix)
+}
+
+// parseSince parses a date, or a duration before now.  An empty value is the zero time.
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if ago, err := time.ParseDuration(value); err == nil {
+		return now.Add(-ago), nil
+	}
+
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if since, err := time.Parse(layout, value); err == nil {
+			return since, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid --since '%s', expected a date like 2006-01-02 or a duration like 72h", value)
+}
+
+func checkpointName(from s3.S3Config, to s3.S3Config) string {
+	id := sha1.Sum([]byte(from.Endpoint + " " + location(from) + " " + to.Endpoint + " " + location(to)))
+	return fmt.Sprintf("%x", id)
+}
+
+// checkpoint records the hashes a copy has finished, one per line
+type checkpoint struct {
+	path string
+	file *os.File
+	done map[string]bool
+}
+
+func openCheckpoint(checkpointPath string) (*checkpoint, error) {
+	cp := &checkpoint{path: checkpointPath, done: map[string]bool{}}
+
+	existing, err := os.Open(checkpointPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	if existing != nil {
+		scanner := bufio.NewScanner(existing)
+		for scanner.Scan() {
+			if hash := strings.TrimSpace(scanner.Text()); hash != "" {
+				cp.done[hash] = true
+			}
+		}
+		existing.Close()
+
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.MkdirAll(path.Dir(checkpointPath), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	cp.file, err = os.OpenFile(checkpointPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	return cp, nil
+}
+
+func (cp *checkpoint) add(hash string) error {
+	cp.done[hash] = true
+
+	_, err := fmt.Fprintln(cp.file, hash)
+	return err
+}
+
+func (cp *checkpoint) Close() error {
+	return cp.file.Close()
+}
+
+func (cp *checkpoint) remove() error {
+	cp.file.Close()
+	return os.Remove(cp.path)
+}
@@ -0,0 +1,206 @@
+package command
+
+import (
+	"bytes"
+	"cas/backends"
+	"cas/localstorage"
+	"context"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/cli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func pushTestHash(t *testing.T, cfg *BackendConfiguration, hash string, files map[string]string) {
+	source := localstorage.NewMemoryStorage()
+	paths := []string{hash}
+	for name, content := range files {
+		source.WriteFile(context.Background(), name, time.Now(), strings.NewReader(content))
+		paths = append(paths, name)
+	}
+
+	push := NewArtifactPushCommand(cli.NewMockUi(), source)
+	push.backendCfg = cfg
+	require.NoError(t, push.RunContext(context.Background(), paths))
+}
+
+func catArtifact(t *testing.T, cfg *BackendConfiguration, hash string, name string) string {
+	stdout := &bytes.Buffer{}
+
+	cat := NewArtifactCatCommand(localstorage.NewMemoryStorage())
+	cat.backendCfg = cfg
+	cat.stdout = stdout
+	require.NoError(t, cat.RunContext(context.Background(), []string{hash, name}))
+
+	return stdout.String()
+}
+
+func withPrefix(cfg *BackendConfiguration, prefix string) *BackendConfiguration {
+	copied := *cfg
+	copied.s3.PathPrefix = prefix
+	return &copied
+}
+
+func TestCopy(t *testing.T) {
+	run := uuid.New().String()
+	hash := uuid.New().String()
+
+	ci := withPrefix(configureTestEnvironment(), "tests/ci-"+run)
+	// names which have to be escaped to be copied by S3
+	files := map[string]string{"dist/app.js": "the app", "dist/app.css": "the styles", "dist/my app+1%?é.js": "escaped"}
+	pushTestHash(t, ci, hash, files)
+
+	source, err := ci.CreateRemote(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, source.WriteMetadata(context.Background(), hash, "branch", strings.NewReader("main")))
+
+	expected, err := source.ReadMetadata(context.Background(), hash, nil)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name     string
+		prefix   string
+		endpoint func() string
+	}{
+		// the same endpoint, so S3 copies the objects
+		{name: "server side", prefix: "tests/release-" + run},
+		// another endpoint, so the artifacts are downloaded and uploaded
+		{name: "transfer", prefix: "tests/moved-" + run, endpoint: func() string {
+			server, _ := countingProxy(t)
+			return server.URL
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cmd := NewCopyCommand()
+			cmd.backendCfg = ci
+			cmd.to = tc.prefix
+			cmd.checkpointPath = t.TempDir()
+			if tc.endpoint != nil {
+				cmd.toEndpoint = tc.endpoint()
+			}
+
+			require.NoError(t, cmd.RunContext(context.Background(), []string{hash}))
+
+			release := withPrefix(ci, tc.prefix)
+
+			destination, err := release.CreateRemote(context.Background())
+			require.NoError(t, err)
+
+			// the timestamp, artifact digests and other metadata are the same
+			copied, err := destination.ReadMetadata(context.Background(), hash, nil)
+			require.NoError(t, err)
+			assert.Equal(t, expected, copied)
+
+			for name, content := range files {
+				assert.Equal(t, content, catArtifact(t, release, hash, name))
+			}
+
+			// copying again transfers nothing, as every artifact exists
+			copier := destination.(backends.HashCopier)
+			transferred, err := copier.CopyHash(context.Background(), source, hash)
+			require.NoError(t, err)
+			assert.Equal(t, 0, transferred)
+		})
+	}
+}
+
+func TestCopyAll(t *testing.T) {
+	run := uuid.New().String()
+	ci := withPrefix(configureTestEnvironment(), "tests/ci-"+run)
+
+	source, err := ci.CreateRemote(context.Background())
+	require.NoError(t, err)
+
+	recent, checkpointed, old := uuid.New().String(), uuid.New().String(), uuid.New().String()
+	require.NoError(t, backends.CreateHash(context.Background(), source, old, time.Now().Add(-48*time.Hour)))
+
+	for _, hash := range []string{recent, checkpointed, old} {
+		pushTestHash(t, ci, hash, map[string]string{"dist/app.js": "app " + hash})
+	}
+
+	cmd := NewCopyCommand()
+	cmd.backendCfg = ci
+	cmd.to = "tests/release-" + run
+	cmd.all = true
+	cmd.since = "24h"
+	cmd.checkpointPath = t.TempDir()
+
+	// an interrupted copy had already copied one hash
+	checkpointPath := path.Join(cmd.checkpointPath, checkpointName(ci.s3, withLocation(ci.s3, cmd.to)))
+	require.NoError(t, os.WriteFile(checkpointPath, []byte(checkpointed+"\n"), 0644))
+
+	require.NoError(t, cmd.RunContext(context.Background(), []string{}))
+
+	destination, err := withPrefix(ci, cmd.to).CreateRemote(context.Background())
+	require.NoError(t, err)
+
+	for hash, copied := range map[string]bool{recent: true, checkpointed: false, old: false} {
+		_, found, err := backends.ReadTimestamp(context.Background(), destination, hash)
+		require.NoError(t, err)
+		assert.Equal(t, copied, found, hash)
+	}
+
+	// the copy completed, so its checkpoint is removed
+	assert.NoFileExists(t, checkpointPath)
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	since, err := parseSince("72h", now)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(-72*time.Hour), since)
+
+	since, err = parseSince("2026-10-01", now)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC), since)
+
+	_, err = parseSince("last week", now)
+	assert.Error(t, err)
+}
+
+func TestWithLocation(t *testing.T) {
+	cfg := configureTestEnvironment().s3
+
+	moved := withLocation(cfg, "s3://archive/release/")
+	assert.Equal(t, "archive", moved.BucketName)
+	assert.Equal(t, "release", moved.PathPrefix)
+
+	moved = withLocation(cfg, "release")
+	assert.Equal(t, cfg.BucketName, moved.BucketName)
+	assert.Equal(t, "release", moved.PathPrefix)
+}
+
+func TestCopyDestination(t *testing.T) {
+	cfg := configureTestEnvironment().s3
+	cfg.AccessKey, cfg.SecretKey = "seaweed", "seaweed-secret"
+
+	// copying within the endpoint keeps its keys
+	cmd := &CopyCommand{to: "release"}
+	to := cmd.destination(cfg)
+	assert.Equal(t, "seaweed", to.AccessKey)
+	assert.Equal(t, "seaweed-secret", to.SecretKey)
+
+	// another endpoint or profile signs with its own credentials, rather than the backend's
+	cmd = &CopyCommand{to: "s3://archive", toEndpoint: "https://s3.eu-west-1.amazonaws.com", toProfile: "archive"}
+	to = cmd.destination(cfg)
+	assert.Equal(t, "https://s3.eu-west-1.amazonaws.com", to.Endpoint)
+	assert.Equal(t, "archive", to.Profile)
+	assert.Empty(t, to.AccessKey)
+	assert.Empty(t, to.SecretKey)
+
+	cmd = &CopyCommand{to: "s3://archive", toProfile: "archive"}
+	to = cmd.destination(cfg)
+	assert.Empty(t, to.AccessKey)
+
+	cmd = &CopyCommand{to: "s3://archive", toEndpoint: "https://s3.eu-west-1.amazonaws.com", toAccessKey: "aws", toSecretKey: "aws-secret"}
+	to = cmd.destination(cfg)
+	assert.Equal(t, "aws", to.AccessKey)
+	assert.Equal(t, "aws-secret", to.SecretKey)
+}
@@ -3,10 +3,12 @@ package command
 import (
 	"bytes"
 	"cas/backends"
+	"cas/backends/signing"
 	"cas/config"
 	"cas/debug"
 	"cas/hashing"
 	"cas/localstorage"
+	"cas/progress"
 	"cas/tracing"
 	"context"
 	"fmt"
@@ -15,12 +17,14 @@ import (
 	"path"
 	"time"
 
+	"github.com/hashicorp/cli"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 )
 
-func NewFetchCommand(storage localstorage.Storage) *FetchCommand {
+func NewFetchCommand(ui cli.Ui, storage localstorage.Storage) *FetchCommand {
 	cmd := &FetchCommand{
+		ui:         ui,
 		debugger:   debug.NewDebugger(),
 		storage:    storage,
 		backendCfg: NewBackendConfiguration(),
@@ -29,13 +33,14 @@ func NewFetchCommand(storage localstorage.Storage) *FetchCommand {
 	cmd.cfg = append(cmd.cfg, cmd.commandFlags())
 	cmd.cfg = append(cmd.cfg, cmd.backendCfg.Flags()...)
 	cmd.cfg = append(cmd.cfg, cmd.debugger.Flags())
-	cmd.cfg = append(cmd.cfg, globalFlags())
+	cmd.cfg = append(cmd.cfg, globalFlags(&cmd.format))
 
 	// cmd.Meta = NewMeta(ui, cmd)
 	return cmd
 }
 
 type FetchCommand struct {
+	ui         cli.Ui
 	cfg        []*config.ConfigGroup
 	debugger   *debug.Debugger
 	backendCfg *BackendConfiguration
@@ -45,6 +50,7 @@ type FetchCommand struct {
 	algorithm string
 	statePath string
 	verbose   bool
+	format    string
 
 	// for testing hashing on streams of data
 	testInput io.ReadCloser
@@ -92,33 +98,89 @@ func (c *FetchCommand) RunContext(ctx context.Context, args []string) error {
 
 	c.verbosePrint(fmt.Sprintf("Hash: %s", hash))
 
+	// a lease taken for building is recorded in the local state, so only its push releases it
+	c.backendCfg.s3.StatePath = c.statePath
+
 	backend, err := c.backendCfg.Create(ctx)
 	if err != nil {
 		return tracing.Error(span, err)
 	}
 
+	trusted, err := c.backendCfg.TrustList()
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
 	ts, timestampExists, err := backends.ReadTimestamp(ctx, backend, hash)
 	if err != nil {
 		return tracing.Error(span, err)
 	}
 
-	span.SetAttributes(attribute.Bool("existing_hash", timestampExists))
+	span.SetAttributes(
+		attribute.Bool("existing_hash", timestampExists),
+		attribute.Bool("read_only", c.backendCfg.readOnly),
+	)
+
 	if !timestampExists {
 		ts = time.Now()
 
-		if err := backends.CreateHash(ctx, backend, hash, ts); err != nil {
-			return tracing.Error(span, err)
+		if !c.backendCfg.readOnly {
+			if err := backends.CreateHash(ctx, backend, hash, ts); err != nil {
+				return tracing.Error(span, err)
+			}
 		}
 	}
 
-	backend.WriteMetadata(ctx, hash, "@debug/hashes", bytes.NewReader(debug.MarshalIntermediates(intermediate)))
+	if !c.backendCfg.readOnly {
+		backend.WriteMetadata(ctx, hash, "@debug/hashes", bytes.NewReader(debug.MarshalIntermediates(intermediate)))
+	}
 
 	statePath := path.Join(c.statePath, hash)
 	if err := c.storage.WriteFile(ctx, statePath, ts, &bytes.Buffer{}); err != nil {
 		return tracing.Error(span, err)
 	}
 
-	remoteFiles, err := backend.FetchArtifacts(ctx, hash)
+	// a read only process can't push, so it builds without leasing rather than making others wait
+	if c.backendCfg.lease && !c.backendCfg.readOnly {
+		state, err := backends.AwaitLease(ctx, backend, hash, c.backendCfg.leaseTTL, c.backendCfg.leaseWait)
+		if err != nil {
+			return tracing.Error(span, err)
+		}
+
+		span.SetAttributes(attribute.String("lease", string(state)))
+
+		switch state {
+		case backends.LeaseHeld:
+			c.verbosePrint("Leased hash for building")
+		case backends.LeaseTimeout:
+			c.verbosePrint("Timed out waiting for another process to build the hash")
+		}
+	}
+
+	// artifacts which aren't signed by a trusted key are treated as a miss, so they are built
+	// locally rather than restored
+	if trusted != nil {
+		manifest, err := signing.VerifyManifest(ctx, backend, hash, trusted)
+		if signing.IsRejected(err) {
+			span.SetAttributes(attribute.Bool("rejected", true))
+			c.verbosePrint("Not restoring artifacts: " + err.Error())
+
+			fmt.Println(statePath)
+			return nil
+		}
+		if err != nil {
+			return tracing.Error(span, err)
+		}
+
+		// the manifest could be written after it was verified, so only its verified artifacts
+		// are fetched
+		ctx = backends.WithArtifactManifest(ctx, hash, manifest)
+	}
+
+	tracker := progress.NewTracker(c.ui, progress.Fetch, progress.IsTerminal())
+	defer tracker.Finish()
+
+	remoteFiles, err := backend.FetchArtifacts(progress.WithTracker(ctx, tracker), hash)
 	if err != nil {
 		return tracing.Error(span, err)
 	}
@@ -126,7 +188,7 @@ func (c *FetchCommand) RunContext(ctx context.Context, args []string) error {
 	for _, remoteFile := range remoteFiles {
 		c.verbosePrint("Fetching artifact: " + remoteFile.Name)
 
-		if err := c.storage.WriteFile(ctx, remoteFile.Name, remoteFile.Timestamp, remoteFile.Content); err != nil {
+		if err := c.storage.WriteEntry(ctx, remoteFile.Name, remoteFile.Timestamp, remoteFile.Mode, remoteFile.Content); err != nil {
 			return tracing.Error(span, err)
 		}
 
@@ -0,0 +1,103 @@
+package command
+
+import (
+	"cas/localstorage"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/cli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingProxy forwards requests to the real endpoint, counting them
+func countingProxy(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	target, err := url.Parse(os.Getenv("AWS_ENDPOINT_URL"))
+	require.NoError(t, err)
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	requests := &atomic.Int32{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		proxy.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, requests
+}
+
+func TestFetchManyArtifacts(t *testing.T) {
+	cfg := configureTestEnvironment()
+	hash := uuid.New().String()
+
+	source := localstorage.NewMemoryStorage()
+	paths := []string{hash}
+	for i := range 40 {
+		name := fmt.Sprintf("dist/%02d.txt", i)
+		source.WriteFile(context.Background(), name, time.Now(), strings.NewReader("content of "+name))
+		paths = append(paths, name)
+	}
+
+	push := NewArtifactPushCommand(cli.NewMockUi(), source)
+	push.backendCfg = cfg
+	require.NoError(t, push.RunContext(context.Background(), paths))
+
+	server, requests := countingProxy(t)
+
+	fetchCfg := configureTestEnvironment()
+	fetchCfg.concurrency = 8
+	fetchCfg.s3.Endpoint = server.URL
+
+	backend, err := fetchCfg.Create(context.Background())
+	require.NoError(t, err)
+
+	files, err := backend.FetchArtifacts(context.Background(), hash)
+	require.NoError(t, err)
+	require.Len(t, files, 40)
+
+	// the manifest and timestamp are read once for the hash, and then each artifact once
+	assert.Equal(t, int32(2+40), requests.Load())
+
+	for _, file := range files {
+		content, err := io.ReadAll(file.Content)
+		require.NoError(t, err)
+		assert.Equal(t, "content of "+file.Name, string(content))
+		file.Close()
+	}
+
+	// everything is cached now, so fetching again only reads the manifest and timestamp
+	requests.Store(0)
+
+	files, err = backend.FetchArtifacts(context.Background(), hash)
+	require.NoError(t, err)
+	require.Len(t, files, 40)
+
+	for _, file := range files {
+		file.Close()
+	}
+
+	assert.Equal(t, int32(2), requests.Load())
+
+	// the fetch command summarises what it restored
+	ui := cli.NewMockUi()
+
+	fetch := NewFetchCommand(ui, localstorage.NewMemoryStorage())
+	fetch.backendCfg = configureTestEnvironment()
+	fetch.testHash = hash
+	require.NoError(t, fetch.RunContext(context.Background(), []string{}))
+
+	assert.Contains(t, ui.ErrorWriter.String(), "Fetched 40 files, 0 B in ")
+	assert.Contains(t, ui.ErrorWriter.String(), ", 40 from the cache")
+}
@@ -3,11 +3,18 @@ package command
 import (
 	"cas/backends"
 	"cas/backends/cache"
+	"cas/backends/encryption"
+	"cas/backends/failopen"
+	"cas/backends/readonly"
 	"cas/backends/s3"
+	"cas/backends/signing"
 	"cas/config"
+	"cas/debug"
 	"context"
 	"fmt"
+	"os"
 	"strings"
+	"time"
 )
 
 const BackendEnvVar = "CAS_BACKEND"
@@ -19,42 +26,146 @@ func NewBackendConfiguration() *BackendConfiguration {
 }
 
 type BackendConfiguration struct {
-	name string
+	name       string
+	onConflict string
+	readOnly   bool
+	failOpen   bool
+
+	lease     bool
+	leaseTTL  time.Duration
+	leaseWait time.Duration
+
+	retry          backends.RetryPolicy
+	connectTimeout time.Duration
+	concurrency    int
+
+	encryptionKeys     encryption.KeySource
+	encryptionRequired bool
+
+	signingKey  signing.KeySource
+	trustedKeys signing.KeySource
 
 	s3 s3.S3Config
 }
 
 func (bc *BackendConfiguration) Flags() []*config.ConfigGroup {
 
+	defaultRetry := backends.DefaultRetryPolicy()
+
 	own := config.NewConfigGroup("backend")
 	own.StringFlag(&bc.name, "backend", BackendEnvVar, "s3", "the backend to use for artifacts")
+	// pull requests from forks are untrusted, so default to not writing
+	own.BoolFlag(&bc.readOnly, "read-only", "CAS_READ_ONLY", debug.IsForkPullRequest(), "never write to the backend, and make push do nothing.  Defaults to true for pull requests from forks")
+	own.BoolFlag(&bc.failOpen, "fail-open", "CAS_FAIL_OPEN", false, "when the backend is unavailable, fetch reports a miss and push does nothing, rather than failing")
+	own.StringFlag(&bc.onConflict, "on-conflict", "CAS_ON_CONFLICT", string(backends.ConflictWarn), "what to do when an artifact exists with different content: fail, warn or overwrite")
+	own.BoolFlag(&bc.lease, "lease", "CAS_LEASE", false, "when a hash has no artifacts, lease it so only one process builds it while others wait")
+	own.DurationFlag(&bc.leaseTTL, "lease-ttl", "CAS_LEASE_TTL", 10*time.Minute, "how long a lease lasts if its artifacts are never pushed")
+	own.DurationFlag(&bc.leaseWait, "lease-wait", "CAS_LEASE_WAIT", 5*time.Minute, "how long to wait for another process's leased build before building anyway")
+	own.IntFlag(&bc.retry.Attempts, "retry-attempts", "CAS_RETRY_ATTEMPTS", defaultRetry.Attempts, "how many times a backend request is tried before failing, when it is throttled or fails transiently")
+	own.DurationFlag(&bc.retry.BaseDelay, "retry-delay", "CAS_RETRY_DELAY", defaultRetry.BaseDelay, "the delay before the first retry, which doubles for each retry, with jitter")
+	own.DurationFlag(&bc.retry.Timeout, "backend-timeout", "CAS_BACKEND_TIMEOUT", defaultRetry.Timeout, "the deadline for each backend operation, including its retries and reading its response")
+	own.IntFlag(&bc.concurrency, "concurrency", "CAS_CONCURRENCY", backends.DefaultConcurrency, "the most requests to make to the backend at once")
+	own.DurationFlag(&bc.connectTimeout, "connect-timeout", "CAS_CONNECT_TIMEOUT", 5*time.Second, "how long to wait for a connection to the backend")
+	own.StringFlag(&bc.encryptionKeys.Value, "encryption-keys", "CAS_ENCRYPTION_KEYS", "", "keys to encrypt artifacts and metadata with, as id=base64-key pairs; the first key encrypts, the rest only decrypt")
+	own.StringFlag(&bc.encryptionKeys.File, "encryption-keys-file", "CAS_ENCRYPTION_KEYS_FILE", "", "a file containing the encryption keys, one id=base64-key pair per line")
+	own.StringFlag(&bc.encryptionKeys.Command, "encryption-keys-command", "CAS_ENCRYPTION_KEYS_COMMAND", "", "a shell command which prints the encryption keys")
+	own.BoolFlag(&bc.encryptionRequired, "encryption-required", "CAS_ENCRYPTION_REQUIRED", true, "with encryption keys, reject artifacts and metadata values which aren't encrypted.  Set to false while content stored before encryption was enabled is still read")
+
+	sign := config.NewConfigGroup("signing")
+	sign.StringFlag(&bc.signingKey.Value, "signing-key", "CAS_SIGNING_KEY", "", "an id=base64-ed25519-seed pair, to sign hashes with when pushing")
+	sign.StringFlag(&bc.signingKey.File, "signing-key-file", "CAS_SIGNING_KEY_FILE", "", "a file containing the signing key")
+	sign.StringFlag(&bc.trustedKeys.Value, "trusted-keys", "CAS_TRUSTED_KEYS", "", "id=base64-ed25519-public-key pairs; when set, only hashes signed by one of these keys are restored")
+	sign.StringFlag(&bc.trustedKeys.File, "trusted-keys-file", "CAS_TRUSTED_KEYS_FILE", "", "a file containing the trusted keys, one per line")
 
 	return []*config.ConfigGroup{
 		own,
+		sign,
 		bc.s3.Flags(),
 		// other backend flag sets here
 	}
 }
 
 func (bc *BackendConfiguration) Create(ctx context.Context) (backends.Backend, error) {
-	switch strings.ToLower(bc.name) {
-	case "s3":
-		be, err := s3.NewS3Backend(ctx, bc.s3)
+	be, err := bc.CreateRemote(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	be = cache.NewCachedBackend(be, bc.concurrency)
+
+	// the cache stores the encrypted content, so it can still check it against the stored digests
+	if !bc.encryptionKeys.IsEmpty() {
+		keyring, err := encryption.LoadKeyring(ctx, bc.encryptionKeys)
+		if err != nil {
+			return nil, err
+		}
+
+		be = encryption.NewEncryptedBackend(be, keyring, bc.encryptionRequired)
+	}
+
+	if bc.readOnly {
+		be = readonly.NewReadOnlyBackend(be)
+	}
+
+	// outermost, so that any layer failing to reach the backend opens the circuit
+	if bc.failOpen {
+		be = failopen.NewFailOpenBackend(be, os.Stderr)
+	}
+
+	return be, nil
+}
+
+// SigningKey returns the key to sign pushed hashes with, or nil if hashes aren't signed
+func (bc *BackendConfiguration) SigningKey() (*signing.PrivateKey, error) {
+	if bc.signingKey.IsEmpty() {
+		return nil, nil
+	}
+
+	return signing.LoadPrivateKey(bc.signingKey)
+}
+
+// TrustList returns the keys which restored hashes must be signed by, or nil if any hash can
+// be restored
+func (bc *BackendConfiguration) TrustList() (signing.TrustList, error) {
+	if bc.trustedKeys.IsEmpty() {
+		return nil, nil
+	}
+
+	return signing.LoadTrustList(bc.trustedKeys)
+}
+
+// CreateRemote creates the backend without the local cache, for commands which need to
+// work with the backend's own storage.
+func (bc *BackendConfiguration) CreateRemote(ctx context.Context) (backends.Backend, error) {
+	onConflict := backends.ConflictWarn
+	if bc.onConflict != "" {
+		policy, err := backends.ParseConflictPolicy(bc.onConflict)
 		if err != nil {
 			return nil, err
 		}
-		return cache.NewCachedBackend(be), nil
+		onConflict = policy
+	}
+
+	switch strings.ToLower(bc.name) {
+	case "s3":
+		cfg := bc.s3
+		cfg.OnConflict = onConflict
+		cfg.Retry = bc.retry
+		cfg.Retry.MaxDelay = backends.DefaultRetryPolicy().MaxDelay
+		cfg.ConnectTimeout = bc.connectTimeout
+		cfg.Concurrency = bc.concurrency
+
+		return s3.NewS3Backend(ctx, cfg)
 	}
 
 	return nil, fmt.Errorf("unsupported backend '%s'", bc.name)
 }
 
-func globalFlags() *config.ConfigGroup {
+func globalFlags(format *string) *config.ConfigGroup {
 	flags := config.NewConfigGroup("global")
 
 	// flags.StringVar(&c.statePath, "state-path", ".cas/state", "the directory to hold local state")
-	format := ""
-	flags.StringFlag(&format, "format", "CAS_FORMAT", "text", "which format to write to stdout")
+	flags.StringFlag(format, "format", "CAS_FORMAT", FormatText, "which format to write to stdout (text, json)")
 
 	return flags
 
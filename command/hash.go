@@ -20,7 +20,7 @@ func NewHashCommand() *HashCommand {
 
 	cmd.cfg = append(cmd.cfg, cmd.commandFlags())
 	cmd.cfg = append(cmd.cfg, cmd.debugger.Flags())
-	cmd.cfg = append(cmd.cfg, globalFlags())
+	cmd.cfg = append(cmd.cfg, globalFlags(&cmd.format))
 
 	return cmd
 }
@@ -30,6 +30,7 @@ type HashCommand struct {
 	debugger *debug.Debugger
 
 	algorithm string
+	format    string
 
 	// for testing hashing on streams of data
 	testInput io.ReadCloser
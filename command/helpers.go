@@ -1,7 +1,10 @@
 package command
 
 import (
+	"bufio"
 	"fmt"
+	"io"
+	"os"
 	"strings"
 )
 
@@ -30,3 +33,59 @@ func parseKeyValuePairs(tags []string) (map[string]string, error) {
 
 	return m, nil
 }
+
+// resolveValues replaces any value starting with `@` with the content of the file it names,
+// or with stdin when the value is `@-`.  A value starting with `@@` is a literal `@`.
+func resolveValues(pairs map[string]string, stdin io.Reader) error {
+
+	stdinUsed := false
+
+	for key, val := range pairs {
+		if !strings.HasPrefix(val, "@") {
+			continue
+		}
+
+		if strings.HasPrefix(val, "@@") {
+			pairs[key] = val[1:]
+			continue
+		}
+
+		source := val[1:]
+
+		var content []byte
+		var err error
+
+		if source == "-" {
+			if stdin == nil || stdinUsed {
+				return fmt.Errorf("%s: stdin can only be read once", key)
+			}
+			stdinUsed = true
+
+			content, err = io.ReadAll(stdin)
+		} else {
+			content, err = os.ReadFile(source)
+		}
+
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+
+		pairs[key] = string(content)
+	}
+
+	return nil
+}
+
+func readLines(input io.Reader) ([]string, error) {
+
+	lines := []string{}
+	scanner := bufio.NewScanner(input)
+
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines, scanner.Err()
+}
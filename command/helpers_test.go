@@ -2,6 +2,9 @@ package command
 
 import (
 	"fmt"
+	"os"
+	"path"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -59,3 +62,31 @@ func TestParseKeyValuePairs(t *testing.T) {
 	}
 
 }
+
+func TestResolveValues(t *testing.T) {
+	t.Parallel()
+
+	file := path.Join(t.TempDir(), "notes.md")
+	assert.NoError(t, os.WriteFile(file, []byte("from a file"), 0666))
+
+	pairs := map[string]string{
+		"plain":  "value",
+		"file":   "@" + file,
+		"stdin":  "@-",
+		"escape": "@@handle",
+	}
+
+	assert.NoError(t, resolveValues(pairs, strings.NewReader("from stdin")))
+	assert.Equal(t, map[string]string{
+		"plain":  "value",
+		"file":   "from a file",
+		"stdin":  "from stdin",
+		"escape": "@handle",
+	}, pairs)
+
+	err := resolveValues(map[string]string{"one": "@-", "two": "@-"}, strings.NewReader(""))
+	assert.ErrorContains(t, err, "stdin can only be read once")
+
+	err = resolveValues(map[string]string{"missing": "@" + path.Join(t.TempDir(), "nope")}, nil)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
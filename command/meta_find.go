@@ -0,0 +1,87 @@
+package command
+
+import (
+	"cas/config"
+	"cas/localstorage"
+	"cas/tracing"
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+func NewMetaFindCommand(storage localstorage.Storage) *MetaFindCommand {
+	cmd := &MetaFindCommand{
+		storage:    storage,
+		backendCfg: NewBackendConfiguration(),
+	}
+
+	cmd.cfg = append(cmd.cfg, cmd.backendCfg.Flags()...)
+	cmd.cfg = append(cmd.cfg, globalFlags(&cmd.format))
+
+	return cmd
+}
+
+type MetaFindCommand struct {
+	cfg        []*config.ConfigGroup
+	backendCfg *BackendConfiguration
+
+	storage localstorage.Storage
+	format  string
+}
+
+func (c *MetaFindCommand) Synopsis() string {
+	return "Finds hashes which have all the given metadata"
+}
+
+func (c *MetaFindCommand) Usages() []string {
+	return []string{
+		`cas meta find git.sha="${GITHUB_SHA}"`,
+		`cas meta find app=router environment=production --format json`,
+	}
+}
+
+func (c *MetaFindCommand) Configuration() []*config.ConfigGroup {
+	return c.cfg
+}
+
+func (c *MetaFindCommand) RunContext(ctx context.Context, args []string) error {
+	ctx, span := otel.Tracer("meta_find").Start(ctx, "run")
+	defer span.End()
+
+	if len(args) < 1 {
+		return fmt.Errorf("this command takes at least 1 argument: key=value pairs to match")
+	}
+
+	if err := validateFormat(c.format); err != nil {
+		return tracing.Error(span, err)
+	}
+
+	query, err := parseKeyValuePairs(args)
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	backend, err := c.backendCfg.Create(ctx)
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	hashes, err := backend.FindHashes(ctx, query)
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	span.SetAttributes(attribute.Int("found", len(hashes)))
+
+	if c.format == FormatJson {
+		return printJson(hashes)
+	}
+
+	for _, hash := range hashes {
+		fmt.Println(hash)
+	}
+
+	return nil
+}
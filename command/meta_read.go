@@ -0,0 +1,122 @@
+package command
+
+import (
+	"cas/backends"
+	"cas/config"
+	"cas/localstorage"
+	"cas/tracing"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+)
+
+func NewMetaReadCommand(storage localstorage.Storage) *MetaReadCommand {
+	cmd := &MetaReadCommand{
+		storage:    storage,
+		backendCfg: NewBackendConfiguration(),
+	}
+
+	cmd.cfg = append(cmd.cfg, cmd.commandFlags())
+	cmd.cfg = append(cmd.cfg, cmd.backendCfg.Flags()...)
+	cmd.cfg = append(cmd.cfg, globalFlags(&cmd.format))
+
+	return cmd
+}
+
+type MetaReadCommand struct {
+	cfg        []*config.ConfigGroup
+	backendCfg *BackendConfiguration
+
+	storage   localstorage.Storage
+	statePath string
+	format    string
+}
+
+func (c *MetaReadCommand) Synopsis() string {
+	return "Reads metadata for a hash"
+}
+
+func (c *MetaReadCommand) Usages() []string {
+	return []string{
+		`cas meta read "${hash}"`,
+		`cas meta read "${hash}" git.sha environment`,
+		`cas meta read "${hash}" --format json`,
+	}
+}
+
+func (c *MetaReadCommand) commandFlags() *config.ConfigGroup {
+	cfg := config.NewConfigGroup("")
+
+	cfg.StringFlag(&c.statePath, "state-path", "", ".cas/state", "the directory to hold local state")
+
+	return cfg
+}
+
+func (c *MetaReadCommand) Configuration() []*config.ConfigGroup {
+	return c.cfg
+}
+
+func (c *MetaReadCommand) RunContext(ctx context.Context, args []string) error {
+	ctx, span := otel.Tracer("meta_read").Start(ctx, "run")
+	defer span.End()
+
+	if len(args) < 1 {
+		return fmt.Errorf("this command takes at least 1 argument: hash, and keys to read")
+	}
+
+	if err := validateFormat(c.format); err != nil {
+		return tracing.Error(span, err)
+	}
+
+	// we support receiving the hash directly, or the state file path
+	// i.e. makefile using  `cas meta read "$<"`)
+	hash := strings.TrimPrefix(strings.TrimPrefix(args[0], c.statePath), "/")
+
+	// keys can be given as separate arguments, or comma separated
+	keys := []string{}
+	for _, arg := range args[1:] {
+		for _, key := range strings.Split(arg, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	backend, err := c.backendCfg.Create(ctx)
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	_, found, err := backends.ReadTimestamp(ctx, backend, hash)
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	if !found {
+		return tracing.Errorf(span, "hash %s does not exist", hash)
+	}
+
+	meta, err := backend.ReadMetadata(ctx, hash, keys)
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	if c.format == FormatJson {
+		return printJson(meta)
+	}
+
+	names := make([]string, 0, len(meta))
+	for key := range meta {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+
+	for _, key := range names {
+		fmt.Printf("%s=%s\n", key, meta[key])
+	}
+
+	return nil
+}
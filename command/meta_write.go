@@ -0,0 +1,150 @@
+package command
+
+import (
+	"cas/backends"
+	"cas/config"
+	"cas/localstorage"
+	"cas/tracing"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+func NewMetaWriteCommand(storage localstorage.Storage) *MetaWriteCommand {
+	cmd := &MetaWriteCommand{
+		storage:    storage,
+		backendCfg: NewBackendConfiguration(),
+		stdin:      os.Stdin,
+	}
+
+	cmd.cfg = append(cmd.cfg, cmd.commandFlags())
+	cmd.cfg = append(cmd.cfg, cmd.backendCfg.Flags()...)
+	cmd.cfg = append(cmd.cfg, globalFlags(&cmd.format))
+
+	return cmd
+}
+
+type MetaWriteCommand struct {
+	cfg        []*config.ConfigGroup
+	backendCfg *BackendConfiguration
+
+	storage   localstorage.Storage
+	statePath string
+	format    string
+
+	stdin io.Reader
+}
+
+func (c *MetaWriteCommand) Synopsis() string {
+	return "Writes metadata for a hash"
+}
+
+func (c *MetaWriteCommand) Usages() []string {
+	return []string{
+		`cas meta write "${hash}" git.sha="${GITHUB_SHA}" environment=production`,
+		`cas meta write "${hash}" release.notes=@notes.md`,
+		`git log -1 | cas meta write "${hash}" git.message=@-`,
+		`printf "git.sha=%s\n" "${GITHUB_SHA}" | cas meta write "${hash}"`,
+	}
+}
+
+func (c *MetaWriteCommand) commandFlags() *config.ConfigGroup {
+	cfg := config.NewConfigGroup("")
+
+	cfg.StringFlag(&c.statePath, "state-path", "", ".cas/state", "the directory to hold local state")
+
+	return cfg
+}
+
+func (c *MetaWriteCommand) Configuration() []*config.ConfigGroup {
+	return c.cfg
+}
+
+func (c *MetaWriteCommand) RunContext(ctx context.Context, args []string) error {
+	ctx, span := otel.Tracer("meta_write").Start(ctx, "run")
+	defer span.End()
+
+	if len(args) < 1 {
+		return fmt.Errorf("this command takes at least 1 argument: hash, and key=value pairs to write")
+	}
+
+	// we support receiving the hash directly, or the state file path
+	// i.e. makefile using  `cas meta write "$<" key=value`)
+	hash := strings.TrimPrefix(strings.TrimPrefix(args[0], c.statePath), "/")
+	rawPairs := args[1:]
+	stdin := c.stdin
+
+	// with no pairs on the command line, they are read one per line from stdin
+	if len(rawPairs) == 0 {
+		lines, err := readLines(stdin)
+		if err != nil {
+			return tracing.Error(span, err)
+		}
+		rawPairs = lines
+		stdin = nil
+	}
+
+	pairs, err := parseKeyValuePairs(rawPairs)
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	if len(pairs) == 0 {
+		return tracing.Errorf(span, "no key=value pairs were given")
+	}
+
+	for key := range pairs {
+		if isReservedKey(key) {
+			return tracing.Errorf(span, "%s is reserved for cas itself: keys starting with \"@\" or \"cas.\" can't be written", key)
+		}
+	}
+
+	if err := resolveValues(pairs, stdin); err != nil {
+		return tracing.Error(span, err)
+	}
+
+	span.SetAttributes(attribute.Int("pairs", len(pairs)))
+
+	backend, err := c.backendCfg.Create(ctx)
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	_, found, err := backends.ReadTimestamp(ctx, backend, hash)
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	if !found {
+		if err := backends.CreateHash(ctx, backend, hash, time.Now()); err != nil {
+			return tracing.Error(span, err)
+		}
+	}
+
+	keys := make([]string, 0, len(pairs))
+	for key := range pairs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := backend.WriteMetadata(ctx, hash, key, strings.NewReader(pairs[key])); err != nil {
+			return tracing.Error(span, err)
+		}
+	}
+
+	return nil
+}
+
+// isReservedKey is true for keys which cas writes and relies on, such as the artifact manifest,
+// signature and conflicts, which could otherwise be forged or replaced
+func isReservedKey(key string) bool {
+	return strings.HasPrefix(key, "@") || strings.HasPrefix(key, "cas.")
+}
@@ -0,0 +1,86 @@
+package command
+
+import (
+	"cas/backends"
+	"cas/localstorage"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetaWrite(t *testing.T) {
+	cfg := configureTestEnvironment()
+	hash := uuid.New().String()
+
+	write := NewMetaWriteCommand(localstorage.NewMemoryStorage())
+	write.backendCfg = cfg
+	write.stdin = strings.NewReader("abc123")
+
+	err := write.RunContext(context.Background(), []string{hash, "git.sha=@-", "environment=production"})
+	require.NoError(t, err)
+
+	backend, err := cfg.Create(context.Background())
+	require.NoError(t, err)
+
+	_, found, err := backends.ReadTimestamp(context.Background(), backend, hash)
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	meta, err := backend.ReadMetadata(context.Background(), hash, []string{"git.sha", "environment"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"git.sha": "abc123", "environment": "production"}, meta)
+}
+
+func TestMetaWritePairsFromStdin(t *testing.T) {
+	cfg := configureTestEnvironment()
+	hash := uuid.New().String()
+
+	write := NewMetaWriteCommand(localstorage.NewMemoryStorage())
+	write.backendCfg = cfg
+	write.stdin = strings.NewReader("one=first\n\ntwo=second\n")
+
+	require.NoError(t, write.RunContext(context.Background(), []string{hash}))
+
+	backend, err := cfg.Create(context.Background())
+	require.NoError(t, err)
+
+	meta, err := backend.ReadMetadata(context.Background(), hash, []string{"one", "two"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"one": "first", "two": "second"}, meta)
+}
+
+func TestMetaWriteReservedKeys(t *testing.T) {
+	cfg := configureTestEnvironment()
+	hash := uuid.New().String()
+
+	for _, key := range []string{"@artifacts", backends.MetadataTimeStamp, "@signature", "@conflicts", "cas.conflicted"} {
+		write := NewMetaWriteCommand(localstorage.NewMemoryStorage())
+		write.backendCfg = cfg
+
+		err := write.RunContext(context.Background(), []string{hash, key + "=forged", "environment=production"})
+		assert.ErrorContains(t, err, "reserved", key)
+	}
+
+	// nothing was written, not even the hash
+	backend, err := cfg.Create(context.Background())
+	require.NoError(t, err)
+
+	_, found, err := backends.ReadTimestamp(context.Background(), backend, hash)
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestMetaReadMissingHash(t *testing.T) {
+	cfg := configureTestEnvironment()
+
+	read := NewMetaReadCommand(localstorage.NewMemoryStorage())
+	read.backendCfg = cfg
+	read.format = FormatText
+
+	err := read.RunContext(context.Background(), []string{uuid.New().String()})
+	assert.ErrorContains(t, err, "does not exist")
+}
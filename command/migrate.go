@@ -0,0 +1,112 @@
+package command
+
+import (
+	"cas/backends/readonly"
+	"cas/config"
+	"cas/tracing"
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type manifestMigrator interface {
+	ListHashes(ctx context.Context) ([]string, error)
+	MigrateManifest(ctx context.Context, hash string) (bool, error)
+}
+
+func NewMigrateCommand() *MigrateCommand {
+	cmd := &MigrateCommand{
+		backendCfg: NewBackendConfiguration(),
+	}
+
+	cmd.cfg = append(cmd.cfg, cmd.commandFlags())
+	cmd.cfg = append(cmd.cfg, cmd.backendCfg.Flags()...)
+	cmd.cfg = append(cmd.cfg, globalFlags(&cmd.format))
+
+	return cmd
+}
+
+type MigrateCommand struct {
+	cfg        []*config.ConfigGroup
+	backendCfg *BackendConfiguration
+
+	all    bool
+	format string
+}
+
+func (c *MigrateCommand) Synopsis() string {
+	return "Copies hashes' metadata keys into a single manifest per hash, and records the artifacts of older hashes in their artifact manifest"
+}
+
+func (c *MigrateCommand) Usages() []string {
+	return []string{
+		`cas migrate "${hash}"`,
+		`cas migrate --all`,
+	}
+}
+
+func (c *MigrateCommand) commandFlags() *config.ConfigGroup {
+	cfg := config.NewConfigGroup("")
+
+	cfg.BoolFlag(&c.all, "all", "", false, "migrate every hash in the backend")
+
+	return cfg
+}
+
+func (c *MigrateCommand) Configuration() []*config.ConfigGroup {
+	return c.cfg
+}
+
+func (c *MigrateCommand) RunContext(ctx context.Context, args []string) error {
+	ctx, span := otel.Tracer("migrate").Start(ctx, "run")
+	defer span.End()
+
+	if len(args) == 0 && !c.all {
+		return fmt.Errorf("this command takes either hashes to migrate, or --all")
+	}
+
+	if c.backendCfg.readOnly {
+		return tracing.Error(span, readonly.ErrReadOnly)
+	}
+
+	backend, err := c.backendCfg.CreateRemote(ctx)
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	migrator, ok := backend.(manifestMigrator)
+	if !ok {
+		return tracing.Errorf(span, "the %s backend does not support manifests", c.backendCfg.name)
+	}
+
+	hashes := args
+	if c.all {
+		hashes, err = migrator.ListHashes(ctx)
+		if err != nil {
+			return tracing.Error(span, err)
+		}
+	}
+
+	span.SetAttributes(attribute.Int("hashes", len(hashes)))
+
+	migrated := 0
+	for _, hash := range hashes {
+		done, err := migrator.MigrateManifest(ctx, hash)
+		if err != nil {
+			return tracing.Error(span, err)
+		}
+
+		if done {
+			migrated++
+			fmt.Fprintf(os.Stderr, "- %s\n", hash)
+		}
+	}
+
+	span.SetAttributes(attribute.Int("migrated", migrated))
+	fmt.Fprintf(os.Stderr, "Migrated %d of %d hashes\n", migrated, len(hashes))
+
+	return nil
+}
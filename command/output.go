@@ -0,0 +1,28 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+const (
+	FormatText = "text"
+	FormatJson = "json"
+)
+
+func validateFormat(format string) error {
+	switch format {
+	case FormatText, FormatJson:
+		return nil
+	}
+
+	return fmt.Errorf("unsupported format '%s', expected one of: %s, %s", format, FormatText, FormatJson)
+}
+
+func printJson(value any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(value)
+}
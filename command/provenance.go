@@ -0,0 +1,160 @@
+package command
+
+import (
+	"bytes"
+	"cas/backends"
+	"cas/backends/signing"
+	"cas/config"
+	"cas/localstorage"
+	"cas/provenance"
+	"cas/tracing"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+)
+
+func NewProvenanceCommand(storage localstorage.Storage) *ProvenanceCommand {
+	cmd := &ProvenanceCommand{
+		storage:    storage,
+		backendCfg: NewBackendConfiguration(),
+		stdout:     os.Stdout,
+	}
+
+	cmd.cfg = append(cmd.cfg, cmd.commandFlags())
+	cmd.cfg = append(cmd.cfg, cmd.backendCfg.Flags()...)
+	cmd.cfg = append(cmd.cfg, globalFlags(&cmd.format))
+
+	return cmd
+}
+
+type ProvenanceCommand struct {
+	cfg        []*config.ConfigGroup
+	backendCfg *BackendConfiguration
+
+	storage   localstorage.Storage
+	statePath string
+	format    string
+	verify    bool
+
+	stdout io.Writer
+}
+
+type provenanceResult struct {
+	Hash     string `json:"hash"`
+	Subjects int    `json:"subjects"`
+	Signed   bool   `json:"signed"`
+}
+
+func (c *ProvenanceCommand) Synopsis() string {
+	return "Prints or verifies the provenance of a hash's artifacts"
+}
+
+func (c *ProvenanceCommand) Usages() []string {
+	return []string{
+		`cas provenance "${hash}"`,
+		`cas provenance "${hash}" --verify`,
+	}
+}
+
+func (c *ProvenanceCommand) commandFlags() *config.ConfigGroup {
+	cfg := config.NewConfigGroup("")
+
+	cfg.StringFlag(&c.statePath, "state-path", "", ".cas/state", "the directory to hold local state")
+	cfg.BoolFlag(&c.verify, "verify", "", false, "check the provenance matches the hash's artifacts, and its signature if trusted keys are configured")
+
+	return cfg
+}
+
+func (c *ProvenanceCommand) Configuration() []*config.ConfigGroup {
+	return c.cfg
+}
+
+func (c *ProvenanceCommand) RunContext(ctx context.Context, args []string) error {
+	ctx, span := otel.Tracer("provenance").Start(ctx, "run")
+	defer span.End()
+
+	if len(args) != 1 {
+		return fmt.Errorf("this command takes exactly 1 argument: hash")
+	}
+
+	if err := validateFormat(c.format); err != nil {
+		return tracing.Error(span, err)
+	}
+
+	// we support receiving the hash directly, or the state file path
+	// i.e. makefile using  `cas provenance "$<"`)
+	hash := strings.TrimPrefix(strings.TrimPrefix(args[0], c.statePath), "/")
+
+	backend, err := c.backendCfg.Create(ctx)
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	statement, content, found, err := provenance.Read(ctx, backend, hash)
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	if !found {
+		return tracing.Errorf(span, "hash %s has no provenance", hash)
+	}
+
+	if !c.verify {
+		// the statement is printed as stored, as it is json in either format
+		indented := &bytes.Buffer{}
+		if err := json.Indent(indented, content, "", "  "); err != nil {
+			return tracing.Error(span, err)
+		}
+
+		fmt.Fprintln(c.stdout, indented.String())
+		return nil
+	}
+
+	manifest, _, err := backends.ReadArtifactManifest(ctx, backend, hash)
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	if err := statement.Verify(hash, manifest); err != nil {
+		return tracing.Error(span, err)
+	}
+
+	trusted, err := c.backendCfg.TrustList()
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	// the signature covers @provenance, so a verified signature means a trusted key wrote it
+	if trusted != nil {
+		if err := signing.Verify(ctx, backend, hash, trusted); err != nil {
+			return tracing.Error(span, err)
+		}
+	}
+
+	result := provenanceResult{
+		Hash:     hash,
+		Subjects: len(statement.Subject),
+		Signed:   trusted != nil,
+	}
+
+	if c.format == FormatJson {
+		encoder := json.NewEncoder(c.stdout)
+		encoder.SetIndent("", "  ")
+
+		return encoder.Encode(result)
+	}
+
+	signed := ""
+	if result.Signed {
+		signed = ", and is signed by a trusted key"
+	}
+
+	fmt.Fprintf(c.stdout, "provenance of %s matches its %d artifacts%s\n", hash, result.Subjects, signed)
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package command
+
+import (
+	"bytes"
+	"cas/localstorage"
+	"cas/provenance"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/cli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProvenance(t *testing.T) {
+	cfg := configureTestEnvironment()
+	hash := uuid.New().String()
+
+	backend, err := cfg.Create(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, backend.WriteMetadata(context.Background(), hash, "@debug/hashes", strings.NewReader("aaaa src/main.go\n")))
+
+	source := localstorage.NewMemoryStorage()
+	source.WriteFile(context.Background(), "dist/app", time.Now(), strings.NewReader("app "+hash))
+
+	push := NewArtifactPushCommand(cli.NewMockUi(), source)
+	push.backendCfg = cfg
+	push.provenance = true
+	require.NoError(t, push.RunContext(context.Background(), []string{hash, "dist/app"}))
+
+	stdout := &bytes.Buffer{}
+	cmd := NewProvenanceCommand(localstorage.NewMemoryStorage())
+	cmd.backendCfg = cfg
+	cmd.stdout = stdout
+	cmd.format = FormatText
+	require.NoError(t, cmd.RunContext(context.Background(), []string{hash}))
+
+	statement := provenance.Statement{}
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &statement))
+	assert.Equal(t, provenance.PredicateType, statement.PredicateType)
+	require.Len(t, statement.Subject, 1)
+	assert.Equal(t, "dist/app", statement.Subject[0].Name)
+	assert.Equal(t, "src/main.go", statement.Predicate.BuildDefinition.ResolvedDependencies[0].Name)
+
+	stdout.Reset()
+	cmd.verify = true
+	require.NoError(t, cmd.RunContext(context.Background(), []string{hash}))
+	assert.Equal(t, "provenance of "+hash+" matches its 1 artifacts\n", stdout.String())
+
+	// pushing another artifact without provenance makes it stale
+	source.WriteFile(context.Background(), "dist/other", time.Now(), strings.NewReader("other "+hash))
+	push.provenance = false
+	require.NoError(t, push.RunContext(context.Background(), []string{hash, "dist/other"}))
+
+	assert.ErrorContains(t, cmd.RunContext(context.Background(), []string{hash}), "no subject for dist/other")
+
+	missing := uuid.New().String()
+	assert.ErrorContains(t, cmd.RunContext(context.Background(), []string{missing}), "has no provenance")
+}
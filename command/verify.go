@@ -0,0 +1,187 @@
+package command
+
+import (
+	"cas/backends"
+	"cas/backends/cache"
+	"cas/config"
+	"cas/localstorage"
+	"cas/tracing"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	VerifyOk         = "ok"
+	VerifyCorrupt    = "corrupt"
+	VerifyUnreadable = "unreadable"
+	VerifyNotCached  = "not-cached"
+)
+
+func NewVerifyCommand(storage localstorage.Storage) *VerifyCommand {
+	cmd := &VerifyCommand{
+		storage:    storage,
+		backendCfg: NewBackendConfiguration(),
+	}
+
+	cmd.cfg = append(cmd.cfg, cmd.commandFlags())
+	cmd.cfg = append(cmd.cfg, cmd.backendCfg.Flags()...)
+	cmd.cfg = append(cmd.cfg, globalFlags(&cmd.format))
+
+	return cmd
+}
+
+type VerifyCommand struct {
+	cfg        []*config.ConfigGroup
+	backendCfg *BackendConfiguration
+
+	storage   localstorage.Storage
+	statePath string
+	format    string
+}
+
+type verifyResult struct {
+	Path   string `json:"path"`
+	Digest string `json:"digest"`
+	Remote string `json:"remote"`
+	Local  string `json:"local"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (r verifyResult) failed() bool {
+	return r.Remote != VerifyOk || r.Local == VerifyCorrupt
+}
+
+func (c *VerifyCommand) Synopsis() string {
+	return "Checks the remote and cached copies of a hash's artifacts against their digests"
+}
+
+func (c *VerifyCommand) Usages() []string {
+	return []string{
+		`cas verify "${hash}"`,
+		`cas verify "${hash}" --format json`,
+	}
+}
+
+func (c *VerifyCommand) commandFlags() *config.ConfigGroup {
+	cfg := config.NewConfigGroup("")
+
+	cfg.StringFlag(&c.statePath, "state-path", "", ".cas/state", "the directory to hold local state")
+
+	return cfg
+}
+
+func (c *VerifyCommand) Configuration() []*config.ConfigGroup {
+	return c.cfg
+}
+
+func (c *VerifyCommand) RunContext(ctx context.Context, args []string) error {
+	ctx, span := otel.Tracer("verify").Start(ctx, "run")
+	defer span.End()
+
+	if len(args) != 1 {
+		return fmt.Errorf("this command takes exactly 1 argument: hash")
+	}
+
+	if err := validateFormat(c.format); err != nil {
+		return tracing.Error(span, err)
+	}
+
+	// we support receiving the hash directly, or the state file path
+	// i.e. makefile using  `cas verify "$<"`)
+	hash := strings.TrimPrefix(strings.TrimPrefix(args[0], c.statePath), "/")
+
+	// the remote copies are read directly, so that the cache can't hide their corruption
+	remote, err := c.backendCfg.CreateRemote(ctx)
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	local := cache.NewCachedBackend(remote, c.backendCfg.concurrency)
+
+	manifest, found, err := backends.ReadArtifactManifest(ctx, remote, hash)
+	if err != nil {
+		return tracing.Error(span, err)
+	}
+
+	if !found {
+		return tracing.Errorf(span, "hash %s has no artifacts", hash)
+	}
+
+	results := make([]verifyResult, 0, len(manifest))
+	failures := 0
+
+	for _, name := range manifest.Paths() {
+		result := verifyResult{
+			Path:   name,
+			Digest: manifest[name].Digest,
+			Remote: VerifyOk,
+			Local:  VerifyOk,
+		}
+
+		if err := verifyRemote(ctx, remote, hash, name); err != nil {
+			var mismatch *backends.DigestError
+			if errors.As(err, &mismatch) {
+				result.Remote = VerifyCorrupt
+			} else {
+				result.Remote = VerifyUnreadable
+			}
+			result.Error = err.Error()
+		}
+
+		digest, cached, err := local.CachedDigest(hash, name)
+		if err != nil {
+			return tracing.Error(span, err)
+		}
+
+		if !cached {
+			result.Local = VerifyNotCached
+		} else if digest != result.Digest {
+			result.Local = VerifyCorrupt
+		}
+
+		if result.failed() {
+			failures++
+		}
+
+		results = append(results, result)
+	}
+
+	span.SetAttributes(
+		attribute.Int("artifacts", len(results)),
+		attribute.Int("failures", failures),
+	)
+
+	if c.format == FormatJson {
+		if err := printJson(results); err != nil {
+			return tracing.Error(span, err)
+		}
+	} else {
+		for _, result := range results {
+			fmt.Printf("%s remote=%s local=%s\n", result.Path, result.Remote, result.Local)
+		}
+	}
+
+	if failures > 0 {
+		return tracing.Errorf(span, "%d of %d artifacts in %s failed verification", failures, len(results), hash)
+	}
+
+	return nil
+}
+
+// verifyRemote reads the whole artifact, which checks its digest
+func verifyRemote(ctx context.Context, backend backends.Backend, hash string, name string) error {
+	file, err := backend.FetchArtifact(ctx, hash, name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(io.Discard, file.Content)
+	return err
+}
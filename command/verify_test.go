@@ -0,0 +1,98 @@
+package command
+
+import (
+	"bytes"
+	"cas/backends"
+	"cas/localstorage"
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/cli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	cfg := configureTestEnvironment()
+	hash := uuid.New().String()
+
+	source := localstorage.NewMemoryStorage()
+	source.WriteFile(context.Background(), "dist/app", time.Now(), strings.NewReader("the real content"))
+
+	push := NewArtifactPushCommand(cli.NewMockUi(), source)
+	push.backendCfg = cfg
+	require.NoError(t, push.RunContext(context.Background(), []string{hash, "dist/app"}))
+
+	verify := NewVerifyCommand(localstorage.NewMemoryStorage())
+	verify.backendCfg = cfg
+	assert.NoError(t, verify.RunContext(context.Background(), []string{hash}))
+
+	// fill the cache, then corrupt it
+	cat := NewArtifactCatCommand(localstorage.NewMemoryStorage())
+	cat.backendCfg = cfg
+	cat.stdout = &bytes.Buffer{}
+	require.NoError(t, cat.RunContext(context.Background(), []string{hash, "dist/app"}))
+
+	cachePath := path.Join(".cas/cache", hash, "dist/app")
+	require.NoError(t, os.WriteFile(cachePath, []byte("corrupted"), 0644))
+
+	err := verify.RunContext(context.Background(), []string{hash})
+	assert.ErrorContains(t, err, "1 of 1 artifacts")
+
+	// fetching replaces the corrupt cached copy
+	stdout := &bytes.Buffer{}
+	cat.stdout = stdout
+	require.NoError(t, cat.RunContext(context.Background(), []string{hash, "dist/app"}))
+	assert.Equal(t, "the real content", stdout.String())
+
+	assert.NoError(t, verify.RunContext(context.Background(), []string{hash}))
+}
+
+func TestCachedArtifactRemovedFromManifest(t *testing.T) {
+	cfg := configureTestEnvironment()
+	hash := uuid.New().String()
+
+	pushTestHash(t, cfg, hash, map[string]string{"dist/app": "the app", "dist/old": "the old file"})
+	assert.Equal(t, "the old file", catArtifact(t, cfg, hash, "dist/old"))
+
+	// the digest is recorded when the file is cached, so it isn't hashed on every fetch
+	cachePath := path.Join(".cas/cache", hash, "dist/old")
+	assert.FileExists(t, cachePath)
+	assert.FileExists(t, path.Join(".cas/cache/@digests", hash, "dist/old.json"))
+
+	// the hash's manifest no longer has the artifact
+	remote, err := cfg.CreateRemote(context.Background())
+	require.NoError(t, err)
+
+	manifest, _, err := backends.ReadArtifactManifest(context.Background(), remote, hash)
+	require.NoError(t, err)
+	delete(manifest, "dist/old")
+
+	content, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	require.NoError(t, remote.WriteMetadata(context.Background(), hash, backends.MetadataArtifacts, bytes.NewReader(content)))
+
+	cat := NewArtifactCatCommand(localstorage.NewMemoryStorage())
+	cat.backendCfg = cfg
+	cat.stdout = &bytes.Buffer{}
+
+	err = cat.RunContext(context.Background(), []string{hash, "dist/old"})
+	assert.ErrorContains(t, err, "does not exist")
+	assert.NoFileExists(t, cachePath)
+}
+
+func TestVerifyMissingHash(t *testing.T) {
+	cfg := configureTestEnvironment()
+
+	verify := NewVerifyCommand(localstorage.NewMemoryStorage())
+	verify.backendCfg = cfg
+
+	err := verify.RunContext(context.Background(), []string{uuid.New().String()})
+	assert.ErrorContains(t, err, "has no artifacts")
+}
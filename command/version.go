@@ -14,7 +14,7 @@ func NewVersionCommand() *VersionCommand {
 	cmd := &VersionCommand{}
 
 	cmd.cfg = append(cmd.cfg, cmd.commandFlags())
-	cmd.cfg = append(cmd.cfg, globalFlags())
+	cmd.cfg = append(cmd.cfg, globalFlags(&cmd.format))
 
 	return cmd
 }
@@ -25,6 +25,7 @@ type VersionCommand struct {
 	printLog bool
 	rawLog   bool
 	short    bool
+	format   string
 }
 
 func (c *VersionCommand) Name() string {
@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/spf13/pflag"
 	"go.opentelemetry.io/otel"
@@ -38,6 +39,23 @@ func (fg *ConfigGroup) BoolFlag(target *bool, flagName string, envVarName string
 	fg.environment[flagName] = envVarName
 }
 
+func (fg *ConfigGroup) IntFlag(target *int, flagName string, envVarName string, defaultValue int, usage string) {
+	fg.flags.IntVar(target, flagName, defaultValue, usage)
+	fg.environment[flagName] = envVarName
+}
+
+// SizeFlag is a number of bytes, which can be given with a unit such as `16MiB`
+func (fg *ConfigGroup) SizeFlag(target *int64, flagName string, envVarName string, defaultValue int64, usage string) {
+	*target = defaultValue
+	fg.flags.Var(&sizeValue{target: target}, flagName, usage)
+	fg.environment[flagName] = envVarName
+}
+
+func (fg *ConfigGroup) DurationFlag(target *time.Duration, flagName string, envVarName string, defaultValue time.Duration, usage string) {
+	fg.flags.DurationVar(target, flagName, defaultValue, usage)
+	fg.environment[flagName] = envVarName
+}
+
 func (fg *ConfigGroup) Usages() []string {
 	lines := []string{}
 
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var sizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"KB", 1000},
+	{"MB", 1000 * 1000},
+	{"GB", 1000 * 1000 * 1000},
+	{"B", 1},
+}
+
+// ParseSize parses a number of bytes, with an optional unit such as `16MiB` or `1GB`
+func ParseSize(value string) (int64, error) {
+	trimmed := strings.TrimSpace(value)
+	multiplier := int64(1)
+
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(strings.ToUpper(trimmed), strings.ToUpper(unit.suffix)) {
+			trimmed = strings.TrimSpace(trimmed[:len(trimmed)-len(unit.suffix)])
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	number, err := strconv.ParseInt(trimmed, 10, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size '%s', expected a number of bytes such as 1048576, 1024KiB or 1MiB", value)
+	}
+
+	return number * multiplier, nil
+}
+
+// FormatSize prints a size with the largest binary unit which divides it exactly
+func FormatSize(size int64) string {
+	for i := 2; i >= 0; i-- {
+		unit := sizeUnits[i]
+		if size >= unit.multiplier && size%unit.multiplier == 0 {
+			return fmt.Sprintf("%d%s", size/unit.multiplier, unit.suffix)
+		}
+	}
+
+	return strconv.FormatInt(size, 10)
+}
+
+type sizeValue struct {
+	target *int64
+}
+
+func (v *sizeValue) String() string {
+	if v.target == nil {
+		return ""
+	}
+	return FormatSize(*v.target)
+}
+
+func (v *sizeValue) Set(value string) error {
+	size, err := ParseSize(value)
+	if err != nil {
+		return err
+	}
+
+	*v.target = size
+	return nil
+}
+
+func (v *sizeValue) Type() string {
+	return "size"
+}
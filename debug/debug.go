@@ -119,3 +119,19 @@ func MarshalIntermediates(hashes []hashing.FileHash) []byte {
 
 	return []byte(sb.String())
 }
+
+// UnmarshalIntermediates reads the hashes written by MarshalIntermediates
+func UnmarshalIntermediates(content []byte) []hashing.FileHash {
+	hashes := []hashing.FileHash{}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		hash, filePath, found := strings.Cut(line, " ")
+		if !found {
+			continue
+		}
+
+		hashes = append(hashes, hashing.FileHash{Hash: hash, Path: filePath})
+	}
+
+	return hashes
+}
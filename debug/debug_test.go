@@ -1,6 +1,7 @@
 package debug
 
 import (
+	"cas/hashing"
 	"io"
 	"os"
 	"testing"
@@ -25,3 +26,12 @@ func TestWritingAndReading(t *testing.T) {
 	content, _ := io.ReadAll(all["hashes"])
 	require.Equal(t, "content", string(content))
 }
+
+func TestIntermediatesRoundTrip(t *testing.T) {
+	hashes := []hashing.FileHash{
+		{Path: "src/main.go", Hash: "aaaa"},
+		{Path: "src/with space.go", Hash: "bbbb"},
+	}
+
+	require.Equal(t, hashes, UnmarshalIntermediates(MarshalIntermediates(hashes)))
+}
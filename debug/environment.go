@@ -1,6 +1,7 @@
 package debug
 
 import (
+	"encoding/json"
 	"os"
 	"strings"
 
@@ -40,3 +41,39 @@ func EnvironmentData() []attribute.KeyValue {
 
 	return nil
 }
+
+// IsForkPullRequest is true when running for a pull request from a fork in github actions.  If
+// the event can't be read, it is assumed to be from a fork.
+func IsForkPullRequest() bool {
+	if os.Getenv("GITHUB_ACTIONS") != "true" || !strings.HasPrefix(os.Getenv("GITHUB_EVENT_NAME"), "pull_request") {
+		return false
+	}
+
+	content, err := os.ReadFile(os.Getenv("GITHUB_EVENT_PATH"))
+	if err != nil {
+		return true
+	}
+
+	event := struct {
+		PullRequest *struct {
+			Head struct {
+				Repo *struct {
+					FullName string `json:"full_name"`
+					Fork     bool   `json:"fork"`
+				} `json:"repo"`
+			} `json:"head"`
+		} `json:"pull_request"`
+	}{}
+
+	if err := json.Unmarshal(content, &event); err != nil || event.PullRequest == nil {
+		return true
+	}
+
+	// the head repository is missing when the fork has been deleted
+	head := event.PullRequest.Head.Repo
+	if head == nil {
+		return true
+	}
+
+	return head.Fork || head.FullName != os.Getenv("GITHUB_REPOSITORY")
+}
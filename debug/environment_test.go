@@ -0,0 +1,42 @@
+package debug
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsForkPullRequest(t *testing.T) {
+	t.Setenv("GITHUB_ACTIONS", "true")
+	t.Setenv("GITHUB_REPOSITORY", "org/repo")
+
+	writeEvent := func(content string) {
+		eventPath := filepath.Join(t.TempDir(), "event.json")
+		require.NoError(t, os.WriteFile(eventPath, []byte(content), 0666))
+		t.Setenv("GITHUB_EVENT_PATH", eventPath)
+	}
+
+	t.Setenv("GITHUB_EVENT_NAME", "push")
+	writeEvent(`{}`)
+	assert.False(t, IsForkPullRequest())
+
+	t.Setenv("GITHUB_EVENT_NAME", "pull_request")
+
+	writeEvent(`{"pull_request": {"head": {"repo": {"full_name": "org/repo", "fork": false}}}}`)
+	assert.False(t, IsForkPullRequest())
+
+	writeEvent(`{"pull_request": {"head": {"repo": {"full_name": "someone/repo", "fork": true}}}}`)
+	assert.True(t, IsForkPullRequest())
+
+	writeEvent(`{"pull_request": {"head": {"repo": null}}}`)
+	assert.True(t, IsForkPullRequest())
+
+	t.Setenv("GITHUB_EVENT_PATH", filepath.Join(t.TempDir(), "missing.json"))
+	assert.True(t, IsForkPullRequest())
+
+	t.Setenv("GITHUB_ACTIONS", "")
+	assert.False(t, IsForkPullRequest())
+}
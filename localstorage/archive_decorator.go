@@ -90,11 +90,22 @@ func (a *ArchiveDecorator) ReadFile(ctx context.Context, p string) (*LocalFile,
 		header := &tar.Header{
 			Name:     strings.TrimPrefix(file, dirPath),
 			ModTime:  time.Time{},
-			Mode:     int64(0),
+			Mode:     int64(descriptor.Mode.Perm()),
 			Typeflag: tar.TypeReg,
 			Size:     int64(len(content)), // fix this later to handle things bigger than int
 		}
 
+		switch {
+		case descriptor.Mode&os.ModeSymlink != 0:
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = string(content)
+			header.Size = 0
+			content = nil
+		case descriptor.Mode.IsDir():
+			header.Typeflag = tar.TypeDir
+			header.Size = 0
+		}
+
 		if err := archive.WriteHeader(header); err != nil {
 			return nil, tracing.Error(span, err)
 		}
@@ -121,13 +132,17 @@ func (a *ArchiveDecorator) ReadFile(ctx context.Context, p string) (*LocalFile,
 }
 
 func (a *ArchiveDecorator) WriteFile(ctx context.Context, p string, timestamp time.Time, content io.Reader) error {
+	return a.WriteEntry(ctx, p, timestamp, 0, content)
+}
+
+func (a *ArchiveDecorator) WriteEntry(ctx context.Context, p string, timestamp time.Time, mode os.FileMode, content io.Reader) error {
 	ctx, span := archiveTrace.Start(ctx, "write")
 	defer span.End()
 
 	name := path.Base(p)
 
 	if name != a.Marker {
-		return a.Wrapped.WriteFile(ctx, p, timestamp, content)
+		return a.Wrapped.WriteEntry(ctx, p, timestamp, mode, content)
 	}
 
 	archive := tar.NewReader(content)
@@ -145,7 +160,18 @@ func (a *ArchiveDecorator) WriteFile(ctx context.Context, p string, timestamp ti
 
 		filepath := path.Join(root, header.Name)
 
-		if err := a.Wrapped.WriteFile(ctx, filepath, timestamp, archive); err != nil {
+		var entry io.Reader = archive
+		if header.Typeflag == tar.TypeSymlink {
+			entry = strings.NewReader(header.Linkname)
+		}
+
+		// archives written by older versions have no permissions, so are written with the defaults
+		mode := header.FileInfo().Mode()
+		if mode.Perm() == 0 {
+			mode = mode.Type()
+		}
+
+		if err := a.Wrapped.WriteEntry(ctx, filepath, timestamp, mode, entry); err != nil {
 			return err
 		}
 	}
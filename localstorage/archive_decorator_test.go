@@ -2,6 +2,7 @@ package localstorage
 
 import (
 	"context"
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -36,3 +37,28 @@ func TestArchiving(t *testing.T) {
 
 	assert.Contains(t, dest.Store, "test/.archive")
 }
+
+func TestArchivingModes(t *testing.T) {
+	ctx := context.Background()
+
+	source := NewMemoryStorage()
+	source.WriteEntry(ctx, "test/bin/tool", time.Now(), 0755, strings.NewReader("#!/bin/sh"))
+	source.WriteEntry(ctx, "test/bin/link", time.Now(), os.ModeSymlink|0777, strings.NewReader("tool"))
+	source.WriteEntry(ctx, "test/empty", time.Now(), os.ModeDir|0755, strings.NewReader(""))
+
+	wrapper := ArchiveDecorator{Wrapped: source, Marker: ".archive"}
+
+	content, err := wrapper.ReadFile(ctx, "test/.archive")
+	assert.NoError(t, err)
+
+	dest := NewMemoryStorage()
+	wrapper.Wrapped = dest
+
+	err = wrapper.WriteFile(ctx, "test/.archive", time.Now(), content.Content)
+	assert.NoError(t, err)
+
+	assert.Equal(t, os.FileMode(0755), dest.Modes["test/bin/tool"])
+	assert.Equal(t, os.ModeSymlink|0777, dest.Modes["test/bin/link"])
+	assert.Equal(t, []byte("tool"), dest.Store["test/bin/link"])
+	assert.Equal(t, os.ModeDir|0755, dest.Modes["test/empty"])
+}
@@ -1,8 +1,10 @@
 package localstorage
 
 import (
+	"bytes"
 	"cas/tracing"
 	"context"
+	"errors"
 	"io"
 	"os"
 	"path"
@@ -45,6 +47,7 @@ func scanDir(ctx context.Context, files *[]string, dirPath string) error {
 
 	for _, file := range contents {
 
+		// symlinks to directories aren't followed, they are stored as links
 		if file.IsDir() {
 			scanDir(ctx, files, path.Join(dirPath, file.Name()))
 
@@ -55,6 +58,11 @@ func scanDir(ctx context.Context, files *[]string, dirPath string) error {
 
 	}
 
+	// empty directories are listed themselves, so that they can be recreated
+	if len(contents) == 0 {
+		*files = append(*files, dirPath)
+	}
+
 	return nil
 }
 
@@ -62,6 +70,34 @@ func (fs *FileStore) ReadFile(ctx context.Context, p string) (*LocalFile, error)
 	ctx, span := fsTrace.Start(ctx, "read")
 	defer span.End()
 
+	info, err := os.Lstat(p)
+	if err != nil {
+		return nil, tracing.Error(span, err)
+	}
+
+	span.SetAttributes(attribute.String("mode", info.Mode().String()))
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(p)
+		if err != nil {
+			return nil, tracing.Error(span, err)
+		}
+
+		return &LocalFile{
+			Path:    p,
+			Content: &closableBuffer{Reader: bytes.NewReader([]byte(target))},
+			Mode:    info.Mode(),
+		}, nil
+
+	case info.IsDir():
+		return &LocalFile{
+			Path:    p,
+			Content: &closableBuffer{Reader: bytes.NewReader(nil)},
+			Mode:    info.Mode(),
+		}, nil
+	}
+
 	content, err := os.Open(p)
 	if err != nil {
 		return nil, tracing.Error(span, err)
@@ -70,34 +106,82 @@ func (fs *FileStore) ReadFile(ctx context.Context, p string) (*LocalFile, error)
 	return &LocalFile{
 		Path:    p,
 		Content: content,
-	}, err
+		Mode:    info.Mode(),
+	}, nil
 }
 
 func (fs *FileStore) WriteFile(ctx context.Context, p string, timestamp time.Time, content io.Reader) error {
+	return fs.WriteEntry(ctx, p, timestamp, 0, content)
+}
+
+func (fs *FileStore) WriteEntry(ctx context.Context, p string, timestamp time.Time, mode os.FileMode, content io.Reader) error {
 	ctx, span := fsTrace.Start(ctx, "write")
 	defer span.End()
 
+	span.SetAttributes(attribute.String("mode", mode.String()))
+
 	if err := os.MkdirAll(path.Dir(p), os.ModePerm); err != nil {
 		return tracing.Error(span, err)
 	}
 
+	switch {
+	case mode&os.ModeSymlink != 0:
+		target, err := io.ReadAll(content)
+		if err != nil {
+			return tracing.Error(span, err)
+		}
+
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return tracing.Error(span, err)
+		}
+
+		// symlinks keep the time they are created, as changing it needs lutimes
+		if err := os.Symlink(string(target), p); err != nil {
+			return tracing.Error(span, err)
+		}
+
+		return nil
+
+	case mode.IsDir():
+		perm := mode.Perm()
+		if perm == 0 {
+			perm = os.ModePerm
+		}
+
+		if err := os.MkdirAll(p, perm); err != nil {
+			return tracing.Error(span, err)
+		}
+
+	default:
+		if err := writeRegularFile(p, mode, content); err != nil {
+			return tracing.Error(span, err)
+		}
+	}
+
+	if err := os.Chtimes(p, timestamp, timestamp); err != nil {
+		return tracing.Error(span, err)
+	}
+
+	return nil
+}
+
+func writeRegularFile(p string, mode os.FileMode, content io.Reader) error {
 	f, err := os.Create(p)
 	if err != nil {
-		return tracing.Error(span, err)
+		return err
 	}
 	defer f.Close()
 
 	if _, err := io.Copy(f, content); err != nil {
-		return tracing.Error(span, err)
+		return err
 	}
 
-	if err := f.Close(); err != nil {
-		return tracing.Error(span, err)
-	}
-
-	if err := os.Chtimes(p, timestamp, timestamp); err != nil {
-		return tracing.Error(span, err)
+	// files written by older versions have no mode, so get the default from os.Create
+	if mode != 0 {
+		if err := f.Chmod(mode.Perm()); err != nil {
+			return err
+		}
 	}
 
-	return nil
+	return f.Close()
 }
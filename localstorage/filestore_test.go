@@ -2,9 +2,15 @@ package localstorage
 
 import (
 	"context"
+	"io"
+	"os"
+	"path"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestListingFiles(t *testing.T) {
@@ -23,3 +29,41 @@ func TestListingFiles(t *testing.T) {
 
 	assert.Equal(t, expected, files)
 }
+
+func TestFileStoreModesAndLinks(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	now := time.Now().Truncate(time.Second)
+
+	fs := &FileStore{}
+
+	require.NoError(t, fs.WriteEntry(ctx, path.Join(root, "bin/tool"), now, 0755, strings.NewReader("#!/bin/sh")))
+	require.NoError(t, fs.WriteEntry(ctx, path.Join(root, "bin/link"), now, os.ModeSymlink|0777, strings.NewReader("tool")))
+	require.NoError(t, fs.WriteEntry(ctx, path.Join(root, "empty"), now, os.ModeDir|0750, strings.NewReader("")))
+
+	tool, err := fs.ReadFile(ctx, path.Join(root, "bin/tool"))
+	require.NoError(t, err)
+	defer tool.Close()
+	assert.Equal(t, os.FileMode(0755), tool.Mode)
+
+	link, err := fs.ReadFile(ctx, path.Join(root, "bin/link"))
+	require.NoError(t, err)
+	defer link.Close()
+	assert.Equal(t, os.ModeSymlink, link.Mode.Type())
+
+	target, _ := io.ReadAll(link.Content)
+	assert.Equal(t, "tool", string(target))
+
+	empty, err := fs.ReadFile(ctx, path.Join(root, "empty"))
+	require.NoError(t, err)
+	defer empty.Close()
+	assert.True(t, empty.Mode.IsDir())
+
+	files, err := fs.ListFiles(ctx, root)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		path.Join(root, "bin/link"),
+		path.Join(root, "bin/tool"),
+		path.Join(root, "empty"),
+	}, files)
+}
@@ -22,12 +22,14 @@ func (b *closableBuffer) Close() error {
 type MemoryStorage struct {
 	Store    map[string][]byte
 	Modified map[string]time.Time
+	Modes    map[string]os.FileMode
 }
 
 func NewMemoryStorage() *MemoryStorage {
 	return &MemoryStorage{
 		Store:    map[string][]byte{},
 		Modified: map[string]time.Time{},
+		Modes:    map[string]os.FileMode{},
 	}
 }
 
@@ -56,6 +58,7 @@ func (m *MemoryStorage) ReadFile(ctx context.Context, p string) (*LocalFile, err
 		return &LocalFile{
 			Path:    p,
 			Content: &closableBuffer{Reader: bytes.NewReader(content)},
+			Mode:    m.Modes[p],
 		}, nil
 	}
 
@@ -63,6 +66,10 @@ func (m *MemoryStorage) ReadFile(ctx context.Context, p string) (*LocalFile, err
 }
 
 func (m *MemoryStorage) WriteFile(ctx context.Context, path string, timestamp time.Time, content io.Reader) error {
+	return m.WriteEntry(ctx, path, timestamp, 0, content)
+}
+
+func (m *MemoryStorage) WriteEntry(ctx context.Context, path string, timestamp time.Time, mode os.FileMode, content io.Reader) error {
 	b, err := ioutil.ReadAll(content)
 	if err != nil {
 		return err
@@ -70,6 +77,7 @@ func (m *MemoryStorage) WriteFile(ctx context.Context, path string, timestamp ti
 
 	m.Store[path] = b
 	m.Modified[path] = timestamp
+	m.Modes[path] = mode
 
 	return nil
 }
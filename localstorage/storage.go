@@ -4,6 +4,7 @@ import (
 	"cas/tracing"
 	"context"
 	"io"
+	"os"
 	"time"
 
 	"go.opentelemetry.io/otel"
@@ -16,6 +17,10 @@ type ReadableStorage interface {
 
 type WritableStorage interface {
 	WriteFile(ctx context.Context, path string, timestamp time.Time, content io.Reader) error
+
+	// WriteEntry writes a file with the given mode.  For symlinks the content is the link's
+	// target, and directories have no content.  A zero mode is written as a regular file.
+	WriteEntry(ctx context.Context, path string, timestamp time.Time, mode os.FileMode, content io.Reader) error
 }
 
 type Storage interface {
@@ -23,9 +28,19 @@ type Storage interface {
 	WritableStorage
 }
 
+// LocalFile is a file to be stored.  Content which is also an io.Seeker can be read more than
+// once, otherwise it is treated as a stream, such as stdin.
 type LocalFile struct {
 	Path    string
-	Content io.ReadSeekCloser
+	Content io.ReadCloser
+
+	// Mode is the file's type and permissions, or zero if they are unknown.  Symlinks have
+	// their target as their content, and directories have no content.
+	Mode os.FileMode
+
+	// Metadata is stored with the artifact by backends which support it, such as the id of the
+	// key it was encrypted with
+	Metadata map[string]string
 }
 
 func (lf *LocalFile) Close() error {
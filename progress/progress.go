@@ -0,0 +1,357 @@
+package progress
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/cli"
+	"github.com/mattn/go-isatty"
+)
+
+// Action names what is being transferred, while it runs and once it is done
+type Action struct {
+	Running string
+	Done    string
+}
+
+var (
+	Push  = Action{Running: "Pushing", Done: "Pushed"}
+	Pull  = Action{Running: "Pulling", Done: "Pulled"}
+	Fetch = Action{Running: "Fetching", Done: "Fetched"}
+)
+
+// how often the progress line is redrawn
+const renderInterval = 200 * time.Millisecond
+
+// IsTerminal is true when stderr, where the progress is written, is a terminal
+func IsTerminal() bool {
+	return isatty.IsTerminal(os.Stderr.Fd()) || isatty.IsCygwinTerminal(os.Stderr.Fd())
+}
+
+// NewTracker creates a tracker which writes to ui.  On a terminal the progress is redrawn as
+// files are transferred, otherwise only a summary is written when it finishes.
+func NewTracker(ui cli.Ui, action Action, terminal bool) *Tracker {
+	return &Tracker{
+		ui:       ui,
+		action:   action,
+		terminal: terminal,
+		started:  time.Now(),
+		files:    map[string]*file{},
+	}
+}
+
+// Tracker counts the files and bytes transferred by a command.  A nil Tracker does nothing, so
+// code which reports progress doesn't need to check for one.
+type Tracker struct {
+	ui       cli.Ui
+	action   Action
+	terminal bool
+	started  time.Time
+
+	lock sync.Mutex
+
+	expectedFiles int
+	expectedBytes int64
+
+	files     map[string]*file
+	completed int
+	hits      int
+	hitBytes  int64
+
+	current  *file
+	rendered time.Time
+	drawn    bool
+}
+
+type file struct {
+	name     string
+	size     int64
+	position int64
+	done     bool
+}
+
+type trackerKey struct{}
+
+// WithTracker returns a context which carries the tracker to the backends
+func WithTracker(ctx context.Context, tracker *Tracker) context.Context {
+	return context.WithValue(ctx, trackerKey{}, tracker)
+}
+
+// FromContext returns the context's tracker, or nil if it has none
+func FromContext(ctx context.Context) *Tracker {
+	tracker, _ := ctx.Value(trackerKey{}).(*Tracker)
+	return tracker
+}
+
+// Expect adds to the number of files and bytes which will be transferred, for the total and
+// time remaining.  Sizes which aren't known are negative.
+func (t *Tracker) Expect(files int, bytes int64) {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.expectedFiles += files
+	if bytes > 0 {
+		t.expectedBytes += bytes
+	}
+}
+
+// CacheHit records a file which didn't need transferring
+func (t *Tracker) CacheHit(name string, size int64) {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.hits++
+	t.completed++
+	if size > 0 {
+		t.hitBytes += size
+	}
+
+	t.render(false)
+}
+
+// Reader counts what is read from r as the progress of the named file, which is complete once
+// r is closed.  If r is an io.ReadSeeker, so is the returned reader, and seeking moves the
+// file's progress too, so content which is read twice (e.g. to hash it) isn't counted twice.
+// If r is also an io.ReaderAt, so is the returned reader, so parts of it can be read at once.
+func (t *Tracker) Reader(name string, size int64, r io.ReadCloser) io.ReadCloser {
+	if t == nil {
+		return r
+	}
+
+	t.lock.Lock()
+	f := &file{name: name, size: size}
+	t.files[name] = f
+	t.lock.Unlock()
+
+	counting := &countingReader{tracker: t, file: f, reader: r}
+
+	if seeker, ok := r.(io.ReadSeeker); ok {
+		readSeeker := &countingReadSeeker{countingReader: counting, seeker: seeker}
+
+		if at, ok := r.(io.ReaderAt); ok {
+			return &countingReaderAt{countingReadSeeker: readSeeker, at: at}
+		}
+
+		return readSeeker
+	}
+
+	return counting
+}
+
+func (t *Tracker) moved(f *file, position int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	f.position = position
+	t.current = f
+
+	t.render(false)
+}
+
+func (t *Tracker) advanced(f *file, n int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	f.position += n
+	t.current = f
+
+	t.render(false)
+}
+
+func (t *Tracker) closed(f *file) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if f.done {
+		return
+	}
+
+	f.done = true
+	t.completed++
+
+	t.render(false)
+}
+
+// Finish writes the summary of everything transferred, if anything was
+func (t *Tracker) Finish() {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.completed == 0 && len(t.files) == 0 {
+		return
+	}
+
+	elapsed := time.Since(t.started)
+	bytes := t.transferred()
+
+	line := fmt.Sprintf("%s %d files, %s in %s (%s/s)",
+		t.action.Done,
+		t.completed,
+		formatBytes(bytes),
+		elapsed.Round(100*time.Millisecond),
+		formatBytes(rate(bytes, elapsed)),
+	)
+
+	if t.hits > 0 {
+		line += fmt.Sprintf(", %d from the cache", t.hits)
+	}
+
+	t.write(line)
+}
+
+// transferred is the bytes read from every file which wasn't a cache hit
+func (t *Tracker) transferred() int64 {
+	total := int64(0)
+	for _, f := range t.files {
+		total += f.position
+	}
+
+	return total
+}
+
+// render redraws the progress line on a terminal, at most every renderInterval unless forced
+func (t *Tracker) render(force bool) {
+	if !t.terminal {
+		return
+	}
+
+	if !force && time.Since(t.rendered) < renderInterval {
+		return
+	}
+
+	t.rendered = time.Now()
+
+	elapsed := time.Since(t.started)
+	bytes := t.transferred()
+	speed := rate(bytes, elapsed)
+
+	line := fmt.Sprintf("%s %d/%d files, %s", t.action.Running, t.completed, max(t.expectedFiles, len(t.files)), formatBytes(bytes))
+
+	// the cache hits aren't transferred, so they don't count towards the time remaining
+	if remaining := t.expectedBytes - t.hitBytes; remaining > 0 {
+		line += " of " + formatBytes(remaining)
+
+		if speed > 0 && remaining > bytes {
+			eta := time.Duration(float64(remaining-bytes) / float64(speed) * float64(time.Second))
+			line += fmt.Sprintf(", %s/s, %s left", formatBytes(speed), eta.Round(time.Second))
+		}
+	} else if speed > 0 {
+		line += fmt.Sprintf(", %s/s", formatBytes(speed))
+	}
+
+	if f := t.current; f != nil && !f.done {
+		line += ": " + f.name
+		if f.size > 0 {
+			line += fmt.Sprintf(" %d%%", min(100, f.position*100/f.size))
+		}
+	}
+
+	t.write(line)
+}
+
+// write replaces the progress line on a terminal, rather than adding another
+func (t *Tracker) write(line string) {
+	if t.terminal && t.drawn {
+		line = "\x1b[1A\x1b[2K" + line
+	}
+
+	t.drawn = true
+	t.ui.Warn(line)
+}
+
+type countingReader struct {
+	tracker  *Tracker
+	file     *file
+	reader   io.ReadCloser
+	position int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+
+	if n > 0 {
+		r.position += int64(n)
+		r.tracker.moved(r.file, r.position)
+	}
+
+	return n, err
+}
+
+func (r *countingReader) Close() error {
+	r.tracker.closed(r.file)
+	return r.reader.Close()
+}
+
+type countingReadSeeker struct {
+	*countingReader
+	seeker io.ReadSeeker
+}
+
+func (r *countingReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	position, err := r.seeker.Seek(offset, whence)
+	if err != nil {
+		return position, err
+	}
+
+	r.position = position
+	r.tracker.moved(r.file, position)
+
+	return position, nil
+}
+
+// countingReaderAt counts reads at an offset as progress, as each part of the content is read
+// once, in any order
+type countingReaderAt struct {
+	*countingReadSeeker
+	at io.ReaderAt
+}
+
+func (r *countingReaderAt) ReadAt(p []byte, offset int64) (int, error) {
+	n, err := r.at.ReadAt(p, offset)
+
+	if n > 0 {
+		r.tracker.advanced(r.file, int64(n))
+	}
+
+	return n, err
+}
+
+func rate(bytes int64, elapsed time.Duration) int64 {
+	if elapsed <= 0 {
+		return 0
+	}
+
+	return int64(float64(bytes) / elapsed.Seconds())
+}
+
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	value := float64(bytes)
+	suffix := 0
+	for value >= unit && suffix < 4 {
+		value /= unit
+		suffix++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", value, "KMGT"[suffix-1])
+}
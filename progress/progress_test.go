@@ -0,0 +1,127 @@
+package progress
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/cli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type seekable struct {
+	*strings.Reader
+}
+
+func (s seekable) Close() error {
+	return nil
+}
+
+func TestSummary(t *testing.T) {
+	ui := cli.NewMockUi()
+	tracker := NewTracker(ui, Pull, false)
+	tracker.Expect(2, 10)
+
+	reader := tracker.Reader("one", 5, seekable{strings.NewReader("hello")})
+
+	// reading seekable content again doesn't count it twice
+	_, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	_, err = reader.(io.Seeker).Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	_, err = io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+
+	tracker.CacheHit("two", 5)
+
+	// nothing is written until the end when it isn't a terminal
+	assert.Empty(t, ui.ErrorWriter.String())
+
+	tracker.Finish()
+
+	output := ui.ErrorWriter.String()
+	assert.True(t, strings.HasPrefix(output, "Pulled 2 files, 5 B in "), output)
+	assert.Contains(t, output, ", 1 from the cache")
+	assert.Empty(t, ui.OutputWriter.String())
+}
+
+func TestReaderAt(t *testing.T) {
+	ui := cli.NewMockUi()
+	tracker := NewTracker(ui, Push, false)
+	tracker.Expect(1, 10)
+
+	reader := tracker.Reader("one", 10, seekable{strings.NewReader("helloworld")})
+
+	// parts of seekable content can be read at once, each counting towards its progress
+	at, ok := reader.(io.ReaderAt)
+	require.True(t, ok)
+
+	part := make([]byte, 5)
+	_, err := at.ReadAt(part, 5)
+	require.NoError(t, err)
+	_, err = at.ReadAt(part, 0)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+
+	tracker.Finish()
+
+	assert.True(t, strings.HasPrefix(ui.ErrorWriter.String(), "Pushed 1 files, 10 B in "), ui.ErrorWriter.String())
+}
+
+func TestSummaryWithoutFiles(t *testing.T) {
+	ui := cli.NewMockUi()
+	NewTracker(ui, Fetch, false).Finish()
+
+	assert.Empty(t, ui.ErrorWriter.String())
+}
+
+func TestTerminalRedraws(t *testing.T) {
+	ui := cli.NewMockUi()
+	tracker := NewTracker(ui, Push, true)
+	tracker.Expect(1, 2048)
+
+	reader := tracker.Reader("dist/app", 2048, io.NopCloser(strings.NewReader(strings.Repeat("a", 2048))))
+	_, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	reader.Close()
+
+	tracker.Finish()
+
+	lines := strings.Split(strings.TrimSpace(ui.ErrorWriter.String()), "\n")
+	require.Len(t, lines, 2)
+
+	// redrawing is throttled, so only the first read is shown
+	assert.True(t, strings.HasPrefix(lines[0], "Pushing 0/1 files, 512 B of 2.0 KiB, "), lines[0])
+	assert.True(t, strings.HasSuffix(lines[0], ": dist/app 25%"), lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], "\x1b[1A\x1b[2KPushed 1 files, 2.0 KiB in "), lines[1])
+}
+
+func TestNilTracker(t *testing.T) {
+	tracker := FromContext(context.Background())
+	assert.Nil(t, tracker)
+
+	content := io.NopCloser(strings.NewReader("content"))
+	assert.Equal(t, content, tracker.Reader("file", 7, content))
+
+	tracker.Expect(1, 7)
+	tracker.CacheHit("file", 7)
+	tracker.Finish()
+}
+
+func TestFormatBytes(t *testing.T) {
+	cases := map[int64]string{
+		0:                      "0 B",
+		1023:                   "1023 B",
+		1024:                   "1.0 KiB",
+		1536:                   "1.5 KiB",
+		10 * 1024 * 1024:       "10.0 MiB",
+		3 * 1024 * 1024 * 1024: "3.0 GiB",
+	}
+
+	for bytes, expected := range cases {
+		assert.Equal(t, expected, formatBytes(bytes))
+	}
+}
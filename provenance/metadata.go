@@ -0,0 +1,94 @@
+package provenance
+
+import (
+	"bytes"
+	"cas/backends"
+	"cas/debug"
+	"cas/tracing"
+	"cas/version"
+	"context"
+	"encoding/json"
+	"path"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Record writes the provenance of the hash's artifacts.  The build is taken to start when the
+// hash was created by `fetch`, and to finish now.
+func Record(ctx context.Context, backend backends.Backend, hash string) (*Statement, error) {
+	ctx, span := otel.Tracer("provenance").Start(ctx, "record")
+	defer span.End()
+
+	artifacts, _, err := backends.ReadArtifactManifest(ctx, backend, hash)
+	if err != nil {
+		return nil, tracing.Error(span, err)
+	}
+
+	hashesKey := path.Join("@debug", debug.HashesKey)
+	meta, err := backend.ReadMetadata(ctx, hash, []string{hashesKey})
+	if err != nil {
+		return nil, tracing.Error(span, err)
+	}
+
+	started, _, err := backends.ReadTimestamp(ctx, backend, hash)
+	if err != nil {
+		return nil, tracing.Error(span, err)
+	}
+
+	environment := map[string]string{}
+	for _, kv := range debug.EnvironmentData() {
+		environment[string(kv.Key)] = kv.Value.AsString()
+	}
+
+	statement := NewStatement(Build{
+		Hash:        hash,
+		Artifacts:   artifacts,
+		Inputs:      debug.UnmarshalIntermediates([]byte(meta[hashesKey])),
+		Environment: environment,
+		Version:     version.VersionNumber(),
+		StartedOn:   started,
+		FinishedOn:  time.Now().Truncate(time.Second),
+	})
+
+	span.SetAttributes(
+		attribute.Int("subjects", len(statement.Subject)),
+		attribute.Int("dependencies", len(statement.Predicate.BuildDefinition.ResolvedDependencies)),
+	)
+
+	content, err := json.Marshal(statement)
+	if err != nil {
+		return nil, tracing.Error(span, err)
+	}
+
+	if err := backend.WriteMetadata(ctx, hash, MetadataProvenance, bytes.NewReader(content)); err != nil {
+		return nil, tracing.Error(span, err)
+	}
+
+	return statement, nil
+}
+
+// Read returns the hash's provenance, and false if it has none.  The raw json is also returned,
+// so it can be printed exactly as stored.
+func Read(ctx context.Context, backend backends.Backend, hash string) (*Statement, []byte, bool, error) {
+	ctx, span := otel.Tracer("provenance").Start(ctx, "read")
+	defer span.End()
+
+	meta, err := backend.ReadMetadata(ctx, hash, []string{MetadataProvenance})
+	if err != nil {
+		return nil, nil, false, tracing.Error(span, err)
+	}
+
+	content, found := meta[MetadataProvenance]
+	if !found {
+		return nil, nil, false, nil
+	}
+
+	statement := &Statement{}
+	if err := json.Unmarshal([]byte(content), statement); err != nil {
+		return nil, nil, false, tracing.Error(span, err)
+	}
+
+	return statement, []byte(content), true, nil
+}
@@ -0,0 +1,228 @@
+package provenance
+
+import (
+	"cas/backends"
+	"cas/hashing"
+	"fmt"
+	"os"
+	"time"
+)
+
+// MetadataProvenance holds the json in-toto Statement describing how a hash's artifacts were built
+const MetadataProvenance = "@provenance"
+
+const (
+	StatementType  = "https://in-toto.io/Statement/v1"
+	PredicateType  = "https://slsa.dev/provenance/v1"
+	BuildType      = "https://github.com/Pondidum/cas/build-types/artifact-push@v1"
+	DefaultBuilder = "https://github.com/Pondidum/cas"
+)
+
+// Statement is an in-toto Statement, with a SLSA provenance predicate
+type Statement struct {
+	Type          string               `json:"_type"`
+	Subject       []ResourceDescriptor `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     Predicate            `json:"predicate"`
+}
+
+type ResourceDescriptor struct {
+	Name   string            `json:"name,omitempty"`
+	URI    string            `json:"uri,omitempty"`
+	Digest map[string]string `json:"digest"`
+}
+
+type Predicate struct {
+	BuildDefinition BuildDefinition `json:"buildDefinition"`
+	RunDetails      RunDetails      `json:"runDetails"`
+}
+
+type BuildDefinition struct {
+	BuildType            string               `json:"buildType"`
+	ExternalParameters   ExternalParameters   `json:"externalParameters"`
+	InternalParameters   map[string]string    `json:"internalParameters,omitempty"`
+	ResolvedDependencies []ResourceDescriptor `json:"resolvedDependencies"`
+}
+
+type ExternalParameters struct {
+	// Hash is the cas hash the artifacts were pushed to
+	Hash     string `json:"hash"`
+	Workflow string `json:"workflow,omitempty"`
+}
+
+type RunDetails struct {
+	Builder  Builder       `json:"builder"`
+	Metadata BuildMetadata `json:"metadata"`
+}
+
+type Builder struct {
+	ID      string            `json:"id"`
+	Version map[string]string `json:"version,omitempty"`
+}
+
+type BuildMetadata struct {
+	InvocationID string     `json:"invocationId,omitempty"`
+	StartedOn    *time.Time `json:"startedOn,omitempty"`
+	FinishedOn   *time.Time `json:"finishedOn,omitempty"`
+}
+
+// Build describes the build which produced a hash's artifacts
+type Build struct {
+	Hash      string
+	Artifacts backends.ArtifactManifest
+
+	// Inputs are the files the hash was computed from, as written to `@debug/hashes`
+	Inputs []hashing.FileHash
+
+	// Environment is the CI environment, see debug.EnvironmentData
+	Environment map[string]string
+
+	Version    string
+	StartedOn  time.Time
+	FinishedOn time.Time
+}
+
+// NewStatement creates the provenance for a build.  Subjects are the artifacts with their
+// stored digests, and the input files are its resolved dependencies (SLSA's materials).
+func NewStatement(build Build) *Statement {
+	subjects := make([]ResourceDescriptor, 0, len(build.Artifacts))
+	for _, name := range build.Artifacts.Paths() {
+		subjects = append(subjects, ResourceDescriptor{
+			Name:   name,
+			Digest: map[string]string{"sha1": build.Artifacts[name].Digest},
+		})
+	}
+
+	dependencies := []ResourceDescriptor{}
+	if source := sourceDependency(); source != nil {
+		dependencies = append(dependencies, *source)
+	}
+
+	for _, input := range build.Inputs {
+		dependencies = append(dependencies, ResourceDescriptor{
+			Name:   input.Path,
+			Digest: map[string]string{digestAlgorithm(input.Hash): input.Hash},
+		})
+	}
+
+	statement := &Statement{
+		Type:          StatementType,
+		Subject:       subjects,
+		PredicateType: PredicateType,
+		Predicate: Predicate{
+			BuildDefinition: BuildDefinition{
+				BuildType: BuildType,
+				ExternalParameters: ExternalParameters{
+					Hash:     build.Hash,
+					Workflow: os.Getenv("GITHUB_WORKFLOW_REF"),
+				},
+				InternalParameters:   build.Environment,
+				ResolvedDependencies: dependencies,
+			},
+			RunDetails: RunDetails{
+				Builder: Builder{
+					ID:      builderID(),
+					Version: map[string]string{"cas": build.Version},
+				},
+				Metadata: BuildMetadata{
+					InvocationID: invocationID(),
+				},
+			},
+		},
+	}
+
+	if !build.StartedOn.IsZero() {
+		statement.Predicate.RunDetails.Metadata.StartedOn = &build.StartedOn
+	}
+
+	if !build.FinishedOn.IsZero() {
+		statement.Predicate.RunDetails.Metadata.FinishedOn = &build.FinishedOn
+	}
+
+	return statement
+}
+
+// Verify checks the statement describes the given hash, and that its subjects are exactly the
+// hash's artifacts.
+func (s *Statement) Verify(hash string, artifacts backends.ArtifactManifest) error {
+	if s.Type != StatementType || s.PredicateType != PredicateType {
+		return fmt.Errorf("provenance is a %s statement of %s, expected %s of %s", s.Type, s.PredicateType, StatementType, PredicateType)
+	}
+
+	if s.Predicate.BuildDefinition.ExternalParameters.Hash != hash {
+		return fmt.Errorf("provenance is for hash %s, not %s", s.Predicate.BuildDefinition.ExternalParameters.Hash, hash)
+	}
+
+	subjects := map[string]string{}
+	for _, subject := range s.Subject {
+		subjects[subject.Name] = subject.Digest["sha1"]
+	}
+
+	for _, name := range artifacts.Paths() {
+		digest, found := subjects[name]
+		if !found {
+			return fmt.Errorf("provenance has no subject for %s", name)
+		}
+
+		if digest != artifacts[name].Digest {
+			return fmt.Errorf("provenance has digest %s for %s, but the artifact's digest is %s", digest, name, artifacts[name].Digest)
+		}
+
+		delete(subjects, name)
+	}
+
+	for name := range subjects {
+		return fmt.Errorf("provenance has a subject %s, which isn't an artifact of the hash", name)
+	}
+
+	return nil
+}
+
+// digestAlgorithm names the algorithm of an input's hash, which `fetch --algorithm` chose
+func digestAlgorithm(hex string) string {
+	switch len(hex) {
+	case 32:
+		return hashing.AlgorithmMd5
+	case 40:
+		return hashing.AlgorithmSha1
+	case 128:
+		return hashing.AlgorithmSha512
+	}
+
+	return hashing.AlgorithmSha256
+}
+
+func builderID() string {
+	if server, workflow := os.Getenv("GITHUB_SERVER_URL"), os.Getenv("GITHUB_WORKFLOW_REF"); server != "" && workflow != "" {
+		return server + "/" + workflow
+	}
+
+	return DefaultBuilder
+}
+
+func invocationID() string {
+	server, repository, run := os.Getenv("GITHUB_SERVER_URL"), os.Getenv("GITHUB_REPOSITORY"), os.Getenv("GITHUB_RUN_ID")
+	if server == "" || repository == "" || run == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("%s/%s/actions/runs/%s/attempts/%s", server, repository, run, os.Getenv("GITHUB_RUN_ATTEMPT"))
+}
+
+// sourceDependency is the commit being built, when running in github actions
+func sourceDependency() *ResourceDescriptor {
+	server, repository, sha := os.Getenv("GITHUB_SERVER_URL"), os.Getenv("GITHUB_REPOSITORY"), os.Getenv("GITHUB_SHA")
+	if server == "" || repository == "" || sha == "" {
+		return nil
+	}
+
+	uri := fmt.Sprintf("git+%s/%s", server, repository)
+	if ref := os.Getenv("GITHUB_REF"); ref != "" {
+		uri += "@" + ref
+	}
+
+	return &ResourceDescriptor{
+		URI:    uri,
+		Digest: map[string]string{"gitCommit": sha},
+	}
+}
@@ -0,0 +1,70 @@
+package provenance
+
+import (
+	"cas/backends"
+	"cas/hashing"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewStatement(t *testing.T) {
+	t.Setenv("GITHUB_SERVER_URL", "https://github.com")
+	t.Setenv("GITHUB_REPOSITORY", "org/repo")
+	t.Setenv("GITHUB_WORKFLOW_REF", "org/repo/.github/workflows/build.yml@refs/heads/main")
+	t.Setenv("GITHUB_REF", "refs/heads/main")
+	t.Setenv("GITHUB_SHA", "abc123")
+	t.Setenv("GITHUB_RUN_ID", "42")
+	t.Setenv("GITHUB_RUN_ATTEMPT", "1")
+
+	artifacts := backends.ArtifactManifest{
+		"dist/b": {Digest: "bbbb", Size: 1},
+		"dist/a": {Digest: "aaaa", Size: 1},
+	}
+
+	statement := NewStatement(Build{
+		Hash:      "the-hash",
+		Artifacts: artifacts,
+		Inputs: []hashing.FileHash{
+			{Path: "main.go", Hash: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		},
+		Version:    "local",
+		StartedOn:  time.Unix(1000, 0),
+		FinishedOn: time.Unix(2000, 0),
+	})
+
+	assert.Equal(t, []ResourceDescriptor{
+		{Name: "dist/a", Digest: map[string]string{"sha1": "aaaa"}},
+		{Name: "dist/b", Digest: map[string]string{"sha1": "bbbb"}},
+	}, statement.Subject)
+
+	assert.Equal(t, []ResourceDescriptor{
+		{URI: "git+https://github.com/org/repo@refs/heads/main", Digest: map[string]string{"gitCommit": "abc123"}},
+		{Name: "main.go", Digest: map[string]string{"sha256": "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"}},
+	}, statement.Predicate.BuildDefinition.ResolvedDependencies)
+
+	assert.Equal(t, "https://github.com/org/repo/.github/workflows/build.yml@refs/heads/main", statement.Predicate.RunDetails.Builder.ID)
+	assert.Equal(t, "https://github.com/org/repo/actions/runs/42/attempts/1", statement.Predicate.RunDetails.Metadata.InvocationID)
+
+	require.NoError(t, statement.Verify("the-hash", artifacts))
+	assert.ErrorContains(t, statement.Verify("other-hash", artifacts), "not other-hash")
+
+	changed := backends.ArtifactManifest{
+		"dist/a": {Digest: "aaaa", Size: 1},
+		"dist/b": {Digest: "cccc", Size: 1},
+	}
+	assert.ErrorContains(t, statement.Verify("the-hash", changed), "digest bbbb for dist/b")
+
+	added := backends.ArtifactManifest{
+		"dist/a": artifacts["dist/a"],
+		"dist/b": artifacts["dist/b"],
+		"dist/c": {Digest: "cccc", Size: 1},
+	}
+	assert.ErrorContains(t, statement.Verify("the-hash", added), "no subject for dist/c")
+
+	delete(added, "dist/c")
+	delete(added, "dist/b")
+	assert.ErrorContains(t, statement.Verify("the-hash", added), "subject dist/b")
+}